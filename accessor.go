@@ -0,0 +1,52 @@
+package taptun
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// accessor reads and writes through its own duplicate of the device's file
+// descriptor, so stopping it can interrupt pending operations by closing
+// that descriptor without affecting the Interface or other accessors.
+type accessor struct {
+	ifce *Interface
+	file *os.File
+
+	once sync.Once
+}
+
+func (a *accessor) Write(p []byte) (n int, err error) {
+	n, err = a.file.Write(p)
+	return n, mapStopped(err)
+}
+
+func (a *accessor) Read(p []byte) (n int, err error) {
+	n, err = a.file.Read(p)
+	return n, mapStopped(err)
+}
+
+func (a *accessor) Stop() bool {
+	stopped := a.stop()
+	if stopped {
+		a.ifce.release(a)
+	}
+	return stopped
+}
+
+func (a *accessor) stop() bool {
+	stopped := false
+	a.once.Do(func() {
+		a.file.Close()
+		stopped = true
+	})
+	return stopped
+}
+
+func mapStopped(err error) error {
+	if errors.Is(err, os.ErrClosed) {
+		return io.EOF
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package taptun
+
+import (
+	"net"
+	"sync"
+
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+var broadcastMAC = net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// ARPResponder answers ARP requests for a set of IPv4 addresses on behalf
+// of a userspace host attached to a TAP device, and learns the addresses
+// of its neighbors from the ARP traffic it sees.
+type ARPResponder struct {
+	mac   net.HardwareAddr
+	cache *NeighborCache
+
+	mu    sync.Mutex
+	addrs map[[4]byte]struct{}
+}
+
+// Creates a responder answering for ips with mac. Learned neighbors expire
+// after DefaultNeighborTimeout.
+func NewARPResponder(mac net.HardwareAddr, ips ...net.IP) *ARPResponder {
+	r := &ARPResponder{
+		mac:   mac,
+		cache: NewNeighborCache(DefaultNeighborTimeout),
+		addrs: make(map[[4]byte]struct{}),
+	}
+	for _, ip := range ips {
+		r.AddAddress(ip)
+	}
+	return r
+}
+
+// Starts answering for the IPv4 address ip.
+func (r *ARPResponder) AddAddress(ip net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key, ok := arpKey(ip); ok {
+		r.addrs[key] = struct{}{}
+	}
+}
+
+// Stops answering for the IPv4 address ip.
+func (r *ARPResponder) RemoveAddress(ip net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key, ok := arpKey(ip); ok {
+		delete(r.addrs, key)
+	}
+}
+
+// Returns the cache of neighbors learned by r.
+func (r *ARPResponder) Neighbors() *NeighborCache {
+	return r.cache
+}
+
+// Processes a frame read from the TAP device and returns a reply to write
+// back, or nil. Frames other than untagged ARP for IPv4 are ignored.
+//
+// Following RFC 826, the sender of a request or reply refreshes its cache
+// entry if it has one and is added if the packet is addressed to one of
+// r's addresses.
+func (r *ARPResponder) Handle(frame []byte) []byte {
+	if len(frame) < 14 || pktutil.MACTagging(frame) != pktutil.NotTagged || pktutil.MACEthertype(frame) != pktutil.ARP {
+		return nil
+	}
+	pkt := pktutil.MACPayload(frame)
+	if !pktutil.IsARPEthernetIPv4(pkt) {
+		return nil
+	}
+	senderIP := pktutil.ARPSenderIP(pkt)
+	senderMAC := pktutil.ARPSenderMAC(pkt)
+	targetIP := pktutil.ARPTargetIP(pkt)
+	if senderIP.IsUnspecified() {
+		// address probes must not be learned
+		senderMAC = nil
+	}
+
+	if senderMAC != nil {
+		r.cache.Update(senderIP, senderMAC)
+	}
+	if !r.owns(targetIP) || targetIP.Equal(senderIP) {
+		return nil
+	}
+	if senderMAC != nil {
+		r.cache.Add(senderIP, senderMAC)
+	}
+	if pktutil.ARPOperation(pkt) != pktutil.ARPOpRequest {
+		return nil
+	}
+	reply := pktutil.NewARPReply(r.mac, targetIP, pktutil.ARPSenderMAC(pkt), senderIP)
+	return r.frame(pktutil.ARPSenderMAC(pkt), reply)
+}
+
+// Returns a broadcast frame asking for the address of targetIP on behalf
+// of senderIP, one of r's addresses.
+func (r *ARPResponder) Request(senderIP, targetIP net.IP) []byte {
+	return r.frame(broadcastMAC, pktutil.NewARPRequest(r.mac, senderIP, targetIP))
+}
+
+// Returns gratuitous ARP frames announcing each of r's addresses, to be
+// sent when the host comes up or its address changes.
+func (r *ARPResponder) Announce() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var frames [][]byte
+	for key := range r.addrs {
+		ip := net.IP(key[:])
+		frames = append(frames, r.frame(broadcastMAC, pktutil.NewGratuitousARP(r.mac, ip)))
+	}
+	return frames
+}
+
+func (r *ARPResponder) owns(ip net.IP) bool {
+	key, ok := arpKey(ip)
+	if !ok {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, owned := r.addrs[key]
+	return owned
+}
+
+func (r *ARPResponder) frame(dst net.HardwareAddr, arp []byte) []byte {
+	frame, _ := pktutil.Serialize(&pktutil.EthernetFrame{
+		Destination: dst,
+		Source:      r.mac,
+		Ethertype:   pktutil.ARP,
+	}, pktutil.Payload(arp))
+	return frame
+}
+
+func arpKey(ip net.IP) ([4]byte, bool) {
+	var key [4]byte
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return key, false
+	}
+	copy(key[:], ip4)
+	return key, true
+}
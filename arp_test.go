@@ -0,0 +1,109 @@
+package taptun_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/catalyzeio/taptun"
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+var (
+	arpLocalMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	arpPeerMAC  = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	arpLocalIP  = net.ParseIP("10.0.0.1")
+	arpPeerIP   = net.ParseIP("10.0.0.2")
+)
+
+func arpFrame(t *testing.T, src net.HardwareAddr, arp []byte) []byte {
+	t.Helper()
+	frame, err := pktutil.Serialize(&pktutil.EthernetFrame{
+		Destination: net.HardwareAddr{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+		Source:      src,
+		Ethertype:   pktutil.ARP,
+	}, pktutil.Payload(arp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestARPResponderRequest(t *testing.T) {
+	r := taptun.NewARPResponder(arpLocalMAC, arpLocalIP)
+	reply := r.Handle(arpFrame(t, arpPeerMAC, pktutil.NewARPRequest(arpPeerMAC, arpPeerIP, arpLocalIP)))
+	if reply == nil {
+		t.Fatal("no reply")
+	}
+	if pktutil.MACDestination(reply).String() != arpPeerMAC.String() || pktutil.MACSource(reply).String() != arpLocalMAC.String() {
+		t.Errorf("reply from %s to %s", pktutil.MACSource(reply), pktutil.MACDestination(reply))
+	}
+	arp := pktutil.MACPayload(reply)
+	if pktutil.ARPOperation(arp) != pktutil.ARPOpReply ||
+		!pktutil.ARPSenderIP(arp).Equal(arpLocalIP) || pktutil.ARPSenderMAC(arp).String() != arpLocalMAC.String() ||
+		!pktutil.ARPTargetIP(arp).Equal(arpPeerIP) || pktutil.ARPTargetMAC(arp).String() != arpPeerMAC.String() {
+		t.Errorf("reply %x", arp)
+	}
+	// the request was addressed to r, so its sender is learned
+	if mac, ok := r.Neighbors().Lookup(arpPeerIP); !ok || mac.String() != arpPeerMAC.String() {
+		t.Errorf("learned %s, %v", mac, ok)
+	}
+}
+
+func TestARPResponderOtherTarget(t *testing.T) {
+	r := taptun.NewARPResponder(arpLocalMAC, arpLocalIP)
+	request := pktutil.NewARPRequest(arpPeerMAC, arpPeerIP, net.ParseIP("10.0.0.9"))
+	if reply := r.Handle(arpFrame(t, arpPeerMAC, request)); reply != nil {
+		t.Errorf("answered for another address: %x", reply)
+	}
+	if r.Neighbors().Len() != 0 {
+		t.Error("learned from a request for another address")
+	}
+
+	r.RemoveAddress(arpLocalIP)
+	request = pktutil.NewARPRequest(arpPeerMAC, arpPeerIP, arpLocalIP)
+	if reply := r.Handle(arpFrame(t, arpPeerMAC, request)); reply != nil {
+		t.Errorf("answered for a removed address: %x", reply)
+	}
+}
+
+func TestARPResponderProbe(t *testing.T) {
+	r := taptun.NewARPResponder(arpLocalMAC, arpLocalIP)
+	probe := pktutil.NewARPRequest(arpPeerMAC, net.IPv4zero, arpLocalIP)
+	if reply := r.Handle(arpFrame(t, arpPeerMAC, probe)); reply == nil {
+		t.Error("probe for an owned address not answered")
+	}
+	if r.Neighbors().Len() != 0 {
+		t.Error("learned from a probe")
+	}
+}
+
+func TestARPResponderMerge(t *testing.T) {
+	r := taptun.NewARPResponder(arpLocalMAC, arpLocalIP)
+	other := net.ParseIP("10.0.0.9")
+	newMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 3}
+	r.Neighbors().Add(arpPeerIP, arpPeerMAC)
+
+	// a known sender is updated even when the packet is not for r
+	request := pktutil.NewARPRequest(newMAC, arpPeerIP, other)
+	if reply := r.Handle(arpFrame(t, newMAC, request)); reply != nil {
+		t.Errorf("answered for another address: %x", reply)
+	}
+	if mac, ok := r.Neighbors().Lookup(arpPeerIP); !ok || mac.String() != newMAC.String() {
+		t.Errorf("updated to %s, %v", mac, ok)
+	}
+
+	// an unknown sender is only added by packets for r, including replies
+	third := net.ParseIP("10.0.0.3")
+	reply := pktutil.NewARPReply(newMAC, third, arpPeerMAC, other)
+	r.Handle(arpFrame(t, newMAC, reply))
+	if _, ok := r.Neighbors().Lookup(third); ok {
+		t.Error("added from a reply for another address")
+	}
+	reply = pktutil.NewARPReply(newMAC, third, arpLocalMAC, arpLocalIP)
+	if answer := r.Handle(arpFrame(t, newMAC, reply)); answer != nil {
+		t.Errorf("answered a reply: %x", answer)
+	}
+	if mac, ok := r.Neighbors().Lookup(third); !ok || mac.String() != newMAC.String() {
+		t.Errorf("added %s, %v", mac, ok)
+	}
+}
@@ -0,0 +1,440 @@
+package taptun
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+// ConnState classifies a packet against the connections a Conntrack
+// knows, as netfilter's conntrack match does.
+type ConnState byte
+
+const (
+	// The packet starts a connection, or belongs to one that has not seen
+	// a reply yet.
+	ConnNew ConnState = iota
+	// The packet belongs to a connection that has seen packets in both
+	// directions.
+	ConnEstablished
+	// The packet is an ICMP error about a known connection.
+	ConnRelated
+	// The packet does not fit any known connection or state transition.
+	ConnInvalid
+)
+
+var connStateNames = []string{"new", "established", "related", "invalid"}
+
+func (s ConnState) String() string {
+	if int(s) < len(connStateNames) {
+		return connStateNames[s]
+	}
+	return "unknown"
+}
+
+// ConntrackTimeouts sets how long a Conntrack keeps connections without
+// packets, depending on their protocol and state. Zero fields take the
+// value from DefaultConntrackTimeouts.
+type ConntrackTimeouts struct {
+	// TCP connections whose handshake has not completed.
+	TCPHandshake time.Duration
+	// Established TCP connections.
+	TCPEstablished time.Duration
+	// TCP connections after the first FIN. Connections closed by both
+	// FINs or by a RST are kept for FlowClosedTimeout.
+	TCPClosing time.Duration
+	// UDP and other connections that have not seen a reply.
+	UDP time.Duration
+	// UDP and other connections that have seen a reply.
+	UDPStream time.Duration
+	// ICMP and ICMPv6 echo exchanges.
+	ICMP time.Duration
+}
+
+// Timeouts used by NewConntrack for unset ConntrackTimeouts fields. They
+// follow the Linux defaults.
+var DefaultConntrackTimeouts = ConntrackTimeouts{
+	TCPHandshake:   2 * time.Minute,
+	TCPEstablished: 5 * 24 * time.Hour,
+	TCPClosing:     2 * time.Minute,
+	UDP:            30 * time.Second,
+	UDPStream:      3 * time.Minute,
+	ICMP:           30 * time.Second,
+}
+
+// Conn is a snapshot of a connection tracked by a Conntrack.
+type Conn struct {
+	// Key of the packet that started the connection.
+	Key pktutil.FlowKey
+	// State of a TCP connection; TCPStateNone for other protocols.
+	TCP TCPState
+	// Whether a packet was seen from the responder.
+	Replied  bool
+	Start    time.Time
+	LastSeen time.Time
+	Expires  time.Time
+}
+
+// Conntrack follows TCP connections, UDP and other pseudo-connections, and
+// ICMP echo exchanges, classifying each packet it is given. It does not
+// validate TCP sequence numbers, and fragments after the first are
+// classified ConnInvalid, so packets should be reassembled first. It is
+// safe for concurrent use.
+type Conntrack struct {
+	// Pick up TCP connections mid-stream, as Linux does by default, so
+	// that an ACK for an unknown connection starts it as established
+	// instead of being classified ConnInvalid. Only a SYN starts a
+	// connection otherwise. Set before use.
+	Loose bool
+	// Maximum number of connections tracked, like nf_conntrack_max; zero
+	// means no limit. Once it is reached, packets that would start a new
+	// connection are classified ConnInvalid with ErrConntrackFull until
+	// Expire or Remove makes room. Set before use.
+	MaxConns int
+
+	timeouts ConntrackTimeouts
+
+	mu    sync.Mutex
+	conns map[pktutil.FlowKey]*conn
+}
+
+type conn struct {
+	Conn
+	// FINs seen from the initiator (bit 0) and the responder (bit 1).
+	fins byte
+	// Whether the connection was closed by a RST.
+	reset bool
+}
+
+// Creates an empty connection tracker.
+func NewConntrack(timeouts ConntrackTimeouts) *Conntrack {
+	defaults := DefaultConntrackTimeouts
+	if timeouts.TCPHandshake == 0 {
+		timeouts.TCPHandshake = defaults.TCPHandshake
+	}
+	if timeouts.TCPEstablished == 0 {
+		timeouts.TCPEstablished = defaults.TCPEstablished
+	}
+	if timeouts.TCPClosing == 0 {
+		timeouts.TCPClosing = defaults.TCPClosing
+	}
+	if timeouts.UDP == 0 {
+		timeouts.UDP = defaults.UDP
+	}
+	if timeouts.UDPStream == 0 {
+		timeouts.UDPStream = defaults.UDPStream
+	}
+	if timeouts.ICMP == 0 {
+		timeouts.ICMP = defaults.ICMP
+	}
+	return &Conntrack{
+		timeouts: timeouts,
+		conns:    make(map[pktutil.FlowKey]*conn),
+	}
+}
+
+// Classifies a frame or packet read from ifce and updates the connection
+// it belongs to.
+func (c *Conntrack) ClassifyFrom(ifce *Interface, data []byte) (ConnState, error) {
+	return c.classifyDecoded(ifce.LinkType(), data)
+}
+
+// Classifies the Ethernet frame macFrame and updates the connection it
+// belongs to.
+func (c *Conntrack) ClassifyFrame(macFrame []byte) (ConnState, error) {
+	return c.classifyDecoded(pktutil.LinkTypeEthernet, macFrame)
+}
+
+// Classifies the IPv4 or IPv6 packet and updates the connection it belongs
+// to.
+func (c *Conntrack) ClassifyPacket(packet []byte) (ConnState, error) {
+	return c.classifyDecoded(pktutil.LinkTypeRaw, packet)
+}
+
+func (c *Conntrack) classifyDecoded(linkType pktutil.LinkType, data []byte) (ConnState, error) {
+	var p pktutil.DecodedPacket
+	d := pktutil.Decoder{LinkType: linkType}
+	if err := d.Decode(data, &p); err != nil {
+		return ConnInvalid, err
+	}
+	return c.Classify(&p)
+}
+
+// Classifies a decoded packet and updates the connection it belongs to.
+// Packets that are not IPv4 or IPv6 yield an error wrapping
+// pktutil.ErrUnsupported.
+func (c *Conntrack) Classify(p *pktutil.DecodedPacket) (ConnState, error) {
+	key, err := p.FlowKey()
+	if err != nil {
+		return ConnInvalid, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	switch {
+	case p.Fragment:
+		// a later fragment, whose ports are unknown
+		return ConnInvalid, nil
+	case p.Layers.Has(pktutil.LayerTCP):
+		return c.trackTCP(key, p.TCP.Flags, now)
+	case p.Layers.Has(pktutil.LayerICMP) || p.Layers.Has(pktutil.LayerICMPv6):
+		return c.trackICMP(p, key, now)
+	}
+	e, forward := c.lookup(key, now)
+	if e == nil {
+		if e = c.add(key, now); e == nil {
+			return ConnInvalid, ErrConntrackFull
+		}
+	} else if !forward {
+		e.Replied = true
+	}
+	c.touch(e, now)
+	if e.Replied {
+		return ConnEstablished, nil
+	}
+	return ConnNew, nil
+}
+
+func (c *Conntrack) trackTCP(key pktutil.FlowKey, flags pktutil.TCPFlags, now time.Time) (ConnState, error) {
+	const synAck = pktutil.TCPFlagSYN | pktutil.TCPFlagACK
+	switch {
+	case flags&pktutil.TCPFlagSYN != 0 && flags&(pktutil.TCPFlagFIN|pktutil.TCPFlagRST) != 0,
+		flags&(synAck|pktutil.TCPFlagRST) == 0:
+		// SYN with FIN or RST, or a segment without SYN, ACK or RST
+		return ConnInvalid, nil
+	}
+	syn := flags&synAck == pktutil.TCPFlagSYN
+
+	e, forward := c.lookup(key, now)
+	if e == nil || syn && e.TCP == TCPStateClosed {
+		if syn {
+			// a new connection, possibly reusing the ports of a closed one
+			if e = c.add(key, now); e == nil {
+				return ConnInvalid, ErrConntrackFull
+			}
+			e.TCP = TCPStateSynSent
+			c.touch(e, now)
+			return ConnNew, nil
+		}
+		if !c.Loose || flags&(synAck|pktutil.TCPFlagFIN|pktutil.TCPFlagRST) != pktutil.TCPFlagACK {
+			return ConnInvalid, nil
+		}
+		// a connection whose handshake was missed
+		if e = c.add(key, now); e == nil {
+			return ConnInvalid, ErrConntrackFull
+		}
+		e.TCP = TCPStateEstablished
+		forward = true
+	}
+
+	switch {
+	case flags&pktutil.TCPFlagRST != 0:
+		if e.TCP == TCPStateSynSent && !forward && flags&pktutil.TCPFlagACK == 0 {
+			// a RST refusing a connection must acknowledge its SYN
+			return ConnInvalid, nil
+		}
+		e.TCP = TCPStateClosed
+		e.reset = true
+	case syn:
+		if !forward || e.TCP != TCPStateSynSent {
+			return ConnInvalid, nil
+		}
+	case flags&synAck == synAck:
+		if forward || e.TCP != TCPStateSynSent && e.TCP != TCPStateSynReceived {
+			return ConnInvalid, nil
+		}
+		e.TCP = TCPStateSynReceived
+	default:
+		if e.TCP == TCPStateSynSent || e.reset {
+			return ConnInvalid, nil
+		}
+		if e.TCP == TCPStateSynReceived && forward {
+			e.TCP = TCPStateEstablished
+		}
+		if flags&pktutil.TCPFlagFIN != 0 {
+			if forward {
+				e.fins |= 1
+			} else {
+				e.fins |= 2
+			}
+			e.TCP = TCPStateFinWait
+			if e.fins == 3 {
+				e.TCP = TCPStateClosed
+			}
+		}
+	}
+	if !forward {
+		e.Replied = true
+	}
+	c.touch(e, now)
+	if e.Replied {
+		return ConnEstablished, nil
+	}
+	return ConnNew, nil
+}
+
+func (c *Conntrack) trackICMP(p *pktutil.DecodedPacket, key pktutil.FlowKey, now time.Time) (ConnState, error) {
+	request, reply := byte(pktutil.ICMPv4EchoRequest), byte(pktutil.ICMPv4EchoReply)
+	isError := pktutil.IsICMPv4Error
+	if key.Version == 6 {
+		request, reply = pktutil.ICMPv6EchoRequest, pktutil.ICMPv6EchoReply
+		isError = pktutil.IsICMPv6Error
+	}
+
+	switch t := p.ICMP.Type; {
+	case t == request:
+		e, forward := c.lookup(key, now)
+		if e == nil || !forward {
+			if e = c.add(key, now); e == nil {
+				return ConnInvalid, ErrConntrackFull
+			}
+		}
+		c.touch(e, now)
+		if e.Replied {
+			return ConnEstablished, nil
+		}
+		return ConnNew, nil
+	case t == reply:
+		e, forward := c.lookup(key, now)
+		if e == nil || forward {
+			return ConnInvalid, nil
+		}
+		e.Replied = true
+		c.touch(e, now)
+		return ConnEstablished, nil
+	case isError(t):
+		quoted, err := p.QuotedFlowKey()
+		if err != nil {
+			return ConnInvalid, nil
+		}
+		if e, _ := c.lookup(quoted, now); e == nil {
+			return ConnInvalid, nil
+		}
+		return ConnRelated, nil
+	}
+	// neighbor discovery and other informational messages are not tracked
+	return ConnNew, nil
+}
+
+// Returns the connection of key, in either direction, if it is being
+// tracked.
+func (c *Conntrack) Lookup(key pktutil.FlowKey) (Conn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, _ := c.lookup(key, time.Now())
+	if e == nil {
+		return Conn{}, false
+	}
+	return e.Conn, true
+}
+
+// Stops tracking the connection of key.
+func (c *Conntrack) Remove(key pktutil.FlowKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.conns, key.Canonical())
+}
+
+// Returns snapshots of all tracked connections, including expired ones not
+// yet dropped.
+func (c *Conntrack) Conns() []Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conns := make([]Conn, 0, len(c.conns))
+	for _, e := range c.conns {
+		conns = append(conns, e.Conn)
+	}
+	return conns
+}
+
+// Drops expired connections and returns how many there were. Expired
+// connections are never matched, so calling Expire only frees memory.
+func (c *Conntrack) Expire() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for key, e := range c.conns {
+		if now.After(e.Expires) {
+			delete(c.conns, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the number of tracked connections, including expired ones not
+// yet dropped.
+func (c *Conntrack) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+// Returns the current connection of key, or nil, and whether key is in
+// the direction of the packet that started it.
+func (c *Conntrack) lookup(key pktutil.FlowKey, now time.Time) (*conn, bool) {
+	canonical := key.Canonical()
+	e, ok := c.conns[canonical]
+	if !ok {
+		return nil, false
+	}
+	if now.After(e.Expires) {
+		delete(c.conns, canonical)
+		return nil, false
+	}
+	return e, key == e.Key
+}
+
+// Starts tracking a connection of key, replacing any other of the same
+// flow, or returns nil if there is no room for it.
+func (c *Conntrack) add(key pktutil.FlowKey, now time.Time) *conn {
+	canonical := key.Canonical()
+	if _, ok := c.conns[canonical]; !ok && c.MaxConns > 0 && len(c.conns) >= c.MaxConns {
+		return nil
+	}
+	e := &conn{Conn: Conn{Key: key, Start: now}}
+	c.conns[canonical] = e
+	return e
+}
+
+// Records a packet on e, extending its lifetime according to its state.
+func (c *Conntrack) touch(e *conn, now time.Time) {
+	e.LastSeen = now
+	e.Expires = now.Add(c.timeout(e))
+}
+
+func (c *Conntrack) timeout(e *conn) time.Duration {
+	switch e.Key.Protocol {
+	case pktutil.TCP:
+		switch e.TCP {
+		case TCPStateSynSent, TCPStateSynReceived:
+			return c.timeouts.TCPHandshake
+		case TCPStateEstablished:
+			return c.timeouts.TCPEstablished
+		case TCPStateFinWait:
+			return c.timeouts.TCPClosing
+		}
+		return FlowClosedTimeout
+	case pktutil.ICMP, pktutil.IPv6_ICMP:
+		return c.timeouts.ICMP
+	}
+	if e.Replied {
+		return c.timeouts.UDPStream
+	}
+	return c.timeouts.UDP
+}
+
+// Returns e.g. "tcp 10.0.0.1:1234 > 10.0.0.2:80 established".
+func (c Conn) String() string {
+	if c.Key.Protocol == pktutil.TCP {
+		return fmt.Sprintf("%v %v", c.Key, c.TCP)
+	}
+	if c.Replied {
+		return fmt.Sprintf("%v replied", c.Key)
+	}
+	return c.Key.String()
+}
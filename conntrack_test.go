@@ -0,0 +1,320 @@
+package taptun_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/catalyzeio/taptun"
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+const (
+	connClient = "10.0.0.1"
+	connServer = "10.0.0.2"
+)
+
+func mustPacket(t *testing.T, layers ...pktutil.Layer) []byte {
+	t.Helper()
+	pkt, err := pktutil.Serialize(layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func ipv4Header(src, dst string) *pktutil.IPv4Header {
+	return &pktutil.IPv4Header{Source: net.ParseIP(src), Destination: net.ParseIP(dst)}
+}
+
+// Returns a TCP segment from the client, or from the server if reply is
+// set.
+func tcpSegment(t *testing.T, reply bool, flags pktutil.TCPFlags) []byte {
+	if reply {
+		return mustPacket(t, ipv4Header(connServer, connClient), &pktutil.TCPHeader{SourcePort: 80, DestinationPort: 1000, Flags: flags})
+	}
+	return mustPacket(t, ipv4Header(connClient, connServer), &pktutil.TCPHeader{SourcePort: 1000, DestinationPort: 80, Flags: flags})
+}
+
+func udpDatagram(t *testing.T, reply bool, port uint16) []byte {
+	if reply {
+		return mustPacket(t, ipv4Header(connServer, connClient), &pktutil.UDPHeader{SourcePort: 53, DestinationPort: port})
+	}
+	return mustPacket(t, ipv4Header(connClient, connServer), &pktutil.UDPHeader{SourcePort: port, DestinationPort: 53})
+}
+
+func echoMessage(t *testing.T, reply bool, id byte) []byte {
+	if reply {
+		return mustPacket(t, ipv4Header(connServer, connClient), &pktutil.ICMPHeader{Type: pktutil.ICMPv4EchoReply, Body: []byte{0, id, 0, 1}})
+	}
+	return mustPacket(t, ipv4Header(connClient, connServer), &pktutil.ICMPHeader{Type: pktutil.ICMPv4EchoRequest, Body: []byte{0, id, 0, 1}})
+}
+
+type connPacket struct {
+	name   string
+	packet []byte
+	state  taptun.ConnState
+}
+
+func classifyAll(t *testing.T, c *taptun.Conntrack, packets []connPacket) {
+	t.Helper()
+	for _, p := range packets {
+		state, err := c.ClassifyPacket(p.packet)
+		if err != nil {
+			t.Fatalf("%s: %v", p.name, err)
+		}
+		if state != p.state {
+			t.Errorf("%s: %s, want %s", p.name, state, p.state)
+		}
+	}
+}
+
+func connTCPState(t *testing.T, c *taptun.Conntrack) taptun.TCPState {
+	t.Helper()
+	key, err := pktutil.FlowKeyFromPacket(tcpSegment(t, false, pktutil.TCPFlagACK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, ok := c.Lookup(key)
+	if !ok {
+		t.Fatal("connection not tracked")
+	}
+	return conn.TCP
+}
+
+func TestConntrackTCP(t *testing.T) {
+	const (
+		syn = pktutil.TCPFlagSYN
+		ack = pktutil.TCPFlagACK
+		fin = pktutil.TCPFlagFIN | pktutil.TCPFlagACK
+	)
+	c := taptun.NewConntrack(taptun.ConntrackTimeouts{})
+	classifyAll(t, c, []connPacket{
+		{"syn", tcpSegment(t, false, syn), taptun.ConnNew},
+		{"retransmitted syn", tcpSegment(t, false, syn), taptun.ConnNew},
+		{"syn from responder", tcpSegment(t, true, syn), taptun.ConnInvalid},
+		{"ack before syn-ack", tcpSegment(t, false, ack), taptun.ConnInvalid},
+		{"syn-ack", tcpSegment(t, true, syn|ack), taptun.ConnEstablished},
+		{"retransmitted syn-ack", tcpSegment(t, true, syn|ack), taptun.ConnEstablished},
+		{"syn-ack from initiator", tcpSegment(t, false, syn|ack), taptun.ConnInvalid},
+		{"ack", tcpSegment(t, false, ack), taptun.ConnEstablished},
+	})
+	if s := connTCPState(t, c); s != taptun.TCPStateEstablished {
+		t.Errorf("state %s after handshake", s)
+	}
+
+	classifyAll(t, c, []connPacket{
+		{"data", tcpSegment(t, true, ack|pktutil.TCPFlagPSH), taptun.ConnEstablished},
+		{"fin", tcpSegment(t, false, fin), taptun.ConnEstablished},
+		{"fin reply", tcpSegment(t, true, fin), taptun.ConnEstablished},
+		{"last ack", tcpSegment(t, false, ack), taptun.ConnEstablished},
+		{"no flags", tcpSegment(t, false, 0), taptun.ConnInvalid},
+		{"syn-fin", tcpSegment(t, false, syn|pktutil.TCPFlagFIN), taptun.ConnInvalid},
+	})
+	if s := connTCPState(t, c); s != taptun.TCPStateClosed {
+		t.Errorf("state %s after teardown", s)
+	}
+
+	// the ports of the closed connection are reused
+	classifyAll(t, c, []connPacket{
+		{"new syn", tcpSegment(t, false, syn), taptun.ConnNew},
+		{"new syn-ack", tcpSegment(t, true, syn|ack), taptun.ConnEstablished},
+	})
+	if s := connTCPState(t, c); s != taptun.TCPStateSynReceived || c.Len() != 1 {
+		t.Errorf("state %s with %d connections after reuse", s, c.Len())
+	}
+}
+
+func TestConntrackTCPReset(t *testing.T) {
+	const (
+		syn = pktutil.TCPFlagSYN
+		ack = pktutil.TCPFlagACK
+		rst = pktutil.TCPFlagRST
+	)
+	c := taptun.NewConntrack(taptun.ConntrackTimeouts{})
+	classifyAll(t, c, []connPacket{
+		{"syn", tcpSegment(t, false, syn), taptun.ConnNew},
+		// a RST without ACK cannot answer a SYN
+		{"rst", tcpSegment(t, true, rst), taptun.ConnInvalid},
+	})
+	if s := connTCPState(t, c); s != taptun.TCPStateSynSent {
+		t.Errorf("state %s after rst without ack", s)
+	}
+	classifyAll(t, c, []connPacket{
+		{"rst-ack", tcpSegment(t, true, rst|ack), taptun.ConnEstablished},
+		{"ack after rst", tcpSegment(t, false, ack), taptun.ConnInvalid},
+	})
+	if s := connTCPState(t, c); s != taptun.TCPStateClosed {
+		t.Errorf("state %s after rst", s)
+	}
+
+	// an established connection can be reset from either side
+	c = taptun.NewConntrack(taptun.ConntrackTimeouts{})
+	classifyAll(t, c, []connPacket{
+		{"syn", tcpSegment(t, false, syn), taptun.ConnNew},
+		{"syn-ack", tcpSegment(t, true, syn|ack), taptun.ConnEstablished},
+		{"ack", tcpSegment(t, false, ack), taptun.ConnEstablished},
+		{"rst", tcpSegment(t, false, rst), taptun.ConnEstablished},
+		{"data after rst", tcpSegment(t, true, ack), taptun.ConnInvalid},
+	})
+}
+
+func TestConntrackTCPMidStream(t *testing.T) {
+	const (
+		ack = pktutil.TCPFlagACK
+		fin = pktutil.TCPFlagFIN | pktutil.TCPFlagACK
+		rst = pktutil.TCPFlagRST
+	)
+	c := taptun.NewConntrack(taptun.ConntrackTimeouts{})
+	classifyAll(t, c, []connPacket{
+		{"strict ack", tcpSegment(t, true, ack), taptun.ConnInvalid},
+	})
+	if c.Len() != 0 {
+		t.Errorf("%d connections picked up", c.Len())
+	}
+
+	c = taptun.NewConntrack(taptun.ConntrackTimeouts{})
+	c.Loose = true
+	classifyAll(t, c, []connPacket{
+		{"fin", tcpSegment(t, true, fin), taptun.ConnInvalid},
+		{"rst", tcpSegment(t, true, rst), taptun.ConnInvalid},
+		{"ack", tcpSegment(t, true, ack), taptun.ConnNew},
+		{"ack reply", tcpSegment(t, false, ack), taptun.ConnEstablished},
+	})
+	// the first packet seen makes the server the initiator
+	key, _ := pktutil.FlowKeyFromPacket(tcpSegment(t, true, ack))
+	if conn, ok := c.Lookup(key); !ok || conn.Key != key || conn.TCP != taptun.TCPStateEstablished || !conn.Replied {
+		t.Errorf("picked up %v", conn)
+	}
+}
+
+func TestConntrackUDP(t *testing.T) {
+	timeouts := taptun.ConntrackTimeouts{UDP: 20 * time.Millisecond, UDPStream: time.Minute}
+	c := taptun.NewConntrack(timeouts)
+	classifyAll(t, c, []connPacket{
+		{"request", udpDatagram(t, false, 1000), taptun.ConnNew},
+		{"second request", udpDatagram(t, false, 1000), taptun.ConnNew},
+		{"reply", udpDatagram(t, true, 1000), taptun.ConnEstablished},
+		{"unreplied", udpDatagram(t, false, 1001), taptun.ConnNew},
+	})
+	key, _ := pktutil.FlowKeyFromPacket(udpDatagram(t, false, 1000))
+	conn, ok := c.Lookup(key)
+	if !ok || !conn.Replied || conn.Expires.Sub(conn.LastSeen) != timeouts.UDPStream {
+		t.Errorf("replied %v, expiring after %s", conn, conn.Expires.Sub(conn.LastSeen))
+	}
+	unrepliedKey, _ := pktutil.FlowKeyFromPacket(udpDatagram(t, false, 1001))
+	conn, ok = c.Lookup(unrepliedKey)
+	if !ok || conn.Replied || conn.Expires.Sub(conn.LastSeen) != timeouts.UDP {
+		t.Errorf("unreplied %v, expiring after %s", conn, conn.Expires.Sub(conn.LastSeen))
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Lookup(unrepliedKey); ok {
+		t.Errorf("unreplied connection not expired")
+	}
+	if _, ok := c.Lookup(key); !ok {
+		t.Errorf("replied connection expired")
+	}
+	// a reply to an expired connection starts a new one
+	classifyAll(t, c, []connPacket{
+		{"late reply", udpDatagram(t, true, 1001), taptun.ConnNew},
+	})
+}
+
+func TestConntrackICMP(t *testing.T) {
+	c := taptun.NewConntrack(taptun.ConntrackTimeouts{})
+	classifyAll(t, c, []connPacket{
+		{"unsolicited reply", echoMessage(t, true, 1), taptun.ConnInvalid},
+		{"request", echoMessage(t, false, 1), taptun.ConnNew},
+		{"other id", echoMessage(t, true, 2), taptun.ConnInvalid},
+		{"reply", echoMessage(t, true, 1), taptun.ConnEstablished},
+		{"next request", echoMessage(t, false, 1), taptun.ConnEstablished},
+	})
+
+	// errors are related only to the connections they quote
+	syn := tcpSegment(t, false, pktutil.TCPFlagSYN)
+	classifyAll(t, c, []connPacket{{"syn", syn, taptun.ConnNew}})
+	related, err := pktutil.ICMPDestinationUnreachable(net.ParseIP("10.0.0.254"), 3, syn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unrelated, err := pktutil.ICMPDestinationUnreachable(net.ParseIP("10.0.0.254"), 3, udpDatagram(t, false, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoError, err := pktutil.ICMPTimeExceeded(net.ParseIP("10.0.0.254"), 0, echoMessage(t, false, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	classifyAll(t, c, []connPacket{
+		{"error quoting syn", related, taptun.ConnRelated},
+		{"error quoting echo", echoError, taptun.ConnRelated},
+		{"error quoting unknown", unrelated, taptun.ConnInvalid},
+	})
+}
+
+func TestConntrackFragments(t *testing.T) {
+	c := taptun.NewConntrack(taptun.ConntrackTimeouts{})
+	packets := []struct {
+		name   string
+		mtu    int
+		packet []byte
+	}{
+		{"udp", 576, mustPacket(t, ipv4Header(connClient, connServer), &pktutil.UDPHeader{SourcePort: 1000, DestinationPort: 53}, pktutil.Payload(make([]byte, 1000)))},
+		{"ipv6 udp", pktutil.MinIPv6MTU, mustPacket(t, &pktutil.IPv6Header{Source: net.ParseIP("fd00::1"), Destination: net.ParseIP("fd00::2")},
+			&pktutil.UDPHeader{SourcePort: 1000, DestinationPort: 53}, pktutil.Payload(make([]byte, 2000)))},
+		{"icmp", 576, mustPacket(t, ipv4Header(connClient, connServer), &pktutil.ICMPHeader{Type: pktutil.ICMPv4EchoRequest, Body: make([]byte, 1000)})},
+	}
+	for _, p := range packets {
+		fragments, err := pktutil.NewFragmenter(p.mtu, nil).Fragment(p.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fragments) < 2 {
+			t.Fatalf("%s: %d fragments", p.name, len(fragments))
+		}
+		// only the first fragment carries the ports or echo identifier
+		classified := []connPacket{{p.name + " first fragment", fragments[0], taptun.ConnNew}}
+		for _, fragment := range fragments[1:] {
+			classified = append(classified, connPacket{p.name + " later fragment", fragment, taptun.ConnInvalid})
+		}
+		classifyAll(t, c, classified)
+	}
+	if n := c.Len(); n != len(packets) {
+		t.Errorf("%d connections, want %d", n, len(packets))
+	}
+}
+
+func TestConntrackMaxConns(t *testing.T) {
+	c := taptun.NewConntrack(taptun.ConntrackTimeouts{UDP: 20 * time.Millisecond, UDPStream: time.Minute})
+	c.MaxConns = 2
+	classifyAll(t, c, []connPacket{
+		{"first", udpDatagram(t, false, 1000), taptun.ConnNew},
+		{"second", udpDatagram(t, false, 1001), taptun.ConnNew},
+		{"second reply", udpDatagram(t, true, 1001), taptun.ConnEstablished},
+	})
+	full := []struct {
+		name   string
+		packet []byte
+	}{
+		{"udp", udpDatagram(t, false, 1002)},
+		{"syn", tcpSegment(t, false, pktutil.TCPFlagSYN)},
+		{"echo", echoMessage(t, false, 1)},
+	}
+	for _, p := range full {
+		if state, err := c.ClassifyPacket(p.packet); state != taptun.ConnInvalid || err != taptun.ErrConntrackFull {
+			t.Errorf("%s in a full table: %s, %v", p.name, state, err)
+		}
+	}
+	// known connections are still tracked
+	classifyAll(t, c, []connPacket{
+		{"second again", udpDatagram(t, false, 1001), taptun.ConnEstablished},
+	})
+
+	// the unreplied first connection expires, making room once dropped
+	time.Sleep(40 * time.Millisecond)
+	if n := c.Expire(); n != 1 {
+		t.Errorf("expired %d connections", n)
+	}
+	classifyAll(t, c, []connPacket{{"third", udpDatagram(t, false, 1002), taptun.ConnNew}})
+}
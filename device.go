@@ -0,0 +1,77 @@
+package taptun
+
+import (
+	"net"
+	"os"
+)
+
+// DeviceInfo describes a TUN/TAP device present on the system.
+type DeviceInfo struct {
+	Name         string
+	TAP          bool
+	Persistent   bool
+	Owner        int // -1 if unrestricted
+	Group        int // -1 if unrestricted
+	MTU          int
+	Up           bool
+	Carrier      bool
+	HardwareAddr net.HardwareAddr
+	Addrs        []*net.IPNet
+
+	// Flags the device was created with.
+	flags int
+}
+
+// Returns the TUN/TAP devices currently present on the system.
+func Devices() ([]*DeviceInfo, error) {
+	names, err := listDevices()
+	if err != nil {
+		return nil, wrapError("list", "", err)
+	}
+	var devices []*DeviceInfo
+	for _, name := range names {
+		info, err := lookupDevice(name)
+		if os.IsNotExist(err) {
+			// removed while listing
+			continue
+		}
+		if err != nil {
+			return nil, wrapError("lookup", name, err)
+		}
+		devices = append(devices, info)
+	}
+	return devices, nil
+}
+
+// Returns information about the named TUN/TAP device. The returned error
+// matches os.ErrNotExist if there is no such device, and ErrNotTUNTAP if
+// the device exists but is of another kind.
+func LookupDevice(name string) (*DeviceInfo, error) {
+	info, err := lookupDevice(name)
+	if err != nil {
+		return nil, wrapError("lookup", name, err)
+	}
+	return info, nil
+}
+
+// Attaches to an existing TUN/TAP device, creating an Interface of the
+// matching type. The device keeps the flags it was created with, such as
+// multi-queue, except that packet information headers are turned off.
+func OpenDevice(name string) (*Interface, error) {
+	info, err := LookupDevice(name)
+	if err != nil {
+		return nil, err
+	}
+	return newInterface(name, info.TAP, info.flags)
+}
+
+// Removes the named persistent TUN/TAP device. The device disappears once
+// every process holding it open has closed it.
+func DeleteDevice(name string) error {
+	ifce, err := OpenDevice(name)
+	if err != nil {
+		return err
+	}
+	defer ifce.Close()
+	return ifce.SetPersistent(false)
+}
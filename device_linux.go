@@ -0,0 +1,96 @@
+// +build linux
+
+package taptun
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const sysClassNet = "/sys/class/net"
+
+func listDevices() ([]string, error) {
+	entries, err := ioutil.ReadDir(sysClassNet)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		// only TUN/TAP devices expose tun_flags
+		if _, err := os.Stat(filepath.Join(sysClassNet, e.Name(), "tun_flags")); err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func lookupDevice(name string) (*DeviceInfo, error) {
+	if len(name) == 0 || strings.ContainsRune(name, '/') {
+		return nil, os.ErrNotExist
+	}
+	dir := filepath.Join(sysClassNet, name)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	tunFlags, err := readSysInt(dir, "tun_flags")
+	if os.IsNotExist(err) {
+		return nil, ErrNotTUNTAP
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &DeviceInfo{
+		Name:       name,
+		TAP:        tunFlags&cIFF_TAP != 0,
+		Persistent: tunFlags&cIFF_PERSIST != 0,
+		flags:      tunFlags,
+	}
+	if info.Owner, err = readSysInt(dir, "owner"); err != nil {
+		return nil, err
+	}
+	if info.Group, err = readSysInt(dir, "group"); err != nil {
+		return nil, err
+	}
+	if info.MTU, err = readSysInt(dir, "mtu"); err != nil {
+		return nil, err
+	}
+	flags, err := readSysInt(dir, "flags")
+	if err != nil {
+		return nil, err
+	}
+	info.Up = flags&int(net.FlagUp) != 0
+	// carrier cannot be read while the device is down
+	if carrier, err := readSysInt(dir, "carrier"); err == nil {
+		info.Carrier = carrier != 0
+	}
+
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	info.HardwareAddr = ifi.HardwareAddr
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			info.Addrs = append(info.Addrs, ipNet)
+		}
+	}
+	return info, nil
+}
+
+func readSysInt(dir, attr string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(strings.TrimSpace(string(b)), 0, 64)
+	return int(v), err
+}
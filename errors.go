@@ -0,0 +1,58 @@
+package taptun
+
+import (
+	"errors"
+)
+
+var (
+	// Returned on platforms without TUN/TAP support.
+	ErrUnsupported = errors.New("unsupported platform")
+
+	// Returned when an interface name does not fit in IFNAMSIZ bytes.
+	ErrNameTooLong = errors.New("interface name is too long")
+
+	// Returned when a named device exists but is not a TUN/TAP device.
+	ErrNotTUNTAP = errors.New("not a TUN/TAP device")
+
+	// Returned by operations on an Interface that has been closed.
+	ErrClosed = errors.New("device closed")
+
+	// Returned when duplicate address detection finds an address in use.
+	ErrDuplicateAddress = errors.New("duplicate address")
+
+	// Returned when confirming an address whose detection was not started.
+	ErrNotProbing = errors.New("address is not being probed")
+
+	// Returned when a Conntrack has no room for a new connection.
+	ErrConntrackFull = errors.New("connection table full")
+)
+
+// Error records a failed operation on a TUN/TAP device.
+//
+// The underlying error is usually a syscall.Errno, so callers can test
+// for common conditions with errors.Is and os.ErrPermission,
+// os.ErrNotExist, os.ErrExist, etc.
+type Error struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Name == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.Name + ": " + e.Err.Error()
+}
+
+// Returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func wrapError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Name: name, Err: err}
+}
@@ -0,0 +1,327 @@
+package taptun
+
+import (
+	"sync"
+	"time"
+
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+// Default timeouts for NewFlowTable.
+const (
+	DefaultFlowIdleTimeout   = 5 * time.Minute
+	DefaultFlowActiveTimeout = 30 * time.Minute
+
+	// Time a closed TCP flow is kept for the segments that follow its
+	// final FIN or RST.
+	FlowClosedTimeout = 10 * time.Second
+)
+
+// Number of independently locked parts of a FlowTable.
+const flowShards = 16
+
+// TCPState is the state of a TCP flow as seen by a FlowTable.
+type TCPState byte
+
+const (
+	// Not a TCP flow.
+	TCPStateNone TCPState = iota
+	// The initiator has sent a SYN.
+	TCPStateSynSent
+	// The responder has answered with a SYN-ACK.
+	TCPStateSynReceived
+	// The handshake has completed, or the flow was picked up mid-stream.
+	TCPStateEstablished
+	// One side has sent a FIN.
+	TCPStateFinWait
+	// Both sides have sent a FIN, or either has sent a RST.
+	TCPStateClosed
+)
+
+var tcpStateNames = []string{"none", "syn-sent", "syn-received", "established", "fin-wait", "closed"}
+
+func (s TCPState) String() string {
+	if int(s) < len(tcpStateNames) {
+		return tcpStateNames[s]
+	}
+	return "unknown"
+}
+
+// FlowEvictReason tells why a flow left a FlowTable.
+type FlowEvictReason byte
+
+const (
+	// No packets were seen for the idle timeout.
+	FlowEvictIdle FlowEvictReason = iota
+	// The flow lasted longer than the active timeout.
+	FlowEvictActive
+	// The TCP connection was closed.
+	FlowEvictClosed
+)
+
+// FlowCounters counts the packets and bytes of one direction of a flow.
+type FlowCounters struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// Flow is a snapshot of a flow tracked by a FlowTable.
+type Flow struct {
+	// Key of the first packet seen; its source is the initiator.
+	Key      pktutil.FlowKey
+	Start    time.Time
+	LastSeen time.Time
+	// Packets from the initiator and from the responder.
+	Forward FlowCounters
+	Reverse FlowCounters
+	TCP     TCPState
+}
+
+// FlowTable tracks flows in both directions, counting their packets and
+// following the state of TCP connections. Flows idle or active for too
+// long, or whose TCP connection closed a while ago, are evicted by Expire,
+// and by Update when it meets them; a new SYN on a closed TCP flow evicts
+// it at once. It is safe for concurrent use.
+type FlowTable struct {
+	idle   time.Duration
+	active time.Duration
+	evict  func(Flow, FlowEvictReason)
+
+	shards [flowShards]flowShard
+}
+
+type flowShard struct {
+	mu    sync.Mutex
+	flows map[pktutil.FlowKey]*flowEntry
+}
+
+type flowEntry struct {
+	Flow
+	// FINs seen from the initiator (bit 0) and the responder (bit 1).
+	fins byte
+}
+
+// Creates an empty table evicting flows with no packets for idle, and
+// flows older than active. A zero duration disables that timeout. If evict
+// is not nil, it is called with each evicted flow, without locks held.
+// The table runs no goroutine of its own, so callers should call Expire
+// periodically to evict flows that see no further packets.
+func NewFlowTable(idle, active time.Duration, evict func(Flow, FlowEvictReason)) *FlowTable {
+	t := &FlowTable{
+		idle:   idle,
+		active: active,
+		evict:  evict,
+	}
+	for i := range t.shards {
+		t.shards[i].flows = make(map[pktutil.FlowKey]*flowEntry)
+	}
+	return t
+}
+
+// Accounts a packet of length bytes to the flow of key, creating the flow
+// if needed, and returns the updated flow. For TCP, flags are the
+// segment's control flags.
+func (t *FlowTable) Update(key pktutil.FlowKey, length int, flags pktutil.TCPFlags) Flow {
+	canonical := key.Canonical()
+	s := t.shard(canonical)
+	now := time.Now()
+
+	s.mu.Lock()
+	e, ok := s.flows[canonical]
+	var evicted *Flow
+	var reason FlowEvictReason
+	if ok {
+		if r, expired := t.expired(e, now); expired {
+			evicted, reason = &e.Flow, r
+			ok = false
+		} else if e.TCP == TCPStateClosed && flags&(pktutil.TCPFlagSYN|pktutil.TCPFlagACK) == pktutil.TCPFlagSYN {
+			// a new connection reusing the ports of a closed one
+			evicted, reason = &e.Flow, FlowEvictClosed
+			ok = false
+		}
+	}
+	if !ok {
+		e = &flowEntry{Flow: Flow{Key: key, Start: now}}
+		s.flows[canonical] = e
+	}
+	e.LastSeen = now
+	forward := key == e.Key
+	counters := &e.Reverse
+	if forward {
+		counters = &e.Forward
+	}
+	counters.Packets++
+	counters.Bytes += uint64(length)
+	if key.Protocol == pktutil.TCP {
+		e.trackTCP(forward, flags)
+	}
+	flow := e.Flow
+	s.mu.Unlock()
+
+	if evicted != nil && t.evict != nil {
+		t.evict(*evicted, reason)
+	}
+	return flow
+}
+
+// Accounts the Ethernet frame macFrame to its flow. Only the first fragment
+// of a datagram carries its ports; later fragments are accounted to the
+// portless flow between the same hosts.
+func (t *FlowTable) UpdateFrame(macFrame []byte) (Flow, error) {
+	return t.updateDecoded(pktutil.LinkTypeEthernet, macFrame)
+}
+
+// Accounts the IPv4 or IPv6 packet to its flow, treating fragments as
+// UpdateFrame does.
+func (t *FlowTable) UpdatePacket(packet []byte) (Flow, error) {
+	return t.updateDecoded(pktutil.LinkTypeRaw, packet)
+}
+
+func (t *FlowTable) updateDecoded(linkType pktutil.LinkType, data []byte) (Flow, error) {
+	var p pktutil.DecodedPacket
+	d := pktutil.Decoder{LinkType: linkType}
+	if err := d.Decode(data, &p); err != nil {
+		return Flow{}, err
+	}
+	key, err := p.FlowKey()
+	if err != nil {
+		return Flow{}, err
+	}
+	var flags pktutil.TCPFlags
+	if p.Layers.Has(pktutil.LayerTCP) {
+		flags = p.TCP.Flags
+	}
+	return t.Update(key, len(data), flags), nil
+}
+
+// Returns the flow of key, in either direction, if it is being tracked.
+func (t *FlowTable) Lookup(key pktutil.FlowKey) (Flow, bool) {
+	canonical := key.Canonical()
+	s := t.shard(canonical)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.flows[canonical]
+	if !ok {
+		return Flow{}, false
+	}
+	return e.Flow, true
+}
+
+// Stops tracking the flow of key without calling the eviction callback.
+func (t *FlowTable) Remove(key pktutil.FlowKey) {
+	canonical := key.Canonical()
+	s := t.shard(canonical)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.flows, canonical)
+}
+
+// Evicts timed-out and closed flows and returns how many there were.
+func (t *FlowTable) Expire() int {
+	type eviction struct {
+		flow   Flow
+		reason FlowEvictReason
+	}
+	var evicted []eviction
+	now := time.Now()
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for key, e := range s.flows {
+			if reason, ok := t.expired(e, now); ok {
+				delete(s.flows, key)
+				evicted = append(evicted, eviction{e.Flow, reason})
+			}
+		}
+		s.mu.Unlock()
+	}
+	if t.evict != nil {
+		for _, ev := range evicted {
+			t.evict(ev.flow, ev.reason)
+		}
+	}
+	return len(evicted)
+}
+
+// Returns snapshots of all tracked flows, including expired ones not yet
+// evicted.
+func (t *FlowTable) Flows() []Flow {
+	var flows []Flow
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for _, e := range s.flows {
+			flows = append(flows, e.Flow)
+		}
+		s.mu.Unlock()
+	}
+	return flows
+}
+
+// Returns the number of tracked flows, including expired ones not yet
+// evicted.
+func (t *FlowTable) Len() int {
+	n := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		n += len(s.flows)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (t *FlowTable) shard(canonical pktutil.FlowKey) *flowShard {
+	return &t.shards[canonical.Hash()%flowShards]
+}
+
+// Reports whether e should be evicted at now, and why.
+func (t *FlowTable) expired(e *flowEntry, now time.Time) (FlowEvictReason, bool) {
+	switch {
+	case e.TCP == TCPStateClosed && now.Sub(e.LastSeen) > FlowClosedTimeout:
+		return FlowEvictClosed, true
+	case t.idle > 0 && now.Sub(e.LastSeen) > t.idle:
+		return FlowEvictIdle, true
+	case t.active > 0 && now.Sub(e.Start) > t.active:
+		return FlowEvictActive, true
+	}
+	return 0, false
+}
+
+// Advances the TCP state for a segment from the initiator if forward, or
+// from the responder otherwise.
+func (e *flowEntry) trackTCP(forward bool, flags pktutil.TCPFlags) {
+	if flags&pktutil.TCPFlagRST != 0 {
+		e.TCP = TCPStateClosed
+		return
+	}
+	syn := flags&(pktutil.TCPFlagSYN|pktutil.TCPFlagACK) == pktutil.TCPFlagSYN
+	synAck := flags&(pktutil.TCPFlagSYN|pktutil.TCPFlagACK) == pktutil.TCPFlagSYN|pktutil.TCPFlagACK
+	switch e.TCP {
+	case TCPStateNone:
+		if forward && syn {
+			e.TCP = TCPStateSynSent
+		} else {
+			e.TCP = TCPStateEstablished
+		}
+	case TCPStateSynSent:
+		if !forward && synAck {
+			e.TCP = TCPStateSynReceived
+		}
+	case TCPStateSynReceived:
+		if forward && flags&pktutil.TCPFlagACK != 0 && !syn {
+			e.TCP = TCPStateEstablished
+		}
+	}
+	if flags&pktutil.TCPFlagFIN != 0 && e.TCP >= TCPStateEstablished {
+		if forward {
+			e.fins |= 1
+		} else {
+			e.fins |= 2
+		}
+		e.TCP = TCPStateFinWait
+		if e.fins == 3 {
+			e.TCP = TCPStateClosed
+		}
+	}
+}
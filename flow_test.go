@@ -0,0 +1,230 @@
+package taptun_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/catalyzeio/taptun"
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+func testFlowKey(t *testing.T) pktutil.FlowKey {
+	pkt, err := pktutil.Serialize(
+		&pktutil.IPv4Header{Source: net.ParseIP("10.0.0.1"), Destination: net.ParseIP("10.0.0.2")},
+		&pktutil.TCPHeader{SourcePort: 1000, DestinationPort: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := pktutil.FlowKeyFromPacket(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+type flowEviction struct {
+	flow   taptun.Flow
+	reason taptun.FlowEvictReason
+}
+
+func newTestFlowTable(idle, active time.Duration) (*taptun.FlowTable, *[]flowEviction) {
+	var evicted []flowEviction
+	table := taptun.NewFlowTable(idle, active, func(f taptun.Flow, reason taptun.FlowEvictReason) {
+		evicted = append(evicted, flowEviction{f, reason})
+	})
+	return table, &evicted
+}
+
+type flowSegment struct {
+	reverse bool
+	flags   pktutil.TCPFlags
+	state   taptun.TCPState
+}
+
+func TestFlowTableTCP(t *testing.T) {
+	const (
+		syn = pktutil.TCPFlagSYN
+		ack = pktutil.TCPFlagACK
+		fin = pktutil.TCPFlagFIN | pktutil.TCPFlagACK
+		rst = pktutil.TCPFlagRST
+	)
+	handshake := []flowSegment{
+		{false, syn, taptun.TCPStateSynSent},
+		{false, syn, taptun.TCPStateSynSent},
+		{true, syn | ack, taptun.TCPStateSynReceived},
+		{false, ack, taptun.TCPStateEstablished},
+	}
+	tests := []struct {
+		name     string
+		segments []flowSegment
+	}{
+		{"fin", append(handshake[:4:4],
+			flowSegment{true, ack, taptun.TCPStateEstablished},
+			flowSegment{false, fin, taptun.TCPStateFinWait},
+			flowSegment{false, fin, taptun.TCPStateFinWait},
+			flowSegment{true, fin, taptun.TCPStateClosed},
+			flowSegment{false, ack, taptun.TCPStateClosed})},
+		{"rst", append(handshake[:4:4],
+			flowSegment{true, rst, taptun.TCPStateClosed})},
+		{"rst in handshake", []flowSegment{
+			{false, syn, taptun.TCPStateSynSent},
+			{true, rst | ack, taptun.TCPStateClosed}}},
+		{"mid-stream", []flowSegment{
+			{true, ack, taptun.TCPStateEstablished},
+			{false, fin, taptun.TCPStateFinWait}}},
+	}
+	key := testFlowKey(t)
+	for _, test := range tests {
+		table, evicted := newTestFlowTable(0, 0)
+		var flow taptun.Flow
+		for i, s := range test.segments {
+			k := key
+			if s.reverse {
+				k = key.Reverse()
+			}
+			flow = table.Update(k, 40, s.flags)
+			if flow.TCP != s.state {
+				t.Errorf("%s: segment %d: state %s, want %s", test.name, i, flow.TCP, s.state)
+			}
+		}
+		if flow.Forward.Packets+flow.Reverse.Packets != uint64(len(test.segments)) ||
+			flow.Forward.Bytes+flow.Reverse.Bytes != 40*uint64(len(test.segments)) {
+			t.Errorf("%s: counters %+v and %+v", test.name, flow.Forward, flow.Reverse)
+		}
+		if test.segments[0].reverse && flow.Key != key.Reverse() || !test.segments[0].reverse && flow.Key != key {
+			t.Errorf("%s: flow key %s", test.name, flow.Key)
+		}
+		if len(*evicted) != 0 || table.Len() != 1 {
+			t.Errorf("%s: %d evicted, %d flows", test.name, len(*evicted), table.Len())
+		}
+	}
+}
+
+func TestFlowTablePortReuse(t *testing.T) {
+	table, evicted := newTestFlowTable(0, 0)
+	key := testFlowKey(t)
+	table.Update(key, 40, pktutil.TCPFlagSYN)
+	table.Update(key.Reverse(), 40, pktutil.TCPFlagRST|pktutil.TCPFlagACK)
+
+	// a new SYN after the RST starts a new flow
+	flow := table.Update(key, 60, pktutil.TCPFlagSYN)
+	if flow.TCP != taptun.TCPStateSynSent || flow.Forward.Packets != 1 || flow.Forward.Bytes != 60 || flow.Reverse.Packets != 0 {
+		t.Errorf("new flow %+v", flow)
+	}
+	if len(*evicted) != 1 {
+		t.Fatalf("%d flows evicted", len(*evicted))
+	}
+	old := (*evicted)[0]
+	if old.reason != taptun.FlowEvictClosed || old.flow.TCP != taptun.TCPStateClosed || old.flow.Forward.Packets != 1 || old.flow.Reverse.Packets != 1 {
+		t.Errorf("evicted %+v for %d", old.flow, old.reason)
+	}
+	if table.Len() != 1 {
+		t.Errorf("%d flows", table.Len())
+	}
+}
+
+func TestFlowTableExpire(t *testing.T) {
+	key := testFlowKey(t)
+
+	table, evicted := newTestFlowTable(10*time.Millisecond, 0)
+	table.Update(key, 40, pktutil.TCPFlagACK)
+	if n := table.Expire(); n != 0 {
+		t.Errorf("%d flows expired early", n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := table.Expire(); n != 1 || len(*evicted) != 1 || (*evicted)[0].reason != taptun.FlowEvictIdle {
+		t.Errorf("%d flows expired: %+v", n, *evicted)
+	}
+	if _, ok := table.Lookup(key); ok || table.Len() != 0 {
+		t.Errorf("idle flow still tracked")
+	}
+
+	// Update evicts an expired flow it meets and starts a new one
+	table.Update(key, 40, pktutil.TCPFlagACK)
+	time.Sleep(20 * time.Millisecond)
+	flow := table.Update(key.Reverse(), 40, pktutil.TCPFlagACK)
+	if len(*evicted) != 2 || (*evicted)[1].reason != taptun.FlowEvictIdle {
+		t.Errorf("evicted %+v", *evicted)
+	}
+	if flow.Key != key.Reverse() || flow.Forward.Packets != 1 {
+		t.Errorf("new flow %+v", flow)
+	}
+
+	// active flows are evicted however busy they are
+	table, evicted = newTestFlowTable(0, 20*time.Millisecond)
+	deadline := time.Now().Add(30 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		table.Update(key, 40, pktutil.TCPFlagACK)
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	table.Expire()
+	// Update evicts the flow too once it has been active for too long
+	if len(*evicted) == 0 || table.Len() != 0 {
+		t.Fatalf("%d flows evicted, %d left", len(*evicted), table.Len())
+	}
+	for _, e := range *evicted {
+		if e.reason != taptun.FlowEvictActive {
+			t.Errorf("evicted %+v for %d", e.flow, e.reason)
+		}
+	}
+}
+
+func TestFlowTableFragments(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   pktutil.Layer
+		tap  bool
+	}{
+		{"ipv4", &pktutil.IPv4Header{Source: net.ParseIP("10.0.0.1"), Destination: net.ParseIP("10.0.0.2")}, false},
+		{"ipv6", &pktutil.IPv6Header{Source: net.ParseIP("fd00::1"), Destination: net.ParseIP("fd00::2")}, true},
+	}
+	for _, test := range tests {
+		pkt, err := pktutil.Serialize(test.ip, &pktutil.UDPHeader{SourcePort: 5000, DestinationPort: 53}, pktutil.Payload(make([]byte, 3000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fragments, err := pktutil.NewFragmenter(1280, nil).Fragment(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fragments) != 3 {
+			t.Fatalf("%s: %d fragments", test.name, len(fragments))
+		}
+
+		table, _ := newTestFlowTable(0, 0)
+		var flows []taptun.Flow
+		for _, fragment := range fragments {
+			var flow taptun.Flow
+			if test.tap {
+				frame, err := pktutil.Serialize(&pktutil.EthernetFrame{
+					Destination: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+					Source:      net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+					Ethertype:   pktutil.IPv6,
+				}, pktutil.Payload(fragment))
+				if err != nil {
+					t.Fatal(err)
+				}
+				flow, err = table.UpdateFrame(frame)
+			} else {
+				flow, err = table.UpdatePacket(fragment)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			flows = append(flows, flow)
+		}
+
+		// the first fragment carries the ports, the others cannot be told
+		// apart from other datagrams between the same hosts
+		first := flows[0].Key
+		if first.Protocol != pktutil.UDP || first.SourcePort != 5000 || first.DestinationPort != 53 || flows[0].Forward.Packets != 1 {
+			t.Errorf("%s: first fragment flow %+v", test.name, flows[0])
+		}
+		later := flows[2].Key
+		if later.Protocol != pktutil.UDP || later.SourcePort != 0 || later.DestinationPort != 0 || flows[2].Forward.Packets != 2 {
+			t.Errorf("%s: later fragment flow %+v", test.name, flows[2])
+		}
+	}
+}
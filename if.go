@@ -1,7 +1,12 @@
 package taptun
 
 import (
+	"errors"
+	"net"
 	"os"
+	"sync"
+
+	"github.com/catalyzeio/taptun/pktutil"
 )
 
 // Interface is a TUN/TAP interface.
@@ -9,41 +14,164 @@ type Interface struct {
 	isTAP bool
 	file  *os.File
 	name  string
+
+	mu        sync.Mutex
+	closed    bool
+	accessors map[*accessor]struct{}
+	addrs     []*net.IPNet
+	routes    []*Route
+}
+
+// Route is a route through a TUN/TAP device.
+type Route struct {
+	// Destination network.
+	Dst *net.IPNet
+	// Optional next hop; nil for a directly connected destination.
+	Gateway net.IP
 }
 
 // Create a new TAP interface whose name is ifName.
 // If ifName is empty, a default name (tap0, tap1, ... ) will be assigned.
-// ifName should not exceed 16 bytes.
+// ifName should not exceed 15 bytes.
 func NewTAP(ifName string) (*Interface, error) {
-	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
-	if err != nil {
-		return nil, err
-	}
-	name, err := createInterface(file.Fd(), ifName, true)
-	if err != nil {
-		return nil, err
-	}
-	return &Interface{isTAP: true, file: file, name: name}, nil
+	return newInterface(ifName, true, 0)
 }
 
 // Create a new TUN interface whose name is ifName.
 // If ifName is empty, a default name (tun0, tun1, ... ) will be assigned.
-// ifName should not exceed 16 bytes.
+// ifName should not exceed 15 bytes.
 func NewTUN(ifName string) (*Interface, error) {
-	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
-	if err != nil {
-		return nil, err
-	}
-	name, err := createInterface(file.Fd(), ifName, false)
+	return newInterface(ifName, false, 0)
+}
+
+// Features are the flags of an existing device to keep when attaching.
+func newInterface(ifName string, isTAP bool, features int) (*Interface, error) {
+	file, name, err := openDevice(ifName, isTAP, features)
 	if err != nil {
-		return nil, err
+		return nil, wrapError("create", ifName, err)
 	}
-	return &Interface{isTAP: false, file: file, name: name}, err
+	return &Interface{
+		isTAP:     isTAP,
+		file:      file,
+		name:      name,
+		accessors: make(map[*accessor]struct{}),
+	}, nil
 }
 
 // Sets the TUN/TAP device in persistent mode.
 func (ifce *Interface) SetPersistent(persistent bool) error {
-	return setPersistent(ifce.file.Fd(), persistent)
+	return ifce.control("set persistent", func(fd uintptr) error {
+		return setPersistent(fd, persistent)
+	})
+}
+
+// Restricts use of the persistent device to the given user.
+func (ifce *Interface) SetOwner(uid int) error {
+	return ifce.control("set owner", func(fd uintptr) error {
+		return setOwner(fd, uid)
+	})
+}
+
+// Restricts use of the persistent device to the given group.
+func (ifce *Interface) SetGroup(gid int) error {
+	return ifce.control("set group", func(fd uintptr) error {
+		return setGroup(fd, gid)
+	})
+}
+
+// Sets the carrier state reported by the device.
+func (ifce *Interface) SetCarrier(on bool) error {
+	return ifce.control("set carrier", func(fd uintptr) error {
+		return setCarrier(fd, on)
+	})
+}
+
+// Sets the MTU of the device.
+func (ifce *Interface) SetMTU(mtu int) error {
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	if ifce.closed {
+		return wrapError("set mtu", ifce.name, ErrClosed)
+	}
+	return wrapError("set mtu", ifce.name, setMTU(ifce.name, mtu))
+}
+
+// Brings the device administratively up or down.
+func (ifce *Interface) SetUp(up bool) error {
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	if ifce.closed {
+		return wrapError("set up", ifce.name, ErrClosed)
+	}
+	return wrapError("set up", ifce.name, setUp(ifce.name, up))
+}
+
+// Assigns an IPv4 or IPv6 address to the device. The address is removed
+// again when ifce is closed.
+func (ifce *Interface) AddAddress(addr *net.IPNet) error {
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	if ifce.closed {
+		return wrapError("add address", ifce.name, ErrClosed)
+	}
+	if err := addAddress(ifce.name, addr); err != nil {
+		return wrapError("add address", ifce.name, err)
+	}
+	ifce.addrs = append(ifce.addrs, addr)
+	return nil
+}
+
+// Removes an IPv4 or IPv6 address from the device.
+func (ifce *Interface) RemoveAddress(addr *net.IPNet) error {
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	if ifce.closed {
+		return wrapError("remove address", ifce.name, ErrClosed)
+	}
+	if err := removeAddress(ifce.name, addr); err != nil {
+		return wrapError("remove address", ifce.name, err)
+	}
+	for i, a := range ifce.addrs {
+		if a.IP.Equal(addr.IP) {
+			ifce.addrs = append(ifce.addrs[:i], ifce.addrs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Adds a route through the device. The route is removed again when ifce is
+// closed.
+func (ifce *Interface) AddRoute(route *Route) error {
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	if ifce.closed {
+		return wrapError("add route", ifce.name, ErrClosed)
+	}
+	if err := addRoute(ifce.name, route); err != nil {
+		return wrapError("add route", ifce.name, err)
+	}
+	ifce.routes = append(ifce.routes, route)
+	return nil
+}
+
+// Removes a route through the device.
+func (ifce *Interface) RemoveRoute(route *Route) error {
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	if ifce.closed {
+		return wrapError("remove route", ifce.name, ErrClosed)
+	}
+	if err := removeRoute(ifce.name, route); err != nil {
+		return wrapError("remove route", ifce.name, err)
+	}
+	for i, r := range ifce.routes {
+		if r.Dst.String() == route.Dst.String() && r.Gateway.Equal(route.Gateway) {
+			ifce.routes = append(ifce.routes[:i], ifce.routes[i+1:]...)
+			break
+		}
+	}
+	return nil
 }
 
 // Returns whether ifce is a TUN interface.
@@ -56,24 +184,99 @@ func (ifce *Interface) IsTAP() bool {
 	return ifce.isTAP
 }
 
+// Returns the link-layer format of what is read from and written to ifce:
+// Ethernet frames for a TAP device, bare IP packets for a TUN device.
+func (ifce *Interface) LinkType() pktutil.LinkType {
+	if ifce.isTAP {
+		return pktutil.LinkTypeEthernet
+	}
+	return pktutil.LinkTypeRaw
+}
+
 // Returns the interface name of ifce, e.g., tun0, tap1, etc.
 func (ifce *Interface) Name() string {
 	return ifce.name
 }
 
 // Closes the TUN/TAP interface.
+//
+// Close stops all accessors, so their pending and future operations return
+// io.EOF, and wakes any goroutine blocked in Read or Write on ifce with
+// ErrClosed. Addresses and routes added through ifce are removed first,
+// which for a device that is not persistent the kernel does along with the
+// device. Close may be called concurrently and more than once; calls after
+// the first return nil.
 func (ifce *Interface) Close() error {
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	if ifce.closed {
+		return nil
+	}
+	ifce.closed = true
+
+	for acc := range ifce.accessors {
+		acc.stop()
+	}
+	ifce.accessors = nil
+
+	var persistent bool
+	ifce.rawControl(func(fd uintptr) error {
+		var err error
+		persistent, err = isPersistent(fd)
+		return err
+	})
+	if persistent {
+		// best effort, as the device may have been reconfigured meanwhile
+		for _, route := range ifce.routes {
+			removeRoute(ifce.name, route)
+		}
+		for _, addr := range ifce.addrs {
+			removeAddress(ifce.name, addr)
+		}
+	}
+	ifce.routes = nil
+	ifce.addrs = nil
+
 	return ifce.file.Close()
 }
 
 // Implement io.Writer interface.
 func (ifce *Interface) Write(p []byte) (n int, err error) {
-	return ifce.file.Write(p)
+	n, err = ifce.file.Write(p)
+	return n, mapClosed(err)
 }
 
 // Implement io.Reader interface.
 func (ifce *Interface) Read(p []byte) (n int, err error) {
-	return ifce.file.Read(p)
+	n, err = ifce.file.Read(p)
+	return n, mapClosed(err)
+}
+
+// Runs fn with the device's file descriptor, without taking it out of
+// non-blocking mode as File.Fd would.
+func (ifce *Interface) control(op string, fn func(fd uintptr) error) error {
+	return wrapError(op, ifce.name, ifce.rawControl(fn))
+}
+
+func (ifce *Interface) rawControl(fn func(fd uintptr) error) error {
+	conn, err := ifce.file.SyscallConn()
+	if err != nil {
+		return mapClosed(err)
+	}
+	var fnErr error
+	if err := conn.Control(func(fd uintptr) {
+		fnErr = fn(fd)
+	}); err != nil {
+		return mapClosed(err)
+	}
+	return fnErr
+}
+
+func mapClosed(err error) error {
+	if errors.Is(err, os.ErrClosed) {
+		return ErrClosed
+	}
+	return err
 }
 
 // Provides thread-safe read and write operations that can be cancelled.
@@ -86,11 +289,34 @@ type Accessor interface {
 
 	// Stops any pending reads and writes. Any subsequent read or write
 	// operations on this accessor will return an EOF error.  Does not
-	// close the underlying device.
+	// close the underlying device, but closing the device stops all of
+	// its accessors.
 	Stop() bool
 }
 
 // Wraps this Interface with a thread-safe Accessor.
 func (ifce *Interface) Accessor() (Accessor, error) {
-	return wrap(ifce)
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	if ifce.closed {
+		return nil, wrapError("accessor", ifce.name, ErrClosed)
+	}
+	var file *os.File
+	err := ifce.rawControl(func(fd uintptr) error {
+		var err error
+		file, err = dupFile(fd)
+		return err
+	})
+	if err != nil {
+		return nil, wrapError("accessor", ifce.name, err)
+	}
+	acc := &accessor{ifce: ifce, file: file}
+	ifce.accessors[acc] = struct{}{}
+	return acc, nil
+}
+
+func (ifce *Interface) release(acc *accessor) {
+	ifce.mu.Lock()
+	defer ifce.mu.Unlock()
+	delete(ifce.accessors, acc)
 }
@@ -0,0 +1,237 @@
+// +build linux
+
+package taptun_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/catalyzeio/taptun"
+	"github.com/catalyzeio/taptun/pktutil"
+	"github.com/catalyzeio/taptun/taptuntest"
+)
+
+const timeout = time.Second
+
+func TestTUNUDP(t *testing.T) {
+	ns := taptuntest.NewNamespace(t)
+	defer ns.Close()
+	dev := ns.NewTUN(t, "10.0.0.1/24")
+	conn := ns.ListenUDP(t, "10.0.0.1:9000")
+
+	// device to kernel
+	pkt, err := pktutil.Serialize(
+		&pktutil.IPv4Header{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP("10.0.0.1")},
+		&pktutil.UDPHeader{SourcePort: 5000, DestinationPort: 9000},
+		pktutil.Payload("to kernel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.WritePacket(pkt); err != nil {
+		t.Fatal(err)
+	}
+	from := readUDP(t, conn, "to kernel")
+	if from.String() != "10.0.0.2:5000" {
+		t.Fatalf("received from %v", from)
+	}
+
+	// kernel to device
+	if _, err := conn.WriteToUDP([]byte("to device"), from); err != nil {
+		t.Fatal(err)
+	}
+	p := readDecoded(t, dev, 5000)
+	if string(p.Payload) != "to device" || !p.IPv4.Source.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("got %q from %v", p.Payload, p.IPv4.Source)
+	}
+}
+
+func TestTUNDialUDP(t *testing.T) {
+	ns := taptuntest.NewNamespace(t)
+	defer ns.Close()
+	dev := ns.NewTUN(t, "10.0.0.1/24")
+	conn := ns.DialUDP(t, "10.0.0.2:7000")
+
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	p := readDecoded(t, dev, 7000)
+	if string(p.Payload) != "request" {
+		t.Fatalf("got %q", p.Payload)
+	}
+
+	reply, err := pktutil.Serialize(
+		&pktutil.IPv4Header{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP("10.0.0.1")},
+		&pktutil.UDPHeader{SourcePort: 7000, DestinationPort: p.UDP.SourcePort},
+		pktutil.Payload("reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.WritePacket(reply); err != nil {
+		t.Fatal(err)
+	}
+	readUDP(t, conn, "reply")
+}
+
+func TestTAPUDP(t *testing.T) {
+	ns := taptuntest.NewNamespace(t)
+	defer ns.Close()
+	dev := ns.NewTAP(t, "10.0.0.1/24")
+	conn := ns.ListenUDP(t, "10.0.0.1:9000")
+
+	// answer the kernel's ARP requests for the peer
+	peerMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+	responder := taptun.NewARPResponder(peerMAC, net.ParseIP("10.0.0.2"))
+
+	// kernel to device, resolving the peer first
+	if _, err := conn.WriteToUDP([]byte("to device"), &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000}); err != nil {
+		t.Fatal(err)
+	}
+	var p pktutil.DecodedPacket
+	d := pktutil.Decoder{LinkType: dev.LinkType()}
+	_, err := dev.ReadMatching(timeout, func(frame []byte) bool {
+		if reply := responder.Handle(frame); reply != nil {
+			if err := dev.WritePacket(reply); err != nil {
+				t.Error(err)
+			}
+		}
+		return d.Decode(frame, &p) == nil && p.Layers.Has(pktutil.LayerUDP) && p.UDP.DestinationPort == 5000
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Payload) != "to device" || p.Ethernet.Destination.String() != peerMAC.String() {
+		t.Fatalf("got %q for %v", p.Payload, p.Ethernet.Destination)
+	}
+	kernelMAC := append(net.HardwareAddr(nil), p.Ethernet.Source...)
+
+	// device to kernel
+	frame, err := pktutil.Serialize(
+		&pktutil.EthernetFrame{Source: peerMAC, Destination: kernelMAC},
+		&pktutil.IPv4Header{Source: net.ParseIP("10.0.0.2"), Destination: net.ParseIP("10.0.0.1")},
+		&pktutil.UDPHeader{SourcePort: 5000, DestinationPort: 9000},
+		pktutil.Payload("to kernel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.WritePacket(frame); err != nil {
+		t.Fatal(err)
+	}
+	readUDP(t, conn, "to kernel")
+}
+
+// Reads a datagram from conn, failing unless it holds want.
+func readUDP(t *testing.T, conn *net.UDPConn, want string) *net.UDPAddr {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, from, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != want {
+		t.Fatalf("got %q, want %q", buf[:n], want)
+	}
+	return from
+}
+
+// Reads packets from dev until a UDP packet for port arrives, checking its
+// checksum.
+func readDecoded(t *testing.T, dev *taptuntest.Device, port uint16) *pktutil.DecodedPacket {
+	t.Helper()
+	var p pktutil.DecodedPacket
+	d := pktutil.Decoder{LinkType: dev.LinkType()}
+	pkt, err := dev.ReadMatching(timeout, func(pkt []byte) bool {
+		return d.Decode(pkt, &p) == nil && p.Layers.Has(pktutil.LayerUDP) && p.UDP.DestinationPort == port
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := pktutil.VerifyTransportChecksum(pkt); err != nil || !ok {
+		t.Fatalf("bad UDP checksum: %v", err)
+	}
+	return &p
+}
+
+func TestClosedInterface(t *testing.T) {
+	ns := taptuntest.NewNamespace(t)
+	defer ns.Close()
+	dev := ns.NewTUN(t, "")
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err := ns.Do(func() error {
+		if err := dev.SetMTU(1400); !errors.Is(err, taptun.ErrClosed) {
+			t.Errorf("SetMTU after Close: %v", err)
+		}
+		if err := dev.SetUp(true); !errors.Is(err, taptun.ErrClosed) {
+			t.Errorf("SetUp after Close: %v", err)
+		}
+		addr := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)}
+		if err := dev.RemoveAddress(addr); !errors.Is(err, taptun.ErrClosed) {
+			t.Errorf("RemoveAddress after Close: %v", err)
+		}
+		if err := dev.RemoveRoute(&taptun.Route{Dst: addr}); !errors.Is(err, taptun.ErrClosed) {
+			t.Errorf("RemoveRoute after Close: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClosePersistent(t *testing.T) {
+	ns := taptuntest.NewNamespace(t)
+	defer ns.Close()
+	err := ns.Do(func() error {
+		ifce, err := taptun.NewTUN("ptun0")
+		if err != nil {
+			return err
+		}
+		if err := ifce.SetPersistent(true); err != nil {
+			ifce.Close()
+			return err
+		}
+		addr := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)}
+		if err := ifce.AddAddress(addr); err != nil {
+			ifce.Close()
+			return err
+		}
+		if err := ifce.Close(); err != nil {
+			return err
+		}
+
+		link, err := net.InterfaceByName("ptun0")
+		if err != nil {
+			return err
+		}
+		addrs, err := link.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			t.Errorf("address %s left on persistent device", a)
+		}
+
+		ifce, err = taptun.NewTUN("ptun0")
+		if err != nil {
+			return err
+		}
+		defer ifce.Close()
+		return ifce.SetPersistent(false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClosedNamespace(t *testing.T) {
+	ns := taptuntest.NewNamespace(t)
+	ns.Close()
+	ns.Close()
+	if err := ns.Do(func() error { return nil }); err != taptuntest.ErrClosed {
+		t.Errorf("Do after Close: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package taptun
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+// Time to wait for a conflicting claim after sending a duplicate address
+// detection probe (RFC 4861 RetransTimer).
+const DADTimeout = time.Second
+
+// NDPResponder is the IPv6 counterpart of ARPResponder: it answers
+// neighbor solicitations for a set of addresses on behalf of a userspace
+// host attached to a TAP device, performs duplicate address detection,
+// learns the addresses of its neighbors, and can act as a router
+// advertising prefixes for stateless address autoconfiguration.
+type NDPResponder struct {
+	mac   net.HardwareAddr
+	cache *NeighborCache
+
+	mu    sync.Mutex
+	addrs map[[16]byte]*ndpAddr
+	ra    *pktutil.RouterAdvertisement
+}
+
+type ndpAddr struct {
+	tentative bool
+	duplicate bool
+}
+
+// Creates a responder answering with mac. Learned neighbors expire after
+// DefaultNeighborTimeout.
+func NewNDPResponder(mac net.HardwareAddr) *NDPResponder {
+	return &NDPResponder{
+		mac:   mac,
+		cache: NewNeighborCache(DefaultNeighborTimeout),
+		addrs: make(map[[16]byte]*ndpAddr),
+	}
+}
+
+// Starts answering for the IPv6 address ip without duplicate address
+// detection.
+func (r *NDPResponder) AddAddress(ip net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs[neighborKey(ip)] = &ndpAddr{}
+}
+
+// Starts duplicate address detection for ip and returns the probe to send.
+// The address stays tentative, and is not answered for, until
+// ConfirmAddress is called at least DADTimeout later.
+func (r *NDPResponder) ProbeAddress(ip net.IP) []byte {
+	r.mu.Lock()
+	r.addrs[neighborKey(ip)] = &ndpAddr{tentative: true}
+	r.mu.Unlock()
+	return r.frame(pktutil.MulticastMAC(pktutil.SolicitedNodeMulticast(ip)),
+		pktutil.NewNeighborSolicitation(net.IPv6unspecified, r.mac, ip))
+}
+
+// Completes duplicate address detection for ip, making it usable unless
+// another node claimed it meanwhile, in which case ip is dropped and
+// ErrDuplicateAddress is returned. ErrNotProbing is returned if ip is not
+// tentative because ProbeAddress was not called for it.
+func (r *NDPResponder) ConfirmAddress(ip net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := neighborKey(ip)
+	addr, ok := r.addrs[key]
+	if !ok || !addr.tentative {
+		return wrapError("duplicate address detection", ip.String(), ErrNotProbing)
+	}
+	if addr.duplicate {
+		delete(r.addrs, key)
+		return wrapError("duplicate address detection", ip.String(), ErrDuplicateAddress)
+	}
+	addr.tentative = false
+	return nil
+}
+
+// Stops answering for the IPv6 address ip.
+func (r *NDPResponder) RemoveAddress(ip net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.addrs, neighborKey(ip))
+}
+
+// Makes r answer router solicitations with ra, or stop if ra is nil.
+// Advertisements are sent from r's link-local address, which must have
+// been added.
+func (r *NDPResponder) SetRouterAdvertisement(ra *pktutil.RouterAdvertisement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ra = ra
+}
+
+// Returns the cache of neighbors learned by r.
+func (r *NDPResponder) Neighbors() *NeighborCache {
+	return r.cache
+}
+
+// Processes a frame read from the TAP device and returns a reply to write
+// back, or nil. Frames other than untagged NDP messages are ignored.
+func (r *NDPResponder) Handle(frame []byte) []byte {
+	if len(frame) < 14 || pktutil.MACTagging(frame) != pktutil.NotTagged || pktutil.MACEthertype(frame) != pktutil.IPv6 {
+		return nil
+	}
+	pkt := pktutil.MACPayload(frame)
+	var ip pktutil.IPv6Header
+	if err := ip.Decode(pkt); err != nil || ip.HopLimit != pktutil.NDPHopLimit {
+		return nil
+	}
+	protocol, offset, err := pktutil.IPv6UpperLayer(pkt)
+	if err != nil || protocol != pktutil.IPv6_ICMP {
+		return nil
+	}
+	message := pkt[offset : 40+int(ip.PayloadLength)]
+	if ok, err := pktutil.VerifyTransportChecksum(pkt); err != nil || !ok {
+		return nil
+	}
+	var m pktutil.NDPMessage
+	if err := m.Decode(message); err != nil || m.Code != 0 {
+		return nil
+	}
+
+	switch m.Type {
+	case pktutil.ICMPv6NeighborSolicitation:
+		return r.handleSolicitation(&ip, &m)
+	case pktutil.ICMPv6NeighborAdvertisement:
+		r.handleAdvertisement(&m)
+	case pktutil.ICMPv6RouterSolicitation:
+		return r.handleRouterSolicitation(&ip, &m)
+	}
+	return nil
+}
+
+func (r *NDPResponder) handleSolicitation(ip *pktutil.IPv6Header, m *pktutil.NDPMessage) []byte {
+	dad := ip.Source.IsUnspecified()
+	r.mu.Lock()
+	addr, ok := r.addrs[neighborKey(m.Target)]
+	if ok && addr.tentative && dad {
+		// another node is probing for the same address
+		addr.duplicate = true
+	}
+	r.mu.Unlock()
+
+	mac := m.LinkLayerAddr(pktutil.NDPOptionSourceLinkLayerAddr)
+	if !dad && mac != nil {
+		r.cache.Add(ip.Source, mac)
+	}
+	if !ok || addr.tentative {
+		return nil
+	}
+	if dad {
+		// answer a probe for our address to all nodes
+		return r.frame(pktutil.MulticastMAC(pktutil.IPv6AllNodes),
+			pktutil.NewNeighborAdvertisement(m.Target, pktutil.IPv6AllNodes, m.Target, r.mac, r.advertFlags(pktutil.NDPFlagOverride)))
+	}
+	if mac == nil {
+		return nil
+	}
+	return r.frame(mac, pktutil.NewNeighborAdvertisement(m.Target, ip.Source, m.Target, r.mac,
+		r.advertFlags(pktutil.NDPFlagSolicited|pktutil.NDPFlagOverride)))
+}
+
+func (r *NDPResponder) handleAdvertisement(m *pktutil.NDPMessage) {
+	r.mu.Lock()
+	if addr, ok := r.addrs[neighborKey(m.Target)]; ok && addr.tentative {
+		addr.duplicate = true
+	}
+	r.mu.Unlock()
+	if mac := m.LinkLayerAddr(pktutil.NDPOptionTargetLinkLayerAddr); mac != nil {
+		if m.Flags&pktutil.NDPFlagSolicited != 0 {
+			r.cache.Add(m.Target, mac)
+		} else {
+			r.cache.Update(m.Target, mac)
+		}
+	}
+}
+
+func (r *NDPResponder) handleRouterSolicitation(ip *pktutil.IPv6Header, m *pktutil.NDPMessage) []byte {
+	mac := m.LinkLayerAddr(pktutil.NDPOptionSourceLinkLayerAddr)
+	if ip.Source.IsUnspecified() || mac == nil {
+		return r.Advertise()
+	}
+	r.cache.Add(ip.Source, mac)
+	return r.advertise(ip.Source, mac)
+}
+
+// Returns an unsolicited router advertisement to all nodes, or nil if r
+// has no advertisement configured or no link-local address.
+func (r *NDPResponder) Advertise() []byte {
+	return r.advertise(pktutil.IPv6AllNodes, pktutil.MulticastMAC(pktutil.IPv6AllNodes))
+}
+
+func (r *NDPResponder) advertise(dst net.IP, dstMAC net.HardwareAddr) []byte {
+	r.mu.Lock()
+	ra := r.ra
+	src := r.linkLocal()
+	r.mu.Unlock()
+	if ra == nil || src == nil {
+		return nil
+	}
+	return r.frame(dstMAC, pktutil.NewRouterAdvertisement(src, r.mac, dst, ra))
+}
+
+// Returns a frame soliciting the address of target on behalf of src, one
+// of r's addresses.
+func (r *NDPResponder) Solicit(src, target net.IP) []byte {
+	return r.frame(pktutil.MulticastMAC(pktutil.SolicitedNodeMulticast(target)),
+		pktutil.NewNeighborSolicitation(src, r.mac, target))
+}
+
+// Returns unsolicited neighbor advertisements announcing each of r's
+// usable addresses.
+func (r *NDPResponder) Announce() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	flags := byte(pktutil.NDPFlagOverride)
+	if r.ra != nil {
+		flags |= pktutil.NDPFlagRouter
+	}
+	var frames [][]byte
+	for key, addr := range r.addrs {
+		if addr.tentative {
+			continue
+		}
+		ip := net.IP(append([]byte(nil), key[:]...))
+		frames = append(frames, r.frame(pktutil.MulticastMAC(pktutil.IPv6AllNodes),
+			pktutil.NewNeighborAdvertisement(ip, pktutil.IPv6AllNodes, ip, r.mac, flags)))
+	}
+	return frames
+}
+
+// Adds the router flag to flags when r advertises itself as a router.
+func (r *NDPResponder) advertFlags(flags byte) byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ra != nil {
+		flags |= pktutil.NDPFlagRouter
+	}
+	return flags
+}
+
+// Returns a usable link-local address of r, or nil. Must be called with
+// r.mu held.
+func (r *NDPResponder) linkLocal() net.IP {
+	for key, addr := range r.addrs {
+		ip := net.IP(key[:])
+		if !addr.tentative && ip.IsLinkLocalUnicast() {
+			return append(net.IP(nil), ip...)
+		}
+	}
+	return nil
+}
+
+func (r *NDPResponder) frame(dst net.HardwareAddr, pkt []byte) []byte {
+	frame, _ := pktutil.Serialize(&pktutil.EthernetFrame{
+		Destination: dst,
+		Source:      r.mac,
+		Ethertype:   pktutil.IPv6,
+	}, pktutil.Payload(pkt))
+	return frame
+}
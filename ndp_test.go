@@ -0,0 +1,190 @@
+package taptun_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/catalyzeio/taptun"
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+var (
+	ndpLocalMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	ndpPeerMAC  = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	ndpLocalIP  = net.ParseIP("fd00::1")
+	ndpPeerIP   = net.ParseIP("fd00::2")
+)
+
+func ndpFrame(t *testing.T, pkt []byte) []byte {
+	t.Helper()
+	var ip pktutil.IPv6Header
+	if err := ip.Decode(pkt); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := pktutil.Serialize(&pktutil.EthernetFrame{
+		Destination: pktutil.MulticastMAC(ip.Destination),
+		Source:      ndpPeerMAC,
+		Ethertype:   pktutil.IPv6,
+	}, pktutil.Payload(pkt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// Decodes the NDP message in a frame returned by an NDPResponder.
+func decodeNDP(t *testing.T, frame []byte) (*pktutil.IPv6Header, *pktutil.NDPMessage) {
+	t.Helper()
+	pkt := pktutil.MACPayload(frame)
+	var ip pktutil.IPv6Header
+	if err := ip.Decode(pkt); err != nil {
+		t.Fatal(err)
+	}
+	_, offset, err := pktutil.IPv6UpperLayer(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m pktutil.NDPMessage
+	if err := m.Decode(pkt[offset:]); err != nil {
+		t.Fatal(err)
+	}
+	return &ip, &m
+}
+
+func TestNDPResponderSolicitation(t *testing.T) {
+	r := taptun.NewNDPResponder(ndpLocalMAC)
+	r.AddAddress(ndpLocalIP)
+
+	reply := r.Handle(ndpFrame(t, pktutil.NewNeighborSolicitation(ndpPeerIP, ndpPeerMAC, ndpLocalIP)))
+	if reply == nil {
+		t.Fatal("no reply")
+	}
+	if dst := pktutil.MACDestination(reply); dst.String() != ndpPeerMAC.String() {
+		t.Errorf("reply to %s", dst)
+	}
+	ip, m := decodeNDP(t, reply)
+	if m.Type != pktutil.ICMPv6NeighborAdvertisement || !m.Target.Equal(ndpLocalIP) || !ip.Destination.Equal(ndpPeerIP) ||
+		m.Flags != pktutil.NDPFlagSolicited|pktutil.NDPFlagOverride {
+		t.Errorf("reply %+v to %s", m, ip.Destination)
+	}
+	if mac := m.LinkLayerAddr(pktutil.NDPOptionTargetLinkLayerAddr); mac.String() != ndpLocalMAC.String() {
+		t.Errorf("target link-layer address %s", mac)
+	}
+	if mac, ok := r.Neighbors().Lookup(ndpPeerIP); !ok || mac.String() != ndpPeerMAC.String() {
+		t.Errorf("learned %s, %v", mac, ok)
+	}
+
+	other := pktutil.NewNeighborSolicitation(ndpPeerIP, ndpPeerMAC, net.ParseIP("fd00::9"))
+	if reply := r.Handle(ndpFrame(t, other)); reply != nil {
+		t.Errorf("answered for another address: %x", reply)
+	}
+}
+
+func TestNDPResponderProbe(t *testing.T) {
+	r := taptun.NewNDPResponder(ndpLocalMAC)
+	r.AddAddress(ndpLocalIP)
+
+	// another node's probe for an address in use is answered to all nodes
+	reply := r.Handle(ndpFrame(t, pktutil.NewNeighborSolicitation(net.IPv6unspecified, ndpPeerMAC, ndpLocalIP)))
+	if reply == nil {
+		t.Fatal("probe not answered")
+	}
+	ip, m := decodeNDP(t, reply)
+	if m.Type != pktutil.ICMPv6NeighborAdvertisement || !m.Target.Equal(ndpLocalIP) ||
+		!ip.Destination.Equal(pktutil.IPv6AllNodes) || m.Flags != pktutil.NDPFlagOverride {
+		t.Errorf("reply %+v to %s", m, ip.Destination)
+	}
+	if r.Neighbors().Len() != 0 {
+		t.Error("learned from a probe")
+	}
+}
+
+func TestNDPResponderDAD(t *testing.T) {
+	tentative := net.ParseIP("fd00::3")
+	solicitation := pktutil.NewNeighborSolicitation(ndpPeerIP, ndpPeerMAC, tentative)
+	tests := []struct {
+		name  string
+		claim []byte
+	}{
+		{"no claim", nil},
+		{"probe", pktutil.NewNeighborSolicitation(net.IPv6unspecified, ndpPeerMAC, tentative)},
+		{"advertisement", pktutil.NewNeighborAdvertisement(tentative, pktutil.IPv6AllNodes, tentative, ndpPeerMAC, pktutil.NDPFlagOverride)},
+	}
+	for _, test := range tests {
+		r := taptun.NewNDPResponder(ndpLocalMAC)
+		probe := r.ProbeAddress(tentative)
+		ip, m := decodeNDP(t, probe)
+		if m.Type != pktutil.ICMPv6NeighborSolicitation || !m.Target.Equal(tentative) || !ip.Source.IsUnspecified() {
+			t.Errorf("%s: probe %+v from %s", test.name, m, ip.Source)
+		}
+		if reply := r.Handle(ndpFrame(t, solicitation)); reply != nil {
+			t.Errorf("%s: answered for a tentative address", test.name)
+		}
+
+		if test.claim != nil {
+			r.Handle(ndpFrame(t, test.claim))
+		}
+		err := r.ConfirmAddress(tentative)
+		reply := r.Handle(ndpFrame(t, solicitation))
+		if test.claim == nil {
+			if err != nil || reply == nil {
+				t.Errorf("%s: confirm %v, reply %x", test.name, err, reply)
+			}
+			continue
+		}
+		if !errors.Is(err, taptun.ErrDuplicateAddress) || reply != nil {
+			t.Errorf("%s: confirm %v, reply %x", test.name, err, reply)
+		}
+	}
+}
+
+func TestNDPResponderConfirmWithoutProbe(t *testing.T) {
+	r := taptun.NewNDPResponder(ndpLocalMAC)
+	if err := r.ConfirmAddress(ndpLocalIP); !errors.Is(err, taptun.ErrNotProbing) {
+		t.Errorf("confirm unknown address: %v", err)
+	}
+	r.AddAddress(ndpLocalIP)
+	if err := r.ConfirmAddress(ndpLocalIP); !errors.Is(err, taptun.ErrNotProbing) {
+		t.Errorf("confirm added address: %v", err)
+	}
+	// the address stays usable
+	solicitation := pktutil.NewNeighborSolicitation(ndpPeerIP, ndpPeerMAC, ndpLocalIP)
+	if reply := r.Handle(ndpFrame(t, solicitation)); reply == nil {
+		t.Error("address dropped")
+	}
+}
+
+func TestNDPResponderRouterSolicitation(t *testing.T) {
+	r := taptun.NewNDPResponder(ndpLocalMAC)
+	linkLocal := net.ParseIP("fe80::1")
+	peerLinkLocal := net.ParseIP("fe80::2")
+	r.AddAddress(linkLocal)
+	solicitation := ndpFrame(t, pktutil.NewRouterSolicitation(peerLinkLocal, ndpPeerMAC))
+	if reply := r.Handle(solicitation); reply != nil {
+		t.Errorf("advertised without a configured advertisement: %x", reply)
+	}
+
+	r.SetRouterAdvertisement(&pktutil.RouterAdvertisement{CurHopLimit: 64, RouterLifetime: 1800})
+	reply := r.Handle(solicitation)
+	if reply == nil {
+		t.Fatal("no advertisement")
+	}
+	if dst := pktutil.MACDestination(reply); dst.String() != ndpPeerMAC.String() {
+		t.Errorf("advertisement to %s", dst)
+	}
+	ip, m := decodeNDP(t, reply)
+	if m.Type != pktutil.ICMPv6RouterAdvertisement || m.RouterLifetime != 1800 || m.CurHopLimit != 64 ||
+		!ip.Source.Equal(linkLocal) || !ip.Destination.Equal(peerLinkLocal) {
+		t.Errorf("advertisement %+v from %s to %s", m, ip.Source, ip.Destination)
+	}
+
+	// a solicitation without a source address is answered to all nodes
+	reply = r.Handle(ndpFrame(t, pktutil.NewRouterSolicitation(net.IPv6unspecified, nil)))
+	if reply == nil {
+		t.Fatal("no advertisement")
+	}
+	if ip, _ := decodeNDP(t, reply); !ip.Destination.Equal(pktutil.IPv6AllNodes) {
+		t.Errorf("advertisement to %s", ip.Destination)
+	}
+}
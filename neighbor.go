@@ -0,0 +1,111 @@
+package taptun
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Default time a NeighborCache keeps an entry that is not refreshed.
+const DefaultNeighborTimeout = time.Minute
+
+// NeighborCache maps IPv4 and IPv6 addresses to link-layer addresses,
+// forgetting entries that are not refreshed within a timeout.
+type NeighborCache struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	entries map[[16]byte]neighbor
+}
+
+type neighbor struct {
+	mac     net.HardwareAddr
+	expires time.Time
+}
+
+// Creates an empty cache whose entries expire after timeout.
+func NewNeighborCache(timeout time.Duration) *NeighborCache {
+	return &NeighborCache{
+		timeout: timeout,
+		entries: make(map[[16]byte]neighbor),
+	}
+}
+
+// Adds or refreshes the entry for ip.
+func (c *NeighborCache) Add(ip net.IP, mac net.HardwareAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(ip, mac)
+}
+
+// Refreshes the entry for ip if there is a current one, returning whether
+// there was.
+func (c *NeighborCache) Update(ip net.IP, mac net.HardwareAddr) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.lookup(ip); !ok {
+		return false
+	}
+	c.add(ip, mac)
+	return true
+}
+
+// Returns the link-layer address of ip, if it has a current entry.
+func (c *NeighborCache) Lookup(ip net.IP) (net.HardwareAddr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookup(ip)
+}
+
+// Removes the entry for ip.
+func (c *NeighborCache) Remove(ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, neighborKey(ip))
+}
+
+// Drops expired entries and returns how many there were. Expired entries
+// are never returned by Lookup, so calling Expire only frees memory.
+func (c *NeighborCache) Expire() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the number of entries, including expired ones not yet dropped.
+func (c *NeighborCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Adds or refreshes the entry for ip. Must be called with c.mu held.
+func (c *NeighborCache) add(ip net.IP, mac net.HardwareAddr) {
+	c.entries[neighborKey(ip)] = neighbor{
+		mac:     append(net.HardwareAddr(nil), mac...),
+		expires: time.Now().Add(c.timeout),
+	}
+}
+
+// Returns the current entry for ip. Must be called with c.mu held.
+func (c *NeighborCache) lookup(ip net.IP) (net.HardwareAddr, bool) {
+	n, ok := c.entries[neighborKey(ip)]
+	if !ok || time.Now().After(n.expires) {
+		return nil, false
+	}
+	return n.mac, true
+}
+
+func neighborKey(ip net.IP) [16]byte {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	return key
+}
@@ -0,0 +1,36 @@
+package taptun_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/catalyzeio/taptun"
+)
+
+func TestNeighborCacheExpiry(t *testing.T) {
+	c := taptun.NewNeighborCache(20 * time.Millisecond)
+	ip := net.ParseIP("10.0.0.2")
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	if c.Update(ip, mac) {
+		t.Error("updated a missing entry")
+	}
+	c.Add(ip, mac)
+	if got, ok := c.Lookup(ip); !ok || got.String() != mac.String() {
+		t.Errorf("lookup %s, %v", got, ok)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Lookup(ip); ok {
+		t.Error("expired entry found")
+	}
+	if c.Update(ip, mac) {
+		t.Error("updated an expired entry")
+	}
+	if n := c.Len(); n != 1 {
+		t.Errorf("%d entries before Expire", n)
+	}
+	if n := c.Expire(); n != 1 || c.Len() != 0 {
+		t.Errorf("expired %d, %d left", n, c.Len())
+	}
+}
@@ -0,0 +1,180 @@
+// +build linux
+
+package taptun
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+/*
+Addresses and routes are managed over rtnetlink instead of the SIOCSIFADDR
+and SIOCADDRT families of ioctls, since the ioctls cannot remove a specific
+IPv4 address and use different request layouts for IPv6.
+*/
+
+var nlSeq uint32
+
+func addAddress(ifName string, addr *net.IPNet) error {
+	return addrRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifName, addr)
+}
+
+func removeAddress(ifName string, addr *net.IPNet) error {
+	return addrRequest(syscall.RTM_DELADDR, 0, ifName, addr)
+}
+
+func addrRequest(msgType uint16, flags uint16, ifName string, addr *net.IPNet) error {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+	family, ip := ipFamily(addr.IP)
+	if family == 0 {
+		return fmt.Errorf("invalid address %s", addr)
+	}
+	ones, _ := addr.Mask.Size()
+
+	msg := syscall.IfAddrmsg{
+		Family:    family,
+		Prefixlen: uint8(ones),
+		Index:     uint32(ifi.Index),
+	}
+	body := (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:]
+	body = appendAttr(body, syscall.IFA_LOCAL, ip)
+	body = appendAttr(body, syscall.IFA_ADDRESS, ip)
+	return netlinkRequest(msgType, flags, body)
+}
+
+func addRoute(ifName string, route *Route) error {
+	return routeRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifName, route)
+}
+
+func removeRoute(ifName string, route *Route) error {
+	return routeRequest(syscall.RTM_DELROUTE, 0, ifName, route)
+}
+
+func routeRequest(msgType uint16, flags uint16, ifName string, route *Route) error {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+	family, dst := ipFamily(route.Dst.IP.Mask(route.Dst.Mask))
+	if family == 0 {
+		return fmt.Errorf("invalid destination %s", route.Dst)
+	}
+	ones, _ := route.Dst.Mask.Size()
+
+	var gw net.IP
+	scope := uint8(syscall.RT_SCOPE_LINK)
+	if route.Gateway != nil {
+		var gwFamily uint8
+		gwFamily, gw = ipFamily(route.Gateway)
+		if gwFamily != family {
+			return fmt.Errorf("gateway %s does not match destination %s", route.Gateway, route.Dst)
+		}
+		scope = syscall.RT_SCOPE_UNIVERSE
+	}
+
+	msg := syscall.RtMsg{
+		Family:   family,
+		Dst_len:  uint8(ones),
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    scope,
+		Type:     syscall.RTN_UNICAST,
+	}
+	body := (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:]
+	if ones > 0 {
+		body = appendAttr(body, syscall.RTA_DST, dst)
+	}
+	index := make([]byte, 4)
+	binary.NativeEndian.PutUint32(index, uint32(ifi.Index))
+	body = appendAttr(body, syscall.RTA_OIF, index)
+	if gw != nil {
+		body = appendAttr(body, syscall.RTA_GATEWAY, gw)
+	}
+	return netlinkRequest(msgType, flags, body)
+}
+
+func ipFamily(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return syscall.AF_INET6, ip6
+	}
+	return 0, nil
+}
+
+func appendAttr(b []byte, attrType uint16, data []byte) []byte {
+	attrLen := syscall.SizeofRtAttr + len(data)
+	hdr := make([]byte, syscall.SizeofRtAttr)
+	binary.NativeEndian.PutUint16(hdr[0:], uint16(attrLen))
+	binary.NativeEndian.PutUint16(hdr[2:], attrType)
+	b = append(b, hdr...)
+	b = append(b, data...)
+	for i := attrLen; i < rtaAlign(attrLen); i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func rtaAlign(n int) int {
+	return (n + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+// Sends a single rtnetlink request and waits for its acknowledgement.
+func netlinkRequest(msgType uint16, flags uint16, body []byte) error {
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sock)
+
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(sock, sa); err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint32(&nlSeq, 1)
+	hdr := syscall.NlMsghdr{
+		Len:   uint32(syscall.SizeofNlMsghdr + len(body)),
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   seq,
+	}
+	req := append((*[syscall.SizeofNlMsghdr]byte)(unsafe.Pointer(&hdr))[:], body...)
+	if err := syscall.Sendto(sock, req, 0, sa); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(sock, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("short netlink error message")
+			}
+			// the error code is negated; zero indicates success
+			code := int32(binary.NativeEndian.Uint32(m.Data))
+			if code != 0 {
+				return syscall.Errno(-code)
+			}
+			return nil
+		}
+	}
+}
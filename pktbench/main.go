@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+var (
+	run   string
+	sizes string
+)
+
+// A named pktutil benchmark.
+type bench struct {
+	name string
+	fn   func(b *testing.B)
+}
+
+func main() {
+	flag.StringVar(&run, "run", ".", "regular expression selecting the benchmarks to run")
+	flag.StringVar(&sizes, "sizes", "20,64,512,1500,9000", "comma-separated buffer sizes for the checksum benchmarks")
+	flag.Parse()
+
+	err := runBenchmarks()
+	if err != nil {
+		fmt.Printf("Error running benchmarks: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func runBenchmarks() error {
+	re, err := regexp.Compile(run)
+	if err != nil {
+		return err
+	}
+	benches, err := checksumBenchmarks()
+	if err != nil {
+		return err
+	}
+	for _, bench := range benches {
+		if !re.MatchString(bench.name) {
+			continue
+		}
+		r := testing.Benchmark(bench.fn)
+		fmt.Printf("Benchmark%s\t%s\t%s\n", bench.name, r, r.MemString())
+	}
+	return nil
+}
+
+func checksumBenchmarks() ([]bench, error) {
+	var benches []bench
+	for _, field := range strings.Split(sizes, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if size < 1 {
+			return nil, fmt.Errorf("buffer size %d out of range", size)
+		}
+		buf := make([]byte, size)
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+		benches = append(benches,
+			bench{fmt.Sprintf("Checksum/size=%d", size), checksumBench(buf, pktutil.Checksum)},
+			bench{fmt.Sprintf("ChecksumReference/size=%d", size), checksumBench(buf, referenceChecksum)})
+	}
+
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+	segment := make([]byte, 512)
+	benches = append(benches, bench{"TransportChecksum/ipv6/size=512", func(b *testing.B) {
+		b.SetBytes(int64(len(segment)))
+		for i := 0; i < b.N; i++ {
+			pktutil.TransportChecksum(src, dst, pktutil.UDP, segment)
+		}
+	}})
+
+	header := make([]byte, 20)
+	header[0] = 0x45
+	pktutil.SetIPv4Checksum(header)
+	benches = append(benches, bench{"VerifyIPv4Checksum", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pktutil.VerifyIPv4Checksum(header)
+		}
+	}})
+
+	oldIP := net.IPv4(10, 0, 0, 1).To4()
+	newIP := net.IPv4(192, 168, 1, 1).To4()
+	benches = append(benches,
+		bench{"UpdateChecksum16", func(b *testing.B) {
+			sum := uint16(0x1234)
+			for i := 0; i < b.N; i++ {
+				sum = pktutil.UpdateChecksum16(sum, uint16(i), uint16(i+1))
+			}
+		}},
+		bench{"UpdateChecksumBytes/ipv4", func(b *testing.B) {
+			sum := uint16(0x1234)
+			for i := 0; i < b.N; i++ {
+				sum = pktutil.UpdateChecksumBytes(sum, oldIP, newIP)
+			}
+		}})
+	return benches, nil
+}
+
+func checksumBench(buf []byte, checksum func([]byte) uint16) func(b *testing.B) {
+	return func(b *testing.B) {
+		b.SetBytes(int64(len(buf)))
+		for i := 0; i < b.N; i++ {
+			checksum(buf)
+		}
+	}
+}
+
+// Straightforward RFC 1071 checksum, as a baseline for pktutil.Checksum.
+func referenceChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
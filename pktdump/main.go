@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"os"
 
 	"github.com/catalyzeio/taptun/pktutil"
 )
@@ -17,7 +18,13 @@ func main() {
 		return
 	}
 
-	p, err := pktutil.OpenPcap(args[0])
+	var p *pktutil.PcapReader
+	var err error
+	if args[0] == "-" {
+		p, err = pktutil.NewPcapReader(os.Stdin)
+	} else {
+		p, err = pktutil.OpenPcap(args[0])
+	}
 	if err != nil {
 		fmt.Printf("Error: could not read file: %s\n", err)
 		return
@@ -38,19 +45,31 @@ func main() {
 			fmt.Printf(" (truncated)")
 		}
 		fmt.Printf("\n")
-		// XXX the remaining code does not do any bounds-checking
-		fmt.Printf("Layer 2\n")
-		fmt.Printf("    Src  MAC: %s\n", pktutil.MACSource(pkt.Data))
-		fmt.Printf("    Dest MAC: %s\n", pktutil.MACDestination(pkt.Data))
-		payload := pktutil.MACPayload(pkt.Data)
-		if pktutil.IsIPv4(payload) {
-			fmt.Printf("Layer 3 - IPv4\n")
-			fmt.Printf("    Src  IP: %s\n", pktutil.IPv4Source(payload))
-			fmt.Printf("    Dest IP: %s\n", pktutil.IPv4Destination(payload))
-			data := pktutil.IPv4Payload(payload)
-			fmt.Printf("Data\n    %x\n", data)
+		fmt.Printf("Layer 2 - %s\n", pkt.LinkType)
+		if pkt.LinkType == pktutil.LinkTypeEthernet {
+			var frame pktutil.EthernetFrame
+			if err := frame.Decode(pkt.Data); err == nil {
+				fmt.Printf("    Src  MAC: %s\n", frame.Source)
+				fmt.Printf("    Dest MAC: %s\n", frame.Destination)
+			}
+		}
+		ethertype, payload, err := pkt.NetworkPayload()
+		if err != nil {
+			fmt.Printf("    Error: %s\n", err)
+			fmt.Printf("Data\n    %x\n", pkt.Data)
+		} else if ethertype == pktutil.IPv4 {
+			var ip pktutil.IPv4Header
+			if err := ip.Decode(payload); err != nil {
+				fmt.Printf("Layer 3 - IPv4\n    Error: %s\n", err)
+				fmt.Printf("Data\n    %x\n", payload)
+			} else {
+				fmt.Printf("Layer 3 - IPv4\n")
+				fmt.Printf("    Src  IP: %s\n", ip.Source)
+				fmt.Printf("    Dest IP: %s\n", ip.Destination)
+				fmt.Printf("Data\n    %x\n", ip.Payload)
+			}
 		} else {
-			fmt.Printf("Payload\n    %x\n", payload)
+			fmt.Printf("Payload - ethertype %x\n    %x\n", ethertype[:], payload)
 		}
 		fmt.Printf("\n")
 	}
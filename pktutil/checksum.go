@@ -0,0 +1,262 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Returns the Internet checksum (RFC 1071) of b: the one's complement of
+// the one's complement sum of its 16-bit words.
+func Checksum(b []byte) uint16 {
+	return fold(sum16(b, 0))
+}
+
+// Computes and stores the header checksum of an IPv4 packet.
+func SetIPv4Checksum(packet []byte) {
+	header := packet[:IPv4HeaderLength(packet)]
+	header[10], header[11] = 0, 0
+	binary.BigEndian.PutUint16(header[10:], Checksum(header))
+}
+
+// Reports whether the header checksum of an IPv4 packet is correct.
+func VerifyIPv4Checksum(packet []byte) bool {
+	return Checksum(packet[:IPv4HeaderLength(packet)]) == 0
+}
+
+// Returns the checksum of segment, a TCP, UDP or ICMPv6 message sent from
+// src to dst, including the IPv4 or IPv6 pseudo-header. The checksum field
+// of segment must be zero.
+func TransportChecksum(src, dst net.IP, protocol IPProtocol, segment []byte) uint16 {
+	return fold(sum16(segment, pseudoHeaderSum(src, dst, protocol, len(segment))))
+}
+
+// Computes and stores the TCP, UDP, ICMP or ICMPv6 checksum of an IPv4 or
+// IPv6 packet. Fragmented packets are rejected, since their checksum
+// covers data not present.
+func SetTransportChecksum(packet []byte) error {
+	src, dst, protocol, segment, offset, err := transportSegment(packet)
+	if err != nil {
+		return err
+	}
+	segment[offset], segment[offset+1] = 0, 0
+	var sum uint16
+	if protocol == ICMP {
+		sum = Checksum(segment)
+	} else {
+		sum = TransportChecksum(src, dst, protocol, segment)
+	}
+	if sum == 0 && protocol == UDP {
+		// zero means no checksum, so send its other representation
+		sum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(segment[offset:], sum)
+	return nil
+}
+
+// Reports whether the TCP, UDP, ICMP or ICMPv6 checksum of an IPv4 or IPv6
+// packet is correct. UDP over IPv4 without a checksum is accepted.
+func VerifyTransportChecksum(packet []byte) (bool, error) {
+	src, dst, protocol, segment, offset, err := transportSegment(packet)
+	if err != nil {
+		return false, err
+	}
+	if protocol == ICMP {
+		return Checksum(segment) == 0, nil
+	}
+	if protocol == UDP && len(src) == net.IPv4len && binary.BigEndian.Uint16(segment[offset:]) == 0 {
+		return true, nil
+	}
+	return TransportChecksum(src, dst, protocol, segment) == 0, nil
+}
+
+// Returns the addresses, upper-layer protocol and segment of packet, along
+// with the offset of the checksum field in the segment.
+func transportSegment(packet []byte) (src, dst net.IP, protocol IPProtocol, segment []byte, offset int, err error) {
+	if len(packet) > 0 && IsIPv4(packet) {
+		var h IPv4Header
+		if err = h.Decode(packet); err != nil {
+			return
+		}
+		if h.Flags&IPv4FlagMF != 0 || h.FragmentOffset != 0 {
+			err = fmt.Errorf("checksum: %w: fragmented packet", ErrUnsupported)
+			return
+		}
+		src, dst, protocol, segment = h.Source, h.Destination, h.Protocol, h.Payload
+	} else {
+		var h IPv6Header
+		if err = h.Decode(packet); err != nil {
+			return
+		}
+		w := NewIPv6ExtensionWalker(packet)
+		for w.Next() {
+			if w.Header().Protocol == IPv6_Frag {
+				err = fmt.Errorf("checksum: %w: fragmented packet", ErrUnsupported)
+				return
+			}
+		}
+		if err = w.Err(); err != nil {
+			return
+		}
+		src, dst, protocol = h.Source, h.Destination, w.Protocol()
+		segment = packet[w.Offset() : 40+int(h.PayloadLength)]
+	}
+	var minLen int
+	switch {
+	case protocol == TCP:
+		offset, minLen = 16, 20
+	case protocol == UDP:
+		offset, minLen = 6, 8
+	case protocol == ICMP && len(src) == net.IPv4len, protocol == IPv6_ICMP && len(src) == net.IPv6len:
+		offset, minLen = 2, 4
+	default:
+		err = fmt.Errorf("checksum: %w: protocol %d", ErrUnsupported, protocol)
+		return
+	}
+	if len(segment) < minLen {
+		err = fmt.Errorf("checksum: %w: segment of %d bytes", ErrTruncated, len(segment))
+	}
+	return
+}
+
+// Returns checksum updated for a 16-bit field of the checksummed data
+// changing from old to new, following RFC 1624 equation 3.
+func UpdateChecksum16(checksum, old, new uint16) uint16 {
+	return fold(uint64(^checksum) + uint64(^old) + uint64(new))
+}
+
+// Returns checksum updated for a 32-bit field changing from old to new.
+func UpdateChecksum32(checksum uint16, old, new uint32) uint16 {
+	sum := uint64(^checksum)
+	sum += uint64(^uint16(old>>16)) + uint64(^uint16(old))
+	sum += uint64(new>>16) + uint64(new&0xFFFF)
+	return fold(sum)
+}
+
+// Returns checksum updated for a field at an even offset changing from old
+// to new, e.g. an IPv4 or IPv6 address. The slices must have the same
+// length.
+func UpdateChecksumBytes(checksum uint16, old, new []byte) uint16 {
+	sum := uint64(^checksum)
+	// fold complements, giving the ~m term of the update
+	sum += uint64(fold(sum16(old, 0)))
+	sum = sum16(new, sum)
+	return fold(sum)
+}
+
+// Updates the checksum stored at the start of field for a 16-bit word of
+// the checksummed data changing from old to new.
+func updateChecksumField(field []byte, old, new uint16) {
+	binary.BigEndian.PutUint16(field, UpdateChecksum16(binary.BigEndian.Uint16(field), old, new))
+}
+
+// Like updateChecksumField, but leaves a zero UDP checksum, meaning none,
+// alone and never stores a zero result.
+func updateUDPChecksumField(field []byte, old, new uint16) {
+	sum := binary.BigEndian.Uint16(field)
+	if sum == 0 {
+		return
+	}
+	sum = UpdateChecksum16(sum, old, new)
+	if sum == 0 {
+		sum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(field, sum)
+}
+
+// Like updateUDPChecksumField when udp is set, else like
+// updateChecksumField, for an address in the pseudo-header changing from
+// old to new.
+func updateTransportChecksumField(field []byte, udp bool, old, new []byte) {
+	sum := binary.BigEndian.Uint16(field)
+	if udp && sum == 0 {
+		return
+	}
+	sum = UpdateChecksumBytes(sum, old, new)
+	if udp && sum == 0 {
+		sum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(field, sum)
+}
+
+// Returns the checksum field of the TCP, UDP or ICMPv6 header of an IPv4
+// or IPv6 packet, which covers the addresses through the pseudo-header,
+// and whether it is a UDP checksum. Returns nil if there is no such header,
+// as in later fragments.
+func transportChecksumField(packet []byte) ([]byte, bool) {
+	var protocol IPProtocol
+	var segment []byte
+	if IsIPv4(packet) {
+		if len(packet) < 20 || len(packet) < IPv4HeaderLength(packet) || IPv4FragmentOffset(packet) != 0 {
+			return nil, false
+		}
+		protocol = IPv4Protocol(packet)
+		segment = packet[IPv4HeaderLength(packet):]
+	} else {
+		w := NewIPv6ExtensionWalker(packet)
+		for w.Next() {
+		}
+		if w.Err() != nil || w.Fragment() {
+			return nil, false
+		}
+		protocol = w.Protocol()
+		segment = packet[w.Offset():]
+	}
+	switch {
+	case protocol == TCP && len(segment) >= 20:
+		return segment[16:18], false
+	case protocol == UDP && len(segment) >= 8:
+		return segment[6:8], true
+	case protocol == IPv6_ICMP && len(segment) >= 4 && IsIPv6(packet):
+		return segment[2:4], false
+	}
+	return nil, false
+}
+
+// Adds the 16-bit big-endian words of b to sum, padding an odd final byte
+// with zero. Words are added 32 bits at a time; as 1<<16 is 1 in one's
+// complement arithmetic, the folded result is the same.
+func sum16(b []byte, sum uint64) uint64 {
+	for len(b) >= 32 {
+		sum += uint64(binary.BigEndian.Uint32(b[0:])) +
+			uint64(binary.BigEndian.Uint32(b[4:])) +
+			uint64(binary.BigEndian.Uint32(b[8:])) +
+			uint64(binary.BigEndian.Uint32(b[12:])) +
+			uint64(binary.BigEndian.Uint32(b[16:])) +
+			uint64(binary.BigEndian.Uint32(b[20:])) +
+			uint64(binary.BigEndian.Uint32(b[24:])) +
+			uint64(binary.BigEndian.Uint32(b[28:]))
+		b = b[32:]
+	}
+	for len(b) >= 4 {
+		sum += uint64(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	if len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+// Folds sum to 16 bits and returns its one's complement.
+func fold(sum uint64) uint16 {
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
+// Returns the partial sum of the IPv4 or IPv6 pseudo-header used by
+// upper-layer checksums. IPv4 addresses may be given in either form: the
+// 0xFFFF prefix of the 16-byte form adds nothing to a one's complement sum.
+func pseudoHeaderSum(src, dst net.IP, protocol IPProtocol, length int) uint64 {
+	sum := sum16(src, 0)
+	sum = sum16(dst, sum)
+	sum += uint64(protocol)
+	sum += uint64(length)
+	return sum
+}
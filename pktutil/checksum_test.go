@@ -0,0 +1,246 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// Packets captured from a Linux TUN device, with checksums computed by the
+// kernel.
+var capturedPackets = []struct {
+	name   string
+	packet string
+}{
+	{"ipv4 udp", "4500002192bb40004011940e0a0000010a000002cfad0035000dd81c68656c6c6f"},
+	{"ipv4 tcp syn", "4500003cd3494000400653700a0000010a000002e27600509ec1113200000000a002faf0e19c0000020405b40402080a057abf38000000000103030a"},
+	{"ipv6 icmpv6 echo", "600cfcb0000b3a40fd000000000000000000000000000001fd0000000000000000000000000000028000c14a00070001616263"},
+	{"ipv6 router solicitation", "6000000000083afffe80000000000000ca94b4919e1c9e5eff0200000000000000000000000000028500c19500000000"},
+}
+
+func capturedPacket(t testing.TB, i int) []byte {
+	packet, err := hex.DecodeString(capturedPackets[i].packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+// Straightforward RFC 1071 checksum to compare Checksum against.
+func referenceChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = sum>>16 + sum&0xFFFF
+	}
+	return ^uint16(sum)
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want uint16
+	}{
+		{"RFC 1071 example", "0001f203f4f5f6f7", 0x220D},
+		{"IPv4 header", "450000730000400040110000c0a80001c0a800c7", 0xB861},
+		{"IPv4 header with checksum", "45000073000040004011b861c0a80001c0a800c7", 0},
+		{"odd length", "01", 0xFEFF},
+		{"empty", "", 0xFFFF},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Checksum(data); got != test.want {
+			t.Errorf("%s: got %#04x, want %#04x", test.name, got, test.want)
+		}
+	}
+
+	// every length and alignment against the reference
+	r := rand.New(rand.NewSource(1))
+	buf := make([]byte, 300)
+	r.Read(buf)
+	for start := 0; start < 8; start++ {
+		for end := start; end <= len(buf); end++ {
+			if got, want := Checksum(buf[start:end]), referenceChecksum(buf[start:end]); got != want {
+				t.Fatalf("buf[%d:%d]: got %#04x, want %#04x", start, end, got, want)
+			}
+		}
+	}
+}
+
+func TestTransportChecksum(t *testing.T) {
+	for i, test := range capturedPackets {
+		packet := capturedPacket(t, i)
+		if IsIPv4(packet) && !VerifyIPv4Checksum(packet) {
+			t.Errorf("%s: bad IPv4 checksum", test.name)
+		}
+		if ok, err := VerifyTransportChecksum(packet); !ok || err != nil {
+			t.Errorf("%s: verify: %v, %v", test.name, ok, err)
+		}
+
+		src, dst, protocol, segment, offset, err := transportSegment(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := binary.BigEndian.Uint16(segment[offset:])
+		binary.BigEndian.PutUint16(segment[offset:], 0)
+		if got := TransportChecksum(src, dst, protocol, segment); got != want {
+			t.Errorf("%s: TransportChecksum %#04x, want %#04x", test.name, got, want)
+		}
+		if err := SetTransportChecksum(packet); err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.BigEndian.Uint16(segment[offset:]); got != want {
+			t.Errorf("%s: SetTransportChecksum stored %#04x, want %#04x", test.name, got, want)
+		}
+
+		packet[len(packet)-1]++
+		if ok, _ := VerifyTransportChecksum(packet); ok {
+			t.Errorf("%s: corrupted packet verified", test.name)
+		}
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	// RFC 1624 section 4
+	if got := UpdateChecksum16(0xDD2F, 0x5555, 0x3285); got != 0x0000 {
+		t.Errorf("RFC 1624 example: got %#04x, want 0x0000", got)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, 2+2*r.Intn(40))
+		r.Read(data)
+		checksum := Checksum(data)
+
+		// a random field of 2, 4 or 16 bytes at an even offset
+		size := []int{2, 4, 16}[r.Intn(3)]
+		if size > len(data) {
+			size = 2
+		}
+		offset := 2 * r.Intn((len(data)-size)/2+1)
+		field := data[offset : offset+size]
+		old := append([]byte(nil), field...)
+		r.Read(field)
+
+		var got uint16
+		switch size {
+		case 2:
+			got = UpdateChecksum16(checksum, binary.BigEndian.Uint16(old), binary.BigEndian.Uint16(field))
+		case 4:
+			got = UpdateChecksum32(checksum, binary.BigEndian.Uint32(old), binary.BigEndian.Uint32(field))
+		default:
+			got = UpdateChecksumBytes(checksum, old, field)
+		}
+		// 0x0000 and 0xFFFF are the same in one's complement arithmetic
+		if want := Checksum(data); got != want && got^want != 0xFFFF {
+			t.Fatalf("%d-byte field at %d of %x: updated %#04x, recomputed %#04x", size, offset, data, got, want)
+		}
+	}
+}
+
+func TestSetAddressUpdatesChecksums(t *testing.T) {
+	for i, test := range capturedPackets {
+		packet := capturedPacket(t, i)
+		if IsIPv4(packet) {
+			SetIPv4Source(packet, net.ParseIP("192.168.7.9"))
+			if !VerifyIPv4Checksum(packet) {
+				t.Errorf("%s: bad IPv4 checksum after update", test.name)
+			}
+		} else {
+			SetIPv6Destination(packet, net.ParseIP("2001:db8::77"))
+		}
+		if ok, err := VerifyTransportChecksum(packet); !ok || err != nil {
+			t.Errorf("%s: bad transport checksum after update: %v", test.name, err)
+		}
+	}
+}
+
+func TestSetIPv4AddressPanics(t *testing.T) {
+	packet := capturedPacket(t, 0)
+	want := append([]byte(nil), packet...)
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic for an IPv6 address")
+		}
+		if string(packet) != string(want) {
+			t.Error("packet changed")
+		}
+	}()
+	SetIPv4Source(packet, net.ParseIP("fd00::1"))
+}
+
+var checksumSizes = []int{20, 64, 512, 1500, 9000}
+
+func BenchmarkChecksum(b *testing.B) {
+	for _, size := range checksumSizes {
+		buf := make([]byte, size)
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				Checksum(buf)
+			}
+		})
+	}
+}
+
+func BenchmarkChecksumReference(b *testing.B) {
+	for _, size := range checksumSizes {
+		buf := make([]byte, size)
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				referenceChecksum(buf)
+			}
+		})
+	}
+}
+
+func BenchmarkChecksumTransport(b *testing.B) {
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+	segment := make([]byte, 512)
+	b.SetBytes(int64(len(segment)))
+	for i := 0; i < b.N; i++ {
+		TransportChecksum(src, dst, UDP, segment)
+	}
+}
+
+func BenchmarkChecksumVerifyIPv4(b *testing.B) {
+	header := make([]byte, 20)
+	header[0] = 0x45
+	SetIPv4Checksum(header)
+	for i := 0; i < b.N; i++ {
+		VerifyIPv4Checksum(header)
+	}
+}
+
+func BenchmarkChecksumUpdate16(b *testing.B) {
+	sum := uint16(0x1234)
+	for i := 0; i < b.N; i++ {
+		sum = UpdateChecksum16(sum, uint16(i), uint16(i+1))
+	}
+}
+
+func BenchmarkChecksumUpdateBytes(b *testing.B) {
+	oldIP := net.IPv4(10, 0, 0, 1).To4()
+	newIP := net.IPv4(192, 168, 1, 1).To4()
+	sum := uint16(0x1234)
+	for i := 0; i < b.N; i++ {
+		sum = UpdateChecksumBytes(sum, oldIP, newIP)
+	}
+}
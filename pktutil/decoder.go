@@ -0,0 +1,195 @@
+package pktutil
+
+// Layers is a set of protocol layers found by a Decoder.
+type Layers uint16
+
+const (
+	LayerEthernet Layers = 1 << iota
+	LayerVLAN
+	LayerIPv4
+	LayerIPv6
+	LayerTCP
+	LayerUDP
+	LayerICMP
+	LayerICMPv6
+	LayerPayload
+	LayerARP
+)
+
+// Reports whether all layers in l are present.
+func (ls Layers) Has(l Layers) bool {
+	return ls&l == l
+}
+
+// DecodedPacket holds the header views filled in by a Decoder. It is meant
+// to be reused across calls; only the views named in Layers are valid
+// after a decode.
+type DecodedPacket struct {
+	Layers Layers
+
+	Ethernet EthernetFrame
+	ARP      ARPHeader
+	IPv4     IPv4Header
+	IPv6     IPv6Header
+	TCP      TCPHeader
+	UDP      UDPHeader
+	// Used for both ICMP and ICMPv6.
+	ICMP ICMPHeader
+
+	// Outermost VLAN tag of a tagged frame.
+	VLAN VLANTag
+
+	// IPv6 extension headers between the fixed header and Protocol.
+	IPv6Extensions []byte
+	// Whether the packet is an IPv4 or IPv6 fragment other than the first,
+	// whose payload continues an earlier fragment rather than starting a
+	// transport header.
+	Fragment bool
+
+	// Network-layer protocol, even if it was not decoded.
+	Ethertype Ethertype
+	// Transport-layer protocol, even if it was not decoded. For IPv6 this is
+	// the protocol following any extension headers.
+	Protocol IPProtocol
+	// Bytes following the innermost decoded header.
+	Payload []byte
+}
+
+// Decoder splits frames and packets into their protocol layers without
+// allocating.
+type Decoder struct {
+	// Link-layer format of the input: LinkTypeEthernet for frames read from
+	// a TAP device, LinkTypeRaw for packets read from a TUN device. The zero
+	// value, LinkTypeNull, is taken to mean LinkTypeEthernet; to decode a
+	// BSD loopback capture, strip its header with LinkPayload and decode
+	// the rest as LinkTypeRaw.
+	LinkType LinkType
+}
+
+// Decodes data into p. Decoding stops without error at the first protocol
+// the decoder does not understand, leaving its bytes in p.Payload. On a
+// malformed header the layers decoded so far remain set in p and an error
+// wrapping ErrTruncated or ErrMalformed is returned. The UDP header of a
+// first fragment is decoded even though the fragment holds only part of the
+// datagram.
+func (d *Decoder) Decode(data []byte, p *DecodedPacket) error {
+	p.Layers = 0
+	p.Ethertype = Ethertype{}
+	p.Protocol = 0
+	p.IPv6Extensions = nil
+	p.Fragment = false
+	p.Payload = nil
+
+	linkType := d.LinkType
+	if linkType == LinkTypeNull {
+		linkType = LinkTypeEthernet
+	}
+
+	var payload []byte
+	// whether the packet is the first of several fragments
+	var first bool
+	if linkType == LinkTypeEthernet {
+		if err := p.Ethernet.Decode(data); err != nil {
+			return err
+		}
+		p.Layers |= LayerEthernet
+		if p.Ethernet.Tagging != NotTagged {
+			p.Layers |= LayerVLAN
+			p.VLAN = parseVLANTag(data[12:])
+		}
+		p.Ethertype = p.Ethernet.Ethertype
+		payload = p.Ethernet.Payload
+	} else {
+		ethertype, network, err := LinkPayload(linkType, data)
+		if err != nil {
+			return err
+		}
+		p.Ethertype = ethertype
+		payload = network
+	}
+
+	switch p.Ethertype {
+	case IPv4:
+		if err := p.IPv4.Decode(payload); err != nil {
+			return err
+		}
+		p.Layers |= LayerIPv4
+		p.Protocol = p.IPv4.Protocol
+		payload = p.IPv4.Payload
+		if p.IPv4.FragmentOffset != 0 {
+			// only the first fragment carries the transport header
+			p.Fragment = true
+			return p.setPayload(payload)
+		}
+		first = p.IPv4.Flags&IPv4FlagMF != 0
+	case IPv6:
+		if err := p.IPv6.Decode(payload); err != nil {
+			return err
+		}
+		p.Layers |= LayerIPv6
+		w := NewIPv6ExtensionWalker(payload)
+		for w.Next() {
+			first = first || w.Header().Protocol == IPv6_Frag
+		}
+		if err := w.Err(); err != nil {
+			return err
+		}
+		p.Protocol = w.Protocol()
+		p.IPv6Extensions = payload[40:w.Offset()]
+		payload = payload[w.Offset() : 40+int(p.IPv6.PayloadLength)]
+		if w.Fragment() {
+			p.Fragment = true
+			return p.setPayload(payload)
+		}
+	case ARP:
+		if err := p.ARP.Decode(payload); err != nil {
+			return err
+		}
+		p.Layers |= LayerARP
+		return nil
+	default:
+		return p.setPayload(payload)
+	}
+
+	switch p.Protocol {
+	case TCP:
+		if err := p.TCP.Decode(payload); err != nil {
+			return err
+		}
+		p.Layers |= LayerTCP
+		payload = p.TCP.Payload
+	case UDP:
+		decode := p.UDP.Decode
+		if first {
+			decode = p.UDP.decodeFirstFragment
+		}
+		if err := decode(payload); err != nil {
+			return err
+		}
+		p.Layers |= LayerUDP
+		payload = p.UDP.Payload
+	case ICMP, IPv6_ICMP:
+		if (p.Protocol == ICMP) != p.Layers.Has(LayerIPv4) {
+			// ICMP over IPv6 or ICMPv6 over IPv4
+			return p.setPayload(payload)
+		}
+		if err := p.ICMP.Decode(payload); err != nil {
+			return err
+		}
+		if p.Protocol == ICMP {
+			p.Layers |= LayerICMP
+		} else {
+			p.Layers |= LayerICMPv6
+		}
+		payload = p.ICMP.Body
+	}
+	return p.setPayload(payload)
+}
+
+func (p *DecodedPacket) setPayload(payload []byte) error {
+	p.Payload = payload
+	if len(payload) > 0 {
+		p.Layers |= LayerPayload
+	}
+	return nil
+}
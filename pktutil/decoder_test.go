@@ -0,0 +1,186 @@
+package pktutil
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+var (
+	testMAC1 = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	testMAC2 = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+func mustSerialize(t testing.TB, layers ...Layer) []byte {
+	t.Helper()
+	b, err := Serialize(layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testIPv4(src, dst string) *IPv4Header {
+	return &IPv4Header{Source: net.ParseIP(src), Destination: net.ParseIP(dst)}
+}
+
+func testIPv6(src, dst string) *IPv6Header {
+	return &IPv6Header{Source: net.ParseIP(src), Destination: net.ParseIP(dst)}
+}
+
+type decodeTest struct {
+	name     string
+	linkType LinkType
+	data     []byte
+	layers   Layers
+	protocol IPProtocol
+	payload  string
+}
+
+func decodeTests(t testing.TB) []decodeTest {
+	eth := func() *EthernetFrame { return &EthernetFrame{Destination: testMAC1, Source: testMAC2} }
+	fragment := testIPv4("10.0.0.1", "10.0.0.2")
+	fragment.FragmentOffset = 10
+	fragment.Protocol = UDP
+	return []decodeTest{
+		{
+			"ethernet ipv4 tcp", LinkTypeEthernet,
+			mustSerialize(t, eth(), testIPv4("10.0.0.1", "10.0.0.2"), &TCPHeader{SourcePort: 1, DestinationPort: 2, Flags: TCPFlagSYN}, Payload("tcp")),
+			LayerEthernet | LayerIPv4 | LayerTCP | LayerPayload, TCP, "tcp",
+		},
+		{
+			"ethernet vlan ipv6 udp", LinkTypeEthernet,
+			mustSerialize(t, eth(), &VLANTag{VID: 5}, testIPv6("fd00::1", "fd00::2"), &UDPHeader{SourcePort: 1, DestinationPort: 2}, Payload("udp")),
+			LayerEthernet | LayerVLAN | LayerIPv6 | LayerUDP | LayerPayload, UDP, "udp",
+		},
+		{
+			"ethernet ipv4 icmp", LinkTypeEthernet,
+			mustSerialize(t, eth(), testIPv4("10.0.0.1", "10.0.0.2"), &ICMPHeader{Type: ICMPv4EchoRequest, Body: []byte{0, 1, 0, 1}}, Payload("ping")),
+			LayerEthernet | LayerIPv4 | LayerICMP | LayerPayload, ICMP, "\x00\x01\x00\x01ping",
+		},
+		{
+			"raw ipv6 icmpv6", LinkTypeRaw,
+			mustSerialize(t, testIPv6("fd00::1", "fd00::2"), &ICMPHeader{Type: ICMPv6EchoRequest, Body: []byte{0, 1, 0, 1}}),
+			LayerIPv6 | LayerICMPv6 | LayerPayload, IPv6_ICMP, "\x00\x01\x00\x01",
+		},
+		{
+			"raw ipv4 later fragment", LinkTypeRaw,
+			mustSerialize(t, fragment, Payload("more data")),
+			LayerIPv4 | LayerPayload, UDP, "more data",
+		},
+		{
+			"zero link type is ethernet", LinkTypeNull,
+			mustSerialize(t, eth(), testIPv4("10.0.0.1", "10.0.0.2"), &UDPHeader{}, Payload("udp")),
+			LayerEthernet | LayerIPv4 | LayerUDP | LayerPayload, UDP, "udp",
+		},
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, test := range decodeTests(t) {
+		var p DecodedPacket
+		d := Decoder{LinkType: test.linkType}
+		if err := d.Decode(test.data, &p); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		payload := string(p.Payload)
+		if p.Layers != test.layers || p.Protocol != test.protocol || payload != test.payload {
+			t.Errorf("%s: layers %b, protocol %d, payload %q; want %b, %d, %q",
+				test.name, p.Layers, p.Protocol, payload, test.layers, test.protocol, test.payload)
+		}
+	}
+}
+
+func TestDecodeVLAN(t *testing.T) {
+	frame := mustSerialize(t, &EthernetFrame{Destination: testMAC1, Source: testMAC2},
+		&VLANTag{TPID: IEEE802_1ad, VID: 100}, &VLANTag{VID: 5, PCP: 3}, testIPv4("10.0.0.1", "10.0.0.2"), &UDPHeader{})
+	var p DecodedPacket
+	d := Decoder{LinkType: LinkTypeEthernet}
+	if err := d.Decode(frame, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.VLAN.VID != 100 || p.VLAN.TPID != IEEE802_1ad || p.Ethernet.Tagging.Depth() != 2 {
+		t.Errorf("outer tag %+v, depth %d", p.VLAN, p.Ethernet.Tagging.Depth())
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	frame := mustSerialize(t, &EthernetFrame{Destination: testMAC1, Source: testMAC2},
+		testIPv4("10.0.0.1", "10.0.0.2"), &TCPHeader{}, Payload("tcp"))
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short frame", frame[:10], ErrTruncated},
+		{"short ipv4", frame[:20], ErrTruncated},
+		{"short tcp", frame[:14+20+10], ErrTruncated},
+	}
+	for _, test := range tests {
+		var p DecodedPacket
+		d := Decoder{LinkType: LinkTypeEthernet}
+		if err := d.Decode(test.data, &p); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestDecodeAllocs(t *testing.T) {
+	var p DecodedPacket
+	for _, test := range decodeTests(t) {
+		d := Decoder{LinkType: test.linkType}
+		allocs := testing.AllocsPerRun(100, func() {
+			d.Decode(test.data, &p)
+		})
+		if allocs != 0 {
+			t.Errorf("%s: %v allocations per decode", test.name, allocs)
+		}
+	}
+}
+
+func TestDecodeFragment(t *testing.T) {
+	// the UDP header of a 100-byte datagram, of which only 16 bytes follow
+	data := []byte{0, 1, 0, 2, 0, 100, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	tests := []struct {
+		name     string
+		packet   []byte
+		fragment bool
+	}{
+		{"ipv4 first", testIPv4Fragment(t, 1, 0, true, data, nil), false},
+		{"ipv4 later", testIPv4Fragment(t, 1, 16, true, data, nil), true},
+		{"ipv6 first", testIPv6Fragment(t, 1, 0, true, false, data), false},
+		{"ipv6 later", testIPv6Fragment(t, 1, 16, false, true, data), true},
+	}
+	// p is reused to check that Decode resets Fragment
+	var p DecodedPacket
+	d := Decoder{LinkType: LinkTypeRaw}
+	for _, test := range tests {
+		if err := d.Decode(test.packet, &p); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if p.Fragment != test.fragment || p.Layers.Has(LayerUDP) == test.fragment {
+			t.Errorf("%s: fragment %v, layers %b", test.name, p.Fragment, p.Layers)
+			continue
+		}
+		if test.fragment {
+			continue
+		}
+		if p.UDP.SourcePort != 1 || p.UDP.DestinationPort != 2 || p.UDP.Length != 100 || len(p.Payload) != 8 {
+			t.Errorf("%s: ports %d > %d, length %d, %d-byte payload",
+				test.name, p.UDP.SourcePort, p.UDP.DestinationPort, p.UDP.Length, len(p.Payload))
+		}
+	}
+
+	unfragmented := mustSerialize(t, testIPv6("fd00::1", "fd00::2"), &UDPHeader{})
+	if err := d.Decode(unfragmented, &p); err != nil || p.Fragment || !p.Layers.Has(LayerUDP) {
+		t.Errorf("unfragmented: fragment %v, layers %b, %v", p.Fragment, p.Layers, err)
+	}
+	// the same header is still truncated in a whole datagram
+	ip := testIPv4("10.0.0.1", "10.0.0.2")
+	ip.Protocol = UDP
+	truncated := mustSerialize(t, ip, Payload(data))
+	if err := d.Decode(truncated, &p); !errors.Is(err, ErrTruncated) {
+		t.Errorf("truncated: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package pktutil
+
+import (
+	"errors"
+)
+
+var (
+	// Returned when a frame or packet is shorter than its headers require.
+	ErrTruncated = errors.New("truncated")
+
+	// Returned when a header field holds an invalid value.
+	ErrMalformed = errors.New("malformed")
+
+	// Returned when a packet uses a protocol or feature that is not handled.
+	ErrUnsupported = errors.New("unsupported")
+
+	// Returned when removing or changing a VLAN tag of an untagged frame.
+	ErrNotTagged = errors.New("not tagged")
+)
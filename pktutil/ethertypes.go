@@ -14,6 +14,7 @@ var (
 	AARP                = Ethertype{0x80, 0xF3}
 	IPX1                = Ethertype{0x81, 0x37}
 	IPX2                = Ethertype{0x81, 0x38}
+	IEEE802_1Q          = Ethertype{0x81, 0x00}
 	QNXQnet             = Ethertype{0x82, 0x04}
 	IPv6                = Ethertype{0x86, 0xDD}
 	EthernetFlowControl = Ethertype{0x88, 0x08}
@@ -29,6 +30,7 @@ var (
 	PROFINET            = Ethertype{0x88, 0x92}
 	HyperSCSI           = Ethertype{0x88, 0x9A}
 	AoE                 = Ethertype{0x88, 0xA2}
+	IEEE802_1ad         = Ethertype{0x88, 0xA8}
 	EtherCAT            = Ethertype{0x88, 0xA4}
 	EthernetPowerlink   = Ethertype{0x88, 0xAB}
 	LLDP                = Ethertype{0x88, 0xCC}
@@ -0,0 +1,263 @@
+package pktutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// FlowKey identifies the flow a packet belongs to by IP version, VLAN,
+// protocol, addresses and ports. It is comparable, so it can be used as a
+// map key.
+//
+// For ICMP and ICMPv6 echo messages both ports hold the echo identifier,
+// so that requests and replies share a flow. Other protocols, and
+// fragments after the first, have zero ports.
+type FlowKey struct {
+	// IP version, 4 or 6.
+	Version byte
+	// Outermost VLAN identifier, or 0 for untagged frames and packets.
+	VLAN     uint16
+	Protocol IPProtocol
+	// Addresses in 16-byte form; IPv4 addresses are IPv4-mapped.
+	Source          [16]byte
+	Destination     [16]byte
+	SourcePort      uint16
+	DestinationPort uint16
+}
+
+// Returns the key of the Ethernet frame macFrame.
+func FlowKeyFromFrame(macFrame []byte) (FlowKey, error) {
+	var p DecodedPacket
+	d := Decoder{LinkType: LinkTypeEthernet}
+	if err := d.Decode(macFrame, &p); err != nil {
+		return FlowKey{}, err
+	}
+	return p.FlowKey()
+}
+
+// Returns the key of the IPv4 or IPv6 packet.
+func FlowKeyFromPacket(packet []byte) (FlowKey, error) {
+	var p DecodedPacket
+	d := Decoder{LinkType: LinkTypeRaw}
+	if err := d.Decode(packet, &p); err != nil {
+		return FlowKey{}, err
+	}
+	return p.FlowKey()
+}
+
+// Returns the key of a decoded IPv4 or IPv6 packet, or an error wrapping
+// ErrUnsupported for other protocols.
+func (p *DecodedPacket) FlowKey() (FlowKey, error) {
+	var k FlowKey
+	switch {
+	case p.Layers.Has(LayerIPv4):
+		k.Version = 4
+		copy(k.Source[:], p.IPv4.Source.To16())
+		copy(k.Destination[:], p.IPv4.Destination.To16())
+	case p.Layers.Has(LayerIPv6):
+		k.Version = 6
+		copy(k.Source[:], p.IPv6.Source)
+		copy(k.Destination[:], p.IPv6.Destination)
+	default:
+		return FlowKey{}, fmt.Errorf("flow: %w: ethertype %v", ErrUnsupported, p.Ethertype)
+	}
+	if p.Layers.Has(LayerVLAN) {
+		k.VLAN = p.VLAN.VID
+	}
+	k.Protocol = p.Protocol
+	switch {
+	case p.Layers.Has(LayerTCP):
+		k.SourcePort = p.TCP.SourcePort
+		k.DestinationPort = p.TCP.DestinationPort
+	case p.Layers.Has(LayerUDP):
+		k.SourcePort = p.UDP.SourcePort
+		k.DestinationPort = p.UDP.DestinationPort
+	case p.Layers.Has(LayerICMP) || p.Layers.Has(LayerICMPv6):
+		if isICMPEcho(p.ICMP.Type, k.Version) && len(p.ICMP.Body) >= 2 {
+			k.SourcePort = binary.BigEndian.Uint16(p.ICMP.Body)
+			k.DestinationPort = k.SourcePort
+		}
+	}
+	return k, nil
+}
+
+// Returns the key of the packet quoted by a decoded ICMP or ICMPv6 error
+// message, as seen by that packet's sender. The quoted packet may be
+// truncated as long as its IP header and the start of its transport
+// header are present.
+func (p *DecodedPacket) QuotedFlowKey() (FlowKey, error) {
+	var k FlowKey
+	switch {
+	case p.Layers.Has(LayerICMP) && IsICMPv4Error(p.ICMP.Type):
+		k.Version = 4
+	case p.Layers.Has(LayerICMPv6) && IsICMPv6Error(p.ICMP.Type):
+		k.Version = 6
+	default:
+		return FlowKey{}, fmt.Errorf("flow: %w: not an ICMP error message", ErrUnsupported)
+	}
+	if p.Layers.Has(LayerVLAN) {
+		k.VLAN = p.VLAN.VID
+	}
+	if len(p.ICMP.Body) < 4 {
+		return FlowKey{}, fmt.Errorf("flow: %w: ICMP error of %d bytes", ErrTruncated, len(p.ICMP.Body)+4)
+	}
+	quoted := p.ICMP.Body[4:]
+
+	var transport []byte
+	if k.Version == 4 {
+		if len(quoted) < 20 || quoted[0]>>4 != 4 || len(quoted) < int(quoted[0]&0x0F)*4 {
+			return FlowKey{}, fmt.Errorf("flow: %w: quoted IPv4 header", ErrTruncated)
+		}
+		copy(k.Source[:], net.IP(quoted[12:16]).To16())
+		copy(k.Destination[:], net.IP(quoted[16:20]).To16())
+		k.Protocol = IPProtocol(quoted[9])
+		if binary.BigEndian.Uint16(quoted[6:])&0x1FFF != 0 {
+			return k, nil
+		}
+		transport = quoted[int(quoted[0]&0x0F)*4:]
+	} else {
+		if len(quoted) < 40 || quoted[0]>>4 != 6 {
+			return FlowKey{}, fmt.Errorf("flow: %w: quoted IPv6 header", ErrTruncated)
+		}
+		copy(k.Source[:], quoted[8:24])
+		copy(k.Destination[:], quoted[24:40])
+		next := IPProtocol(quoted[6])
+		offset := 40
+		for isIPv6Extension(next) {
+			rest := quoted[offset:]
+			if len(rest) < 8 {
+				return FlowKey{}, fmt.Errorf("flow: %w: quoted IPv6 extension header", ErrTruncated)
+			}
+			length := (int(rest[1]) + 1) * 8
+			switch next {
+			case IPv6_Frag:
+				if binary.BigEndian.Uint16(rest[2:])&0xFFF8 != 0 {
+					k.Protocol = IPProtocol(rest[0])
+					return k, nil
+				}
+				length = 8
+			case AH:
+				length = (int(rest[1]) + 2) * 4
+			}
+			next = IPProtocol(rest[0])
+			offset += length
+			if offset > len(quoted) {
+				return FlowKey{}, fmt.Errorf("flow: %w: quoted IPv6 extension header", ErrTruncated)
+			}
+		}
+		k.Protocol = next
+		transport = quoted[offset:]
+	}
+
+	switch k.Protocol {
+	case TCP, UDP:
+		if len(transport) < 4 {
+			return FlowKey{}, fmt.Errorf("flow: %w: quoted transport header", ErrTruncated)
+		}
+		k.SourcePort = binary.BigEndian.Uint16(transport[0:])
+		k.DestinationPort = binary.BigEndian.Uint16(transport[2:])
+	case ICMP, IPv6_ICMP:
+		if len(transport) >= 6 && isICMPEcho(transport[0], k.Version) {
+			k.SourcePort = binary.BigEndian.Uint16(transport[4:])
+			k.DestinationPort = k.SourcePort
+		}
+	}
+	return k, nil
+}
+
+func isICMPEcho(icmpType, version byte) bool {
+	if version == 4 {
+		return icmpType == ICMPv4EchoRequest || icmpType == ICMPv4EchoReply
+	}
+	return icmpType == ICMPv6EchoRequest || icmpType == ICMPv6EchoReply
+}
+
+func (k FlowKey) SourceIP() net.IP {
+	return flowIP(k.Source, k.Version)
+}
+
+func (k FlowKey) DestinationIP() net.IP {
+	return flowIP(k.Destination, k.Version)
+}
+
+func flowIP(addr [16]byte, version byte) net.IP {
+	ip := net.IP(append([]byte(nil), addr[:]...))
+	if version == 4 {
+		return ip.To4()
+	}
+	return ip
+}
+
+// Returns the key of the opposite direction of the flow.
+func (k FlowKey) Reverse() FlowKey {
+	k.Source, k.Destination = k.Destination, k.Source
+	k.SourcePort, k.DestinationPort = k.DestinationPort, k.SourcePort
+	return k
+}
+
+// Returns the same key for both directions of a flow: k or its reverse,
+// whichever has the lower source address and port.
+func (k FlowKey) Canonical() FlowKey {
+	c := bytes.Compare(k.Source[:], k.Destination[:])
+	if c > 0 || c == 0 && k.SourcePort > k.DestinationPort {
+		return k.Reverse()
+	}
+	return k
+}
+
+// Returns a 64-bit FNV-1a hash of k. The two directions of a flow hash
+// differently.
+func (k FlowKey) Hash() uint64 {
+	const prime = 1099511628211
+	h := uint64(14695981039346656037)
+	mix := func(b byte) {
+		h ^= uint64(b)
+		h *= prime
+	}
+	mix(k.Version)
+	mix(byte(k.VLAN >> 8))
+	mix(byte(k.VLAN))
+	mix(byte(k.Protocol))
+	for _, b := range k.Source {
+		mix(b)
+	}
+	for _, b := range k.Destination {
+		mix(b)
+	}
+	mix(byte(k.SourcePort >> 8))
+	mix(byte(k.SourcePort))
+	mix(byte(k.DestinationPort >> 8))
+	mix(byte(k.DestinationPort))
+	return h
+}
+
+// Returns a hash of k that is the same for both directions of a flow, for
+// sharding flows so that each direction lands on the same shard.
+func (k FlowKey) SymmetricHash() uint64 {
+	return k.Canonical().Hash()
+}
+
+// Returns the key as e.g. "tcp 10.0.0.1:1234 > 10.0.0.2:80 vlan 5".
+func (k FlowKey) String() string {
+	proto := strconv.Itoa(int(k.Protocol))
+	switch k.Protocol {
+	case TCP:
+		proto = "tcp"
+	case UDP:
+		proto = "udp"
+	case ICMP:
+		proto = "icmp"
+	case IPv6_ICMP:
+		proto = "icmpv6"
+	}
+	s := proto + " " +
+		net.JoinHostPort(k.SourceIP().String(), strconv.Itoa(int(k.SourcePort))) + " > " +
+		net.JoinHostPort(k.DestinationIP().String(), strconv.Itoa(int(k.DestinationPort)))
+	if k.VLAN != 0 {
+		s += " vlan " + strconv.Itoa(int(k.VLAN))
+	}
+	return s
+}
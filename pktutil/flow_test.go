@@ -0,0 +1,162 @@
+package pktutil
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestFlowKey(t *testing.T) {
+	tcp4 := mustSerialize(t, testIPv4("10.0.0.1", "10.0.0.2"), &TCPHeader{SourcePort: 1000, DestinationPort: 80, Flags: TCPFlagSYN})
+	udp6 := mustSerialize(t, testIPv6("fd00::1", "fd00::2"), &UDPHeader{SourcePort: 53, DestinationPort: 5353})
+	echo4 := mustSerialize(t, testIPv4("10.0.0.1", "10.0.0.2"), &ICMPHeader{Type: ICMPv4EchoRequest, Body: []byte{0x12, 0x34, 0, 1}})
+	echo6 := mustSerialize(t, testIPv6("fd00::1", "fd00::2"), &ICMPHeader{Type: ICMPv6EchoReply, Body: []byte{0x12, 0x34, 0, 1}})
+	unreachable := mustSerialize(t, testIPv4("10.0.0.1", "10.0.0.2"), &ICMPHeader{Type: ICMPv4DestinationUnreachable, Body: make([]byte, 4)})
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string
+	}{
+		{"tcp", tcp4, "tcp 10.0.0.1:1000 > 10.0.0.2:80"},
+		{"udp", udp6, "udp [fd00::1]:53 > [fd00::2]:5353"},
+		{"icmp echo", echo4, "icmp 10.0.0.1:4660 > 10.0.0.2:4660"},
+		{"icmpv6 echo", echo6, "icmpv6 [fd00::1]:4660 > [fd00::2]:4660"},
+		{"icmp error", unreachable, "icmp 10.0.0.1:0 > 10.0.0.2:0"},
+	}
+	for _, test := range tests {
+		k, err := FlowKeyFromPacket(test.packet)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if k.String() != test.want {
+			t.Errorf("%s: key %s, want %s", test.name, k, test.want)
+		}
+	}
+
+	frame := mustSerialize(t, &EthernetFrame{Source: testMAC1, Destination: testMAC2}, &VLANTag{VID: 7},
+		testIPv4("10.0.0.1", "10.0.0.2"), &UDPHeader{SourcePort: 1, DestinationPort: 2})
+	k, err := FlowKeyFromFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "udp 10.0.0.1:1 > 10.0.0.2:2 vlan 7"; k.String() != want {
+		t.Errorf("vlan key %s, want %s", k, want)
+	}
+	if !k.SourceIP().Equal(net.ParseIP("10.0.0.1")) || !k.DestinationIP().Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("addresses %s and %s", k.SourceIP(), k.DestinationIP())
+	}
+
+	arp := mustSerialize(t, &EthernetFrame{Source: testMAC1, Destination: testMAC2, Ethertype: ARP}, Payload(NewGratuitousARP(testMAC1, net.ParseIP("10.0.0.1"))))
+	if _, err := FlowKeyFromFrame(arp); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("arp: %v", err)
+	}
+}
+
+func TestFlowKeyDirections(t *testing.T) {
+	k, err := FlowKeyFromPacket(mustSerialize(t, testIPv4("10.0.0.2", "10.0.0.1"), &TCPHeader{SourcePort: 80, DestinationPort: 1000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := k.Reverse()
+	if want := "tcp 10.0.0.1:1000 > 10.0.0.2:80"; r.String() != want {
+		t.Errorf("reverse %s, want %s", r, want)
+	}
+	if r.Reverse() != k {
+		t.Errorf("reversing twice gave %s", r.Reverse())
+	}
+	if k.Canonical() != r || r.Canonical() != r {
+		t.Errorf("canonical keys %s and %s", k.Canonical(), r.Canonical())
+	}
+	if k.Hash() == r.Hash() {
+		t.Errorf("both directions hash to %x", k.Hash())
+	}
+	if k.SymmetricHash() != r.SymmetricHash() {
+		t.Errorf("symmetric hashes %x and %x", k.SymmetricHash(), r.SymmetricHash())
+	}
+
+	// keys differing in any field hash differently
+	other := k
+	other.VLAN = 1
+	if other.Hash() == k.Hash() || other.SymmetricHash() == k.SymmetricHash() {
+		t.Errorf("vlan ignored by hash")
+	}
+	other = k
+	other.SourcePort++
+	if other.Hash() == k.Hash() || other.SymmetricHash() == k.SymmetricHash() {
+		t.Errorf("port ignored by hash")
+	}
+}
+
+func TestQuotedFlowKey(t *testing.T) {
+	src := net.ParseIP("10.0.0.254")
+	tcp4 := mustSerialize(t, testIPv4("10.0.0.1", "10.0.0.2"), &TCPHeader{SourcePort: 1000, DestinationPort: 80, Flags: TCPFlagSYN})
+	udp6 := mustSerialize(t, testIPv6("fd00::1", "fd00::2"), &UDPHeader{SourcePort: 53, DestinationPort: 5353}, Payload(make([]byte, 2000)))
+	echo4 := mustSerialize(t, testIPv4("10.0.0.1", "10.0.0.2"), &ICMPHeader{Type: ICMPv4EchoRequest, Body: []byte{0x12, 0x34, 0, 1}})
+	fragment := testIPv4Fragment(t, 1, 8, false, make([]byte, 8), nil)
+
+	unreachable, err := ICMPDestinationUnreachable(src, 3, tcp4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooBig, err := ICMPPacketTooBig(net.ParseIP("fd00::fe"), 1280, udp6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exceeded, err := ICMPTimeExceeded(src, 0, echo4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragmentError, err := ICMPTimeExceeded(src, 1, fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		error []byte
+		want  string
+	}{
+		{"tcp", unreachable, "tcp 10.0.0.1:1000 > 10.0.0.2:80"},
+		{"udp truncated", tooBig, "udp [fd00::1]:53 > [fd00::2]:5353"},
+		{"icmp echo", exceeded, "icmp 10.0.0.1:4660 > 10.0.0.2:4660"},
+		{"fragment", fragmentError, "udp 10.0.0.1:0 > 10.0.0.2:0"},
+	}
+	for _, test := range tests {
+		var p DecodedPacket
+		d := Decoder{LinkType: LinkTypeRaw}
+		if err := d.Decode(test.error, &p); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		k, err := p.QuotedFlowKey()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if k.String() != test.want {
+			t.Errorf("%s: quoted key %s, want %s", test.name, k, test.want)
+		}
+	}
+
+	// the quoted key of an error is the key of the packet that caused it
+	var p DecodedPacket
+	d := Decoder{LinkType: LinkTypeRaw}
+	if err := d.Decode(unreachable, &p); err != nil {
+		t.Fatal(err)
+	}
+	quoted, _ := p.QuotedFlowKey()
+	if k, _ := FlowKeyFromPacket(tcp4); k != quoted {
+		t.Errorf("quoted key %s, packet key %s", quoted, k)
+	}
+
+	if err := d.Decode(echo4, &p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.QuotedFlowKey(); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("echo request: %v", err)
+	}
+	truncated := mustSerialize(t, testIPv4("10.0.0.254", "10.0.0.1"), &ICMPHeader{Type: ICMPv4DestinationUnreachable, Body: append(make([]byte, 4), tcp4[:10]...)})
+	if err := d.Decode(truncated, &p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.QuotedFlowKey(); !errors.Is(err, ErrTruncated) {
+		t.Errorf("truncated error: %v", err)
+	}
+}
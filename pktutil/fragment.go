@@ -0,0 +1,196 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+)
+
+// Smallest MTUs every IPv4 and IPv6 link must support.
+const (
+	MinIPv4MTU = 68
+	MinIPv6MTU = 1280
+)
+
+// FragmentationNeededError is returned by Fragmenter for a packet that
+// exceeds the MTU but must not be fragmented.
+type FragmentationNeededError struct {
+	MTU int
+	// ICMP fragmentation needed or packet too big message to send back to
+	// the packet's source; nil if the Fragmenter has no Source.
+	Reply []byte
+}
+
+func (e *FragmentationNeededError) Error() string {
+	return fmt.Sprintf("fragmentation needed for mtu %d", e.MTU)
+}
+
+// Fragmenter splits IPv4 and IPv6 packets to fit an MTU.
+type Fragmenter struct {
+	// Largest packet to produce.
+	MTU int
+	// Address FragmentationNeededError replies are sent from.
+	Source net.IP
+	// Treat IPv6 packets as a router must, rejecting those that exceed the
+	// MTU instead of fragmenting them as their source would.
+	ForwardIPv6 bool
+
+	id uint32
+}
+
+// Creates a Fragmenter for mtu, sending errors from source.
+func NewFragmenter(mtu int, source net.IP) *Fragmenter {
+	return &Fragmenter{
+		MTU:    mtu,
+		Source: source,
+		id:     rand.Uint32(),
+	}
+}
+
+// Returns packet split into fragments of at most f.MTU bytes, or packet
+// itself if it fits. IPv4 packets with the don't fragment flag set, and
+// IPv6 packets if f.ForwardIPv6 is set, yield a FragmentationNeededError.
+func (f *Fragmenter) Fragment(packet []byte) ([][]byte, error) {
+	if len(packet) > 0 && IsIPv4(packet) {
+		return f.fragmentIPv4(packet)
+	}
+	return f.fragmentIPv6(packet)
+}
+
+func (f *Fragmenter) fragmentIPv4(packet []byte) ([][]byte, error) {
+	var h IPv4Header
+	if err := h.Decode(packet); err != nil {
+		return nil, err
+	}
+	packet = packet[:h.TotalLength]
+	if len(packet) <= f.MTU {
+		return [][]byte{packet}, nil
+	}
+	if h.Flags&IPv4FlagDF != 0 {
+		return nil, f.needed(packet)
+	}
+	headerLen := int(h.IHL) * 4
+	// later fragments only carry the options flagged to be copied
+	laterHeader := make([]byte, 20, headerLen)
+	copy(laterHeader, packet[:20])
+	it := NewIPv4OptionIterator(h.Options)
+	for it.Next() {
+		if o := it.Option(); o.Type.Copied() {
+			laterHeader = append(laterHeader, byte(o.Type), byte(len(o.Data)+2))
+			laterHeader = append(laterHeader, o.Data...)
+		}
+	}
+	for len(laterHeader)%4 != 0 {
+		laterHeader = append(laterHeader, 0)
+	}
+	if f.MTU-len(laterHeader) < 8 || f.MTU-headerLen < 8 || f.MTU < MinIPv4MTU {
+		return nil, fmt.Errorf("fragment: %w: mtu %d too small", ErrMalformed, f.MTU)
+	}
+
+	var fragments [][]byte
+	data := h.Payload
+	offset := 0
+	for len(data) > 0 {
+		header := laterHeader
+		if offset == 0 {
+			header = packet[:headerLen]
+		}
+		n := len(data)
+		if room := (f.MTU - len(header)) &^ 7; n > room {
+			n = room
+		}
+		frag := make([]byte, len(header)+n)
+		copy(frag, header)
+		copy(frag[len(header):], data[:n])
+		frag[0] = 0x40 | byte(len(header)/4)
+		binary.BigEndian.PutUint16(frag[2:], uint16(len(frag)))
+		// keep the original offset and MF flag if packet is a fragment itself
+		flags := uint16(h.Flags) << 13
+		if n < len(data) {
+			flags |= IPv4FlagMF << 13
+		}
+		binary.BigEndian.PutUint16(frag[6:], flags|(h.FragmentOffset+uint16(offset/8)))
+		SetIPv4Checksum(frag)
+		fragments = append(fragments, frag)
+		data = data[n:]
+		offset += n
+	}
+	return fragments, nil
+}
+
+func (f *Fragmenter) fragmentIPv6(packet []byte) ([][]byte, error) {
+	var h IPv6Header
+	if err := h.Decode(packet); err != nil {
+		return nil, err
+	}
+	packet = packet[:40+int(h.PayloadLength)]
+	if len(packet) <= f.MTU {
+		return [][]byte{packet}, nil
+	}
+	if f.ForwardIPv6 {
+		return nil, f.needed(packet)
+	}
+
+	// the unfragmentable part ends after the hop-by-hop options and any
+	// routing header, with the destination options that precede it
+	unfragLen := 40
+	nextPos := 6
+	nextHeader := h.NextHeader
+	w := NewIPv6ExtensionWalker(packet)
+	for w.Next() {
+		hdr := w.Header()
+		if hdr.Protocol == IPv6_Frag {
+			return nil, fmt.Errorf("fragment: %w: packet is already a fragment", ErrUnsupported)
+		}
+		if hdr.Protocol == HOPOPT || hdr.Protocol == IPv6_Route || hdr.Protocol == IPv6_Opts && hdr.NextHeader == IPv6_Route {
+			unfragLen = hdr.Offset + len(hdr.Data)
+			nextPos = hdr.Offset
+			nextHeader = hdr.NextHeader
+		}
+	}
+	if err := w.Err(); err != nil {
+		return nil, err
+	}
+	room := (f.MTU - unfragLen - 8) &^ 7
+	if f.MTU < MinIPv6MTU || room < 8 {
+		return nil, fmt.Errorf("fragment: %w: mtu %d too small", ErrMalformed, f.MTU)
+	}
+
+	id := atomic.AddUint32(&f.id, 1)
+	var fragments [][]byte
+	data := packet[unfragLen:]
+	offset := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > room {
+			n = room
+		}
+		frag := make([]byte, unfragLen+8+n)
+		copy(frag, packet[:unfragLen])
+		frag[nextPos] = IPv6_Frag
+		binary.BigEndian.PutUint16(frag[4:], uint16(len(frag)-40))
+		fh := frag[unfragLen:]
+		fh[0] = byte(nextHeader)
+		more := uint16(0)
+		if n < len(data) {
+			more = 1
+		}
+		binary.BigEndian.PutUint16(fh[2:], uint16(offset)|more)
+		binary.BigEndian.PutUint32(fh[4:], id)
+		copy(frag[unfragLen+8:], data[:n])
+		fragments = append(fragments, frag)
+		data = data[n:]
+		offset += n
+	}
+	return fragments, nil
+}
+
+func (f *Fragmenter) needed(packet []byte) error {
+	e := &FragmentationNeededError{MTU: f.MTU}
+	if f.Source != nil {
+		e.Reply, _ = ICMPPacketTooBig(f.Source, f.MTU, packet)
+	}
+	return e
+}
@@ -1,6 +1,7 @@
 package pktutil
 
 import (
+	"fmt"
 	"net"
 )
 
@@ -14,6 +15,55 @@ const (
 	DoubleTagged Tagging = 8
 )
 
+// Returns the number of VLAN tags.
+func (t Tagging) Depth() int {
+	return int(t) / 4
+}
+
+// Maximum number of VLAN tags accepted by EthernetFrame.Decode.
+const MaxTagDepth = 8
+
+// EthernetFrame is a bounds-checked view of an Ethernet frame. The address
+// and payload slices refer to the decoded frame.
+type EthernetFrame struct {
+	Destination net.HardwareAddr
+	Source      net.HardwareAddr
+	Tagging     Tagging
+	Ethertype   Ethertype
+	Payload     []byte
+}
+
+// Decodes the headers of macFrame into f.
+func (f *EthernetFrame) Decode(macFrame []byte) error {
+	if len(macFrame) < 14 {
+		return fmt.Errorf("ethernet: %w: frame of %d bytes", ErrTruncated, len(macFrame))
+	}
+	pos := 12
+	depth := 0
+	for isTPID(macFrame[pos], macFrame[pos+1]) {
+		depth++
+		if depth > MaxTagDepth {
+			return fmt.Errorf("ethernet: %w: more than %d VLAN tags", ErrMalformed, MaxTagDepth)
+		}
+		pos += 4
+		if len(macFrame) < pos+2 {
+			return fmt.Errorf("ethernet: %w: frame of %d bytes with %d VLAN tags", ErrTruncated, len(macFrame), depth)
+		}
+	}
+	f.Destination = net.HardwareAddr(macFrame[:6])
+	f.Source = net.HardwareAddr(macFrame[6:12])
+	f.Tagging = Tagging(pos - 12)
+	f.Ethertype = Ethertype{macFrame[pos], macFrame[pos+1]}
+	f.Payload = macFrame[pos+2:]
+	return nil
+}
+
+// Reports whether b1, b2 is a VLAN tag protocol identifier: 802.1q, 802.1ad,
+// or one of the older non-standard Q-in-Q values.
+func isTPID(b1, b2 byte) bool {
+	return b2 == 0x00 && (b1 == 0x81 || b1 == 0x91 || b1 == 0x92) || b1 == 0x88 && b2 == 0xA8
+}
+
 func MACDestination(macFrame []byte) net.HardwareAddr {
 	return net.HardwareAddr(macFrame[:6])
 }
@@ -22,28 +72,13 @@ func MACSource(macFrame []byte) net.HardwareAddr {
 	return net.HardwareAddr(macFrame[6:12])
 }
 
+// Returns the tagging of macFrame, counting every stacked VLAN tag.
 func MACTagging(macFrame []byte) Tagging {
-	b1, b2 := macFrame[12], macFrame[13]
-	// check for TPID in ethertype position
-	if b1 == 0x81 && b2 == 0x00 {
-		b3, b4 := macFrame[16], macFrame[17]
-		if b3 == 0x81 && b4 == 0x00 {
-			// literal Q-in-Q tagging
-			return DoubleTagged
-		}
-		// normal 802.1q tagging
-		return Tagged
-	}
-	// older Q-in-Q (non-standard) ethertype values
-	if (b1 == 0x91 || b1 == 0x92) && b2 == 0x00 {
-		return DoubleTagged
+	pos := 12
+	for len(macFrame) >= pos+6 && isTPID(macFrame[pos], macFrame[pos+1]) {
+		pos += 4
 	}
-	// newer 802.1ad ethertype value
-	if b1 == 0x88 && b2 == 0xA8 {
-		return DoubleTagged
-	}
-	// no 802.1q tagging
-	return NotTagged
+	return Tagging(pos - 12)
 }
 
 func MACEthertype(macFrame []byte) Ethertype {
@@ -66,3 +101,11 @@ func IsMACMulticastIPv4(addr net.HardwareAddr) bool {
 func IsMACMulticastIPv6(addr net.HardwareAddr) bool {
 	return addr[0] == 0x33 && addr[1] == 0x33
 }
+
+func SetMACDestination(macFrame []byte, addr net.HardwareAddr) {
+	copy(macFrame[0:6], addr)
+}
+
+func SetMACSource(macFrame []byte, addr net.HardwareAddr) {
+	copy(macFrame[6:12], addr)
+}
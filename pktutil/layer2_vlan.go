@@ -0,0 +1,115 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// VLANTag is an 802.1Q or 802.1ad VLAN tag.
+type VLANTag struct {
+	// Tag protocol identifier; if unset, IEEE802_1Q, or IEEE802_1ad when
+	// PushVLAN adds the tag to an already tagged frame.
+	TPID Ethertype
+	// Priority code point.
+	PCP byte
+	// Drop eligible indicator.
+	DEI bool
+	// VLAN identifier.
+	VID uint16
+	// Ethertype of what follows the tag.
+	Ethertype Ethertype
+}
+
+// Returns the tag control information: PCP, DEI and VID.
+func (t *VLANTag) TCI() uint16 {
+	tci := uint16(t.PCP&0x07)<<13 | t.VID&0x0FFF
+	if t.DEI {
+		tci |= 1 << 12
+	}
+	return tci
+}
+
+func (t *VLANTag) tpid() Ethertype {
+	if t.TPID == (Ethertype{}) {
+		return IEEE802_1Q
+	}
+	return t.TPID
+}
+
+// Returns tag i of macFrame, counting from the outermost tag, and whether
+// the frame has that many tags.
+func MACVLANTag(macFrame []byte, i int) (VLANTag, bool) {
+	if i < 0 || i >= MACTagging(macFrame).Depth() {
+		return VLANTag{}, false
+	}
+	return parseVLANTag(macFrame[12+4*i:]), true
+}
+
+// Returns the outermost tag of macFrame, e.g. the service tag of a Q-in-Q
+// frame, and whether the frame is tagged.
+func MACOuterVLAN(macFrame []byte) (VLANTag, bool) {
+	return MACVLANTag(macFrame, 0)
+}
+
+// Returns the innermost tag of macFrame, e.g. the customer tag of a Q-in-Q
+// frame, and whether the frame is tagged.
+func MACInnerVLAN(macFrame []byte) (VLANTag, bool) {
+	return MACVLANTag(macFrame, MACTagging(macFrame).Depth()-1)
+}
+
+// Returns a copy of macFrame with tag added as its outermost tag. A tag
+// without a TPID pushed onto a tagged frame becomes an 802.1ad service tag.
+func PushVLAN(macFrame []byte, tag VLANTag) ([]byte, error) {
+	if len(macFrame) < 14 {
+		return nil, fmt.Errorf("vlan: %w: frame of %d bytes", ErrTruncated, len(macFrame))
+	}
+	result := make([]byte, len(macFrame)+4)
+	copy(result, macFrame[:12])
+	tpid := tag.tpid()
+	if tag.TPID == (Ethertype{}) && MACTagging(macFrame) != NotTagged {
+		tpid = IEEE802_1ad
+	}
+	copy(result[12:14], tpid[:])
+	binary.BigEndian.PutUint16(result[14:], tag.TCI())
+	copy(result[16:], macFrame[12:])
+	return result, nil
+}
+
+// Returns a copy of macFrame without its outermost tag, along with that
+// tag.
+func PopVLAN(macFrame []byte) ([]byte, VLANTag, error) {
+	tag, ok := MACOuterVLAN(macFrame)
+	if !ok {
+		return nil, VLANTag{}, fmt.Errorf("vlan: %w", ErrNotTagged)
+	}
+	result := make([]byte, len(macFrame)-4)
+	copy(result, macFrame[:12])
+	copy(result[12:], macFrame[16:])
+	return result, tag, nil
+}
+
+// Returns a copy of macFrame with the VLAN identifier of its outermost tag
+// set to vid.
+func RewriteVID(macFrame []byte, vid uint16) ([]byte, error) {
+	tag, ok := MACOuterVLAN(macFrame)
+	if !ok {
+		return nil, fmt.Errorf("vlan: %w", ErrNotTagged)
+	}
+	tag.VID = vid
+	result := make([]byte, len(macFrame))
+	copy(result, macFrame)
+	binary.BigEndian.PutUint16(result[14:], tag.TCI())
+	return result, nil
+}
+
+// Parses the tag at the start of b: TPID, TCI and the following ethertype.
+func parseVLANTag(b []byte) VLANTag {
+	tci := binary.BigEndian.Uint16(b[2:])
+	return VLANTag{
+		TPID:      Ethertype{b[0], b[1]},
+		PCP:       byte(tci >> 13),
+		DEI:       tci&(1<<12) != 0,
+		VID:       tci & 0x0FFF,
+		Ethertype: Ethertype{b[4], b[5]},
+	}
+}
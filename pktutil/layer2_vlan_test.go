@@ -0,0 +1,65 @@
+package pktutil
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPushPopVLAN(t *testing.T) {
+	frame := mustSerialize(t, &EthernetFrame{Destination: testMAC1, Source: testMAC2},
+		testIPv4("10.0.0.1", "10.0.0.2"), &UDPHeader{})
+
+	tagged, err := PushVLAN(frame, VLANTag{VID: 5, PCP: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, ok := MACOuterVLAN(tagged); !ok || tag.TPID != IEEE802_1Q || tag.VID != 5 || tag.PCP != 3 || tag.Ethertype != IPv4 {
+		t.Errorf("customer tag %+v", tag)
+	}
+
+	stacked, err := PushVLAN(tagged, VLANTag{VID: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := MACTagging(stacked).Depth(); depth != 2 {
+		t.Errorf("depth %d", depth)
+	}
+	if tag, _ := MACOuterVLAN(stacked); tag.TPID != IEEE802_1ad || tag.VID != 100 || tag.Ethertype != IEEE802_1Q {
+		t.Errorf("service tag %+v", tag)
+	}
+	if tag, _ := MACInnerVLAN(stacked); tag.VID != 5 {
+		t.Errorf("inner tag %+v", tag)
+	}
+
+	// an explicit TPID is kept
+	explicit, err := PushVLAN(tagged, VLANTag{TPID: IEEE802_1Q, VID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, _ := MACOuterVLAN(explicit); tag.TPID != IEEE802_1Q {
+		t.Errorf("explicit tag %+v", tag)
+	}
+
+	rewritten, err := RewriteVID(stacked, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	popped, tag, err := PopVLAN(rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.VID != 200 || !bytes.Equal(popped, tagged) {
+		t.Errorf("popped tag %+v, frame %x", tag, popped)
+	}
+	popped, _, err = PopVLAN(popped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(popped, frame) {
+		t.Errorf("untagged frame %x, want %x", popped, frame)
+	}
+	if _, _, err := PopVLAN(popped); !errors.Is(err, ErrNotTagged) {
+		t.Errorf("pop of untagged frame: %v", err)
+	}
+}
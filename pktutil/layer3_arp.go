@@ -0,0 +1,121 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ARP operations.
+const (
+	ARPOpRequest = 1
+	ARPOpReply   = 2
+)
+
+// ARP hardware type of Ethernet.
+const ARPHardwareEthernet = 1
+
+// ARPHeader is a bounds-checked view of an ARP packet. The address slices
+// refer to the decoded packet.
+type ARPHeader struct {
+	HardwareType       uint16
+	ProtocolType       Ethertype
+	HardwareLength     byte
+	ProtocolLength     byte
+	Operation          uint16
+	SenderHardwareAddr net.HardwareAddr
+	SenderProtocolAddr net.IP
+	TargetHardwareAddr net.HardwareAddr
+	TargetProtocolAddr net.IP
+}
+
+// Decodes packet into h.
+func (h *ARPHeader) Decode(packet []byte) error {
+	if len(packet) < 8 {
+		return fmt.Errorf("arp: %w: packet of %d bytes", ErrTruncated, len(packet))
+	}
+	hlen, plen := int(packet[4]), int(packet[5])
+	if len(packet) < 8+2*(hlen+plen) {
+		return fmt.Errorf("arp: %w: packet of %d bytes with %d-byte addresses", ErrTruncated, len(packet), hlen+plen)
+	}
+	h.HardwareType = binary.BigEndian.Uint16(packet[0:])
+	h.ProtocolType = Ethertype{packet[2], packet[3]}
+	h.HardwareLength = packet[4]
+	h.ProtocolLength = packet[5]
+	h.Operation = binary.BigEndian.Uint16(packet[6:])
+	pos := 8
+	h.SenderHardwareAddr = net.HardwareAddr(packet[pos : pos+hlen])
+	pos += hlen
+	h.SenderProtocolAddr = net.IP(packet[pos : pos+plen])
+	pos += plen
+	h.TargetHardwareAddr = net.HardwareAddr(packet[pos : pos+hlen])
+	pos += hlen
+	h.TargetProtocolAddr = net.IP(packet[pos : pos+plen])
+	return nil
+}
+
+// Reports whether packet is an ARP packet for IPv4 over Ethernet, the only
+// kind the other ARP accessors handle.
+func IsARPEthernetIPv4(packet []byte) bool {
+	return len(packet) >= 28 && binary.BigEndian.Uint16(packet[0:]) == ARPHardwareEthernet &&
+		packet[2] == IPv4[0] && packet[3] == IPv4[1] && packet[4] == 6 && packet[5] == 4
+}
+
+func ARPOperation(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[6:])
+}
+
+func ARPSenderMAC(packet []byte) net.HardwareAddr {
+	return net.HardwareAddr(packet[8:14])
+}
+
+func ARPSenderIP(packet []byte) net.IP {
+	return net.IPv4(packet[14], packet[15], packet[16], packet[17])
+}
+
+func ARPTargetMAC(packet []byte) net.HardwareAddr {
+	return net.HardwareAddr(packet[18:24])
+}
+
+func ARPTargetIP(packet []byte) net.IP {
+	return net.IPv4(packet[24], packet[25], packet[26], packet[27])
+}
+
+// Reports whether packet is a gratuitous ARP: one announcing the sender's
+// own address, whose sender and target IP are the same.
+func IsGratuitousARP(packet []byte) bool {
+	if len(packet) < 28 {
+		return false
+	}
+	return net.IP(packet[14:18]).Equal(net.IP(packet[24:28]))
+}
+
+// Builds an ARP request from senderMAC and senderIP asking for targetIP.
+func NewARPRequest(senderMAC net.HardwareAddr, senderIP, targetIP net.IP) []byte {
+	return newARP(ARPOpRequest, senderMAC, senderIP, nil, targetIP)
+}
+
+// Builds an ARP reply telling targetMAC and targetIP that senderIP is at
+// senderMAC.
+func NewARPReply(senderMAC net.HardwareAddr, senderIP net.IP, targetMAC net.HardwareAddr, targetIP net.IP) []byte {
+	return newARP(ARPOpReply, senderMAC, senderIP, targetMAC, targetIP)
+}
+
+// Builds a gratuitous ARP request announcing that ip is at mac.
+func NewGratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	return newARP(ARPOpRequest, mac, ip, nil, ip)
+}
+
+func newARP(op uint16, senderMAC net.HardwareAddr, senderIP net.IP, targetMAC net.HardwareAddr, targetIP net.IP) []byte {
+	packet := make([]byte, 28)
+	binary.BigEndian.PutUint16(packet[0:], ARPHardwareEthernet)
+	copy(packet[2:4], IPv4[:])
+	packet[4] = 6
+	packet[5] = 4
+	binary.BigEndian.PutUint16(packet[6:], op)
+	copy(packet[8:14], senderMAC)
+	copy(packet[14:18], senderIP.To4())
+	copy(packet[18:24], targetMAC)
+	copy(packet[24:28], targetIP.To4())
+	return packet
+}
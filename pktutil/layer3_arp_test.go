@@ -0,0 +1,50 @@
+package pktutil
+
+import (
+	"net"
+	"testing"
+)
+
+func TestARP(t *testing.T) {
+	ip1 := net.ParseIP("10.0.0.1")
+	ip2 := net.ParseIP("10.0.0.2")
+	tests := []struct {
+		name       string
+		packet     []byte
+		op         uint16
+		target     net.IP
+		gratuitous bool
+	}{
+		{"request", NewARPRequest(testMAC1, ip1, ip2), ARPOpRequest, ip2, false},
+		{"reply", NewARPReply(testMAC2, ip2, testMAC1, ip1), ARPOpReply, ip1, false},
+		{"gratuitous", NewGratuitousARP(testMAC1, ip1), ARPOpRequest, ip1, true},
+	}
+	for _, test := range tests {
+		var h ARPHeader
+		if err := h.Decode(test.packet); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !IsARPEthernetIPv4(test.packet) || h.Operation != test.op || !h.TargetProtocolAddr.Equal(test.target) {
+			t.Errorf("%s: decoded %+v", test.name, h)
+		}
+		if ARPOperation(test.packet) != test.op || !ARPTargetIP(test.packet).Equal(test.target) {
+			t.Errorf("%s: accessors disagree", test.name)
+		}
+		if IsGratuitousARP(test.packet) != test.gratuitous {
+			t.Errorf("%s: gratuitous %v", test.name, !test.gratuitous)
+		}
+	}
+}
+
+func TestARPShort(t *testing.T) {
+	packet := NewGratuitousARP(testMAC1, net.ParseIP("10.0.0.1"))
+	for n := 0; n < 28; n++ {
+		if IsGratuitousARP(packet[:n]) {
+			t.Errorf("%d-byte packet reported gratuitous", n)
+		}
+		var h ARPHeader
+		if err := h.Decode(packet[:n]); err == nil {
+			t.Errorf("%d-byte packet decoded", n)
+		}
+	}
+}
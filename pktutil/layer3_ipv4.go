@@ -1,9 +1,93 @@
 package pktutil
 
 import (
+	"encoding/binary"
+	"fmt"
 	"net"
 )
 
+// IPv4 header flags.
+const (
+	IPv4FlagMF = 0x1 // more fragments
+	IPv4FlagDF = 0x2 // don't fragment
+)
+
+// IPv4Header is a bounds-checked view of an IPv4 packet. The address,
+// option and payload slices refer to the decoded packet.
+type IPv4Header struct {
+	Version        byte
+	IHL            byte
+	DSCP           byte
+	ECN            byte
+	TotalLength    uint16
+	Identification uint16
+	Flags          byte // IPv4FlagDF, IPv4FlagMF
+	FragmentOffset uint16
+	TTL            byte
+	Protocol       IPProtocol
+	Checksum       uint16
+	Source         net.IP
+	Destination    net.IP
+	Options        []byte
+	// Excludes any link-layer padding beyond TotalLength.
+	Payload []byte
+}
+
+// Decodes the header of packet into h.
+func (h *IPv4Header) Decode(packet []byte) error {
+	if len(packet) < 20 {
+		return fmt.Errorf("ipv4: %w: packet of %d bytes", ErrTruncated, len(packet))
+	}
+	version := packet[0] >> 4
+	if version != 4 {
+		return fmt.Errorf("ipv4: %w: version %d", ErrMalformed, version)
+	}
+	ihl := packet[0] & 0x0F
+	headerLen := int(ihl) * 4
+	if ihl < 5 {
+		return fmt.Errorf("ipv4: %w: header length %d", ErrMalformed, headerLen)
+	}
+	if len(packet) < headerLen {
+		return fmt.Errorf("ipv4: %w: header of %d bytes in packet of %d bytes", ErrTruncated, headerLen, len(packet))
+	}
+	totalLen := binary.BigEndian.Uint16(packet[2:])
+	if int(totalLen) < headerLen {
+		return fmt.Errorf("ipv4: %w: total length %d shorter than header", ErrMalformed, totalLen)
+	}
+	if len(packet) < int(totalLen) {
+		return fmt.Errorf("ipv4: %w: total length %d in packet of %d bytes", ErrTruncated, totalLen, len(packet))
+	}
+	h.Version = version
+	h.IHL = ihl
+	h.DSCP = packet[1] >> 2
+	h.ECN = packet[1] & 0x03
+	h.TotalLength = totalLen
+	h.Identification = binary.BigEndian.Uint16(packet[4:])
+	h.Flags = packet[6] >> 5
+	h.FragmentOffset = binary.BigEndian.Uint16(packet[6:]) & 0x1FFF
+	h.TTL = packet[8]
+	h.Protocol = IPProtocol(packet[9])
+	h.Checksum = binary.BigEndian.Uint16(packet[10:])
+	h.Source = net.IP(packet[12:16])
+	h.Destination = net.IP(packet[16:20])
+	h.Options = packet[20:headerLen]
+	h.Payload = packet[headerLen:totalLen]
+	return nil
+}
+
+func IPv4Version(packet []byte) byte {
+	return packet[0] >> 4
+}
+
+func IPv4IHL(packet []byte) byte {
+	return packet[0] & 0x0F
+}
+
+// Returns the header length in bytes.
+func IPv4HeaderLength(packet []byte) int {
+	return int(IPv4IHL(packet)) * 4
+}
+
 func IPv4DSCP(packet []byte) byte {
 	return packet[1] >> 2
 }
@@ -16,6 +100,28 @@ func IPv4Identification(packet []byte) [2]byte {
 	return [2]byte{packet[4], packet[5]}
 }
 
+func IPv4TotalLength(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[2:])
+}
+
+// Returns the 3-bit flags field; see IPv4FlagDF and IPv4FlagMF.
+func IPv4Flags(packet []byte) byte {
+	return packet[6] >> 5
+}
+
+func IPv4DontFragment(packet []byte) bool {
+	return IPv4Flags(packet)&IPv4FlagDF != 0
+}
+
+func IPv4MoreFragments(packet []byte) bool {
+	return IPv4Flags(packet)&IPv4FlagMF != 0
+}
+
+// Returns the fragment offset in units of 8 bytes.
+func IPv4FragmentOffset(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[6:]) & 0x1FFF
+}
+
 func IPv4TTL(packet []byte) byte {
 	return packet[8]
 }
@@ -24,6 +130,10 @@ func IPv4Protocol(packet []byte) IPProtocol {
 	return IPProtocol(packet[9])
 }
 
+func IPv4Checksum(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[10:])
+}
+
 func IPv4Source(packet []byte) net.IP {
 	return net.IPv4(packet[12], packet[13], packet[14], packet[15])
 }
@@ -32,7 +142,68 @@ func IPv4Destination(packet []byte) net.IP {
 	return net.IPv4(packet[16], packet[17], packet[18], packet[19])
 }
 
+func IPv4Options(packet []byte) []byte {
+	return packet[20:IPv4HeaderLength(packet)]
+}
+
+// Returns the bytes following the header, up to the total length when the
+// packet holds that many, so any link-layer padding is left out.
 func IPv4Payload(packet []byte) []byte {
-	ihl := packet[0] & 0x0F
-	return packet[ihl*4:]
+	start := IPv4HeaderLength(packet)
+	end := int(IPv4TotalLength(packet))
+	if end > len(packet) {
+		end = len(packet)
+	}
+	if end < start {
+		end = start
+	}
+	return packet[start:end]
+}
+
+// Sets the DSCP, updating the header checksum.
+func SetIPv4DSCP(packet []byte, dscp byte) {
+	setIPv4Byte(packet, 1, dscp<<2|packet[1]&0x03)
+}
+
+// Sets the ECN bits, updating the header checksum.
+func SetIPv4ECN(packet []byte, ecn byte) {
+	setIPv4Byte(packet, 1, packet[1]&^0x03|ecn&0x03)
+}
+
+// Sets the TTL, updating the header checksum.
+func SetIPv4TTL(packet []byte, ttl byte) {
+	setIPv4Byte(packet, 8, ttl)
+}
+
+// Sets the source address, updating the header checksum and the checksum
+// of a TCP or UDP header that follows. Panics if ip is not an IPv4 address.
+func SetIPv4Source(packet []byte, ip net.IP) {
+	setIPv4Address(packet, 12, ip)
+}
+
+// Sets the destination address, updating the header checksum and the
+// checksum of a TCP or UDP header that follows. Panics if ip is not an
+// IPv4 address.
+func SetIPv4Destination(packet []byte, ip net.IP) {
+	setIPv4Address(packet, 16, ip)
+}
+
+func setIPv4Byte(packet []byte, pos int, value byte) {
+	word := pos &^ 1
+	old := binary.BigEndian.Uint16(packet[word:])
+	packet[pos] = value
+	updateChecksumField(packet[10:], old, binary.BigEndian.Uint16(packet[word:]))
+}
+
+func setIPv4Address(packet []byte, pos int, ip net.IP) {
+	addr := packet[pos : pos+4]
+	if ip.To4() == nil {
+		panic("pktutil: not an IPv4 address: " + ip.String())
+	}
+	ip = ip.To4()
+	if field, udp := transportChecksumField(packet); field != nil {
+		updateTransportChecksumField(field, udp, addr, ip)
+	}
+	binary.BigEndian.PutUint16(packet[10:], UpdateChecksumBytes(binary.BigEndian.Uint16(packet[10:]), addr, ip))
+	copy(addr, ip)
 }
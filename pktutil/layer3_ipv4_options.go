@@ -0,0 +1,91 @@
+package pktutil
+
+import (
+	"fmt"
+)
+
+type IPv4OptionType byte
+
+// IPv4 option types, including the copied and class bits.
+// From: https://www.iana.org/assignments/ip-parameters
+const (
+	IPv4OptionEnd         IPv4OptionType = 0x00
+	IPv4OptionNOP         IPv4OptionType = 0x01
+	IPv4OptionRecordRoute IPv4OptionType = 0x07
+	IPv4OptionTimestamp   IPv4OptionType = 0x44
+	IPv4OptionSecurity    IPv4OptionType = 0x82
+	IPv4OptionLSRR        IPv4OptionType = 0x83
+	IPv4OptionStreamID    IPv4OptionType = 0x88
+	IPv4OptionSSRR        IPv4OptionType = 0x89
+	IPv4OptionRouterAlert IPv4OptionType = 0x94
+)
+
+// Reports whether the option is copied into every fragment.
+func (t IPv4OptionType) Copied() bool {
+	return t&0x80 != 0
+}
+
+// IPv4Option is a single IPv4 header option.
+type IPv4Option struct {
+	Type IPv4OptionType
+	// Option data, excluding the type and length bytes.
+	Data []byte
+}
+
+// IPv4OptionIterator steps through the options of an IPv4 header, skipping
+// NOP padding and stopping at the end of options list. It does not
+// allocate.
+type IPv4OptionIterator struct {
+	options []byte
+	option  IPv4Option
+	err     error
+}
+
+// Creates an iterator over options, as returned by IPv4Options or found in
+// IPv4Header.Options.
+func NewIPv4OptionIterator(options []byte) IPv4OptionIterator {
+	return IPv4OptionIterator{options: options}
+}
+
+// Advances to the next option, returning false at the end of the list or
+// on error.
+func (it *IPv4OptionIterator) Next() bool {
+	for len(it.options) > 0 {
+		t := IPv4OptionType(it.options[0])
+		switch t {
+		case IPv4OptionEnd:
+			it.options = nil
+			return false
+		case IPv4OptionNOP:
+			it.options = it.options[1:]
+			continue
+		}
+		if len(it.options) < 2 {
+			it.err = fmt.Errorf("ipv4: %w: option %d missing length", ErrTruncated, t)
+			return false
+		}
+		length := int(it.options[1])
+		if length < 2 {
+			it.err = fmt.Errorf("ipv4: %w: option %d of length %d", ErrMalformed, t, length)
+			return false
+		}
+		if len(it.options) < length {
+			it.err = fmt.Errorf("ipv4: %w: option %d of length %d in %d bytes", ErrTruncated, t, length, len(it.options))
+			return false
+		}
+		it.option = IPv4Option{Type: t, Data: it.options[2:length]}
+		it.options = it.options[length:]
+		return true
+	}
+	return false
+}
+
+// Returns the option found by the last call to Next.
+func (it *IPv4OptionIterator) Option() IPv4Option {
+	return it.option
+}
+
+// Returns the error that stopped the iteration, if any.
+func (it *IPv4OptionIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,238 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// IPv6Header is a bounds-checked view of the fixed IPv6 header. The
+// address and payload slices refer to the decoded packet.
+type IPv6Header struct {
+	Version       byte
+	TrafficClass  byte
+	FlowLabel     uint32
+	PayloadLength uint16
+	NextHeader    IPProtocol
+	HopLimit      byte
+	Source        net.IP
+	Destination   net.IP
+	// Everything after the fixed header, including any extension headers.
+	// Excludes any link-layer padding beyond PayloadLength.
+	Payload []byte
+}
+
+// Decodes the fixed header of packet into h.
+func (h *IPv6Header) Decode(packet []byte) error {
+	if len(packet) < 40 {
+		return fmt.Errorf("ipv6: %w: packet of %d bytes", ErrTruncated, len(packet))
+	}
+	version := packet[0] >> 4
+	if version != 6 {
+		return fmt.Errorf("ipv6: %w: version %d", ErrMalformed, version)
+	}
+	payloadLen := binary.BigEndian.Uint16(packet[4:])
+	if len(packet) < 40+int(payloadLen) {
+		return fmt.Errorf("ipv6: %w: payload length %d in packet of %d bytes", ErrTruncated, payloadLen, len(packet))
+	}
+	h.Version = version
+	h.TrafficClass = packet[0]<<4 | packet[1]>>4
+	h.FlowLabel = binary.BigEndian.Uint32(packet[0:]) & 0x000FFFFF
+	h.PayloadLength = payloadLen
+	h.NextHeader = IPProtocol(packet[6])
+	h.HopLimit = packet[7]
+	h.Source = net.IP(packet[8:24])
+	h.Destination = net.IP(packet[24:40])
+	h.Payload = packet[40 : 40+int(payloadLen)]
+	return nil
+}
+
+func IPv6TrafficClass(packet []byte) byte {
+	return packet[0]<<4 | packet[1]>>4
+}
+
+func IPv6FlowLabel(packet []byte) uint32 {
+	return binary.BigEndian.Uint32(packet[0:]) & 0x000FFFFF
+}
+
+func IPv6PayloadLength(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[4:])
+}
+
+func IPv6NextHeader(packet []byte) IPProtocol {
+	return IPProtocol(packet[6])
+}
+
+func IPv6HopLimit(packet []byte) byte {
+	return packet[7]
+}
+
+func SetIPv6HopLimit(packet []byte, hopLimit byte) {
+	packet[7] = hopLimit
+}
+
+func IPv6Source(packet []byte) net.IP {
+	return append(net.IP(nil), packet[8:24]...)
+}
+
+func IPv6Destination(packet []byte) net.IP {
+	return append(net.IP(nil), packet[24:40]...)
+}
+
+// Sets the source address, updating the checksum of a TCP, UDP or ICMPv6
+// header that follows. Panics if ip is not a valid address.
+func SetIPv6Source(packet []byte, ip net.IP) {
+	setIPv6Address(packet[8:24], packet, ip)
+}
+
+// Sets the destination address, updating the checksum of a TCP, UDP or
+// ICMPv6 header that follows. Panics if ip is not a valid address.
+func SetIPv6Destination(packet []byte, ip net.IP) {
+	setIPv6Address(packet[24:40], packet, ip)
+}
+
+func setIPv6Address(addr, packet []byte, ip net.IP) {
+	if ip.To16() == nil {
+		panic("pktutil: not an IP address: " + ip.String())
+	}
+	ip = ip.To16()
+	if field, udp := transportChecksumField(packet); field != nil {
+		updateTransportChecksumField(field, udp, addr, ip)
+	}
+	copy(addr, ip)
+}
+
+// Returns the bytes following the fixed header, up to the payload length
+// when the packet holds that many.
+func IPv6Payload(packet []byte) []byte {
+	end := 40 + int(IPv6PayloadLength(packet))
+	if end > len(packet) {
+		end = len(packet)
+	}
+	return packet[40:end]
+}
+
+// Returns the upper-layer protocol of an IPv6 packet and the offset of its
+// payload, skipping any extension headers. For a fragment other than the
+// first, the protocol is that of the fragmented payload and the offset is
+// where the fragment data starts.
+func IPv6UpperLayer(packet []byte) (IPProtocol, int, error) {
+	w := NewIPv6ExtensionWalker(packet)
+	for w.Next() {
+	}
+	if err := w.Err(); err != nil {
+		return 0, 0, err
+	}
+	return w.Protocol(), w.Offset(), nil
+}
+
+// IPv6ExtensionHeader is one header of an IPv6 extension header chain.
+type IPv6ExtensionHeader struct {
+	// Type of this header, e.g. HOPOPT or IPv6_Frag.
+	Protocol IPProtocol
+	// Type of the header that follows.
+	NextHeader IPProtocol
+	// Offset of the header from the start of the packet.
+	Offset int
+	// The whole header, including the next header and length fields.
+	Data []byte
+}
+
+// IPv6ExtensionWalker steps through the extension headers of an IPv6
+// packet: hop-by-hop options, routing, fragment, destination options and
+// authentication headers. It does not allocate.
+type IPv6ExtensionWalker struct {
+	packet   []byte
+	next     IPProtocol
+	offset   int
+	fragment bool
+	header   IPv6ExtensionHeader
+	err      error
+}
+
+// Creates a walker over the extension headers of packet.
+func NewIPv6ExtensionWalker(packet []byte) IPv6ExtensionWalker {
+	var h IPv6Header
+	if err := h.Decode(packet); err != nil {
+		return IPv6ExtensionWalker{err: err}
+	}
+	return IPv6ExtensionWalker{
+		packet: packet[:40+int(h.PayloadLength)],
+		next:   h.NextHeader,
+		offset: 40,
+	}
+}
+
+// Advances to the next extension header, returning false at the
+// upper-layer header or on error.
+func (w *IPv6ExtensionWalker) Next() bool {
+	if w.err != nil || w.fragment || !isIPv6Extension(w.next) {
+		return false
+	}
+	rest := w.packet[w.offset:]
+	if len(rest) < 8 {
+		w.err = fmt.Errorf("ipv6: %w: extension header %d at offset %d", ErrTruncated, w.next, w.offset)
+		return false
+	}
+	var length int
+	switch w.next {
+	case IPv6_Frag:
+		length = 8
+		// later fragments carry no upper-layer header to walk into
+		w.fragment = binary.BigEndian.Uint16(rest[2:])&0xFFF8 != 0
+	case AH:
+		length = (int(rest[1]) + 2) * 4
+	default:
+		length = (int(rest[1]) + 1) * 8
+	}
+	if len(rest) < length {
+		w.err = fmt.Errorf("ipv6: %w: extension header %d of %d bytes at offset %d", ErrTruncated, w.next, length, w.offset)
+		return false
+	}
+	w.header = IPv6ExtensionHeader{
+		Protocol:   w.next,
+		NextHeader: IPProtocol(rest[0]),
+		Offset:     w.offset,
+		Data:       rest[:length],
+	}
+	w.next = w.header.NextHeader
+	w.offset += length
+	return true
+}
+
+// Returns the header found by the last call to Next.
+func (w *IPv6ExtensionWalker) Header() IPv6ExtensionHeader {
+	return w.header
+}
+
+// Returns the protocol of the header following the last extension header
+// walked; once Next returns false, this is the upper-layer protocol.
+func (w *IPv6ExtensionWalker) Protocol() IPProtocol {
+	return w.next
+}
+
+// Returns the offset from the start of the packet of the header following
+// the last extension header walked.
+func (w *IPv6ExtensionWalker) Offset() int {
+	return w.offset
+}
+
+// Reports whether the walk stopped at a fragment header with a non-zero
+// offset, in which case the bytes at Offset continue an earlier fragment
+// rather than starting an upper-layer header.
+func (w *IPv6ExtensionWalker) Fragment() bool {
+	return w.fragment
+}
+
+// Returns the error that stopped the walk, if any.
+func (w *IPv6ExtensionWalker) Err() error {
+	return w.err
+}
+
+func isIPv6Extension(p IPProtocol) bool {
+	switch p {
+	case HOPOPT, IPv6_Route, IPv6_Frag, IPv6_Opts, AH:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ICMP message types.
+// From: https://www.iana.org/assignments/icmp-parameters
+const (
+	ICMPv4EchoReply              = 0
+	ICMPv4DestinationUnreachable = 3
+	ICMPv4Redirect               = 5
+	ICMPv4EchoRequest            = 8
+	ICMPv4TimeExceeded           = 11
+	ICMPv4ParameterProblem       = 12
+)
+
+// ICMPv4 destination unreachable codes.
+const (
+	ICMPv4NetUnreachable      = 0
+	ICMPv4HostUnreachable     = 1
+	ICMPv4ProtocolUnreachable = 2
+	ICMPv4PortUnreachable     = 3
+	ICMPv4FragmentationNeeded = 4
+	ICMPv4AdminProhibited     = 13
+)
+
+// ICMPv6 message types.
+// From: https://www.iana.org/assignments/icmpv6-parameters
+const (
+	ICMPv6DestinationUnreachable = 1
+	ICMPv6PacketTooBig           = 2
+	ICMPv6TimeExceeded           = 3
+	ICMPv6ParameterProblem       = 4
+	ICMPv6EchoRequest            = 128
+	ICMPv6EchoReply              = 129
+	ICMPv6RouterSolicitation     = 133
+	ICMPv6RouterAdvertisement    = 134
+	ICMPv6NeighborSolicitation   = 135
+	ICMPv6NeighborAdvertisement  = 136
+	ICMPv6Redirect               = 137
+)
+
+// ICMPv6 destination unreachable codes.
+const (
+	ICMPv6NoRoute            = 0
+	ICMPv6AdminProhibited    = 1
+	ICMPv6AddressUnreachable = 3
+	ICMPv6PortUnreachable    = 4
+)
+
+// Time exceeded codes, shared by ICMPv4 and ICMPv6.
+const (
+	ICMPHopLimitExceeded   = 0
+	ICMPReassemblyExceeded = 1
+)
+
+// ICMPHeader is a bounds-checked view of an ICMP or ICMPv6 message. The
+// body slice refers to the decoded message.
+type ICMPHeader struct {
+	Type     byte
+	Code     byte
+	Checksum uint16
+	// Everything after the checksum, starting with the type-specific
+	// header word.
+	Body []byte
+}
+
+// Decodes the header of message into h.
+func (h *ICMPHeader) Decode(message []byte) error {
+	if len(message) < 8 {
+		return fmt.Errorf("icmp: %w: message of %d bytes", ErrTruncated, len(message))
+	}
+	h.Type = message[0]
+	h.Code = message[1]
+	h.Checksum = binary.BigEndian.Uint16(message[2:])
+	h.Body = message[4:]
+	return nil
+}
+
+func ICMPType(message []byte) byte {
+	return message[0]
+}
+
+func ICMPCode(message []byte) byte {
+	return message[1]
+}
+
+func ICMPChecksum(message []byte) uint16 {
+	return binary.BigEndian.Uint16(message[2:])
+}
+
+// Returns the identifier of an echo request or reply.
+func ICMPEchoID(message []byte) uint16 {
+	return binary.BigEndian.Uint16(message[4:])
+}
+
+// Returns the sequence number of an echo request or reply.
+func ICMPEchoSeq(message []byte) uint16 {
+	return binary.BigEndian.Uint16(message[6:])
+}
+
+// Returns the data following the header of an echo request or reply.
+func ICMPEchoData(message []byte) []byte {
+	return message[8:]
+}
+
+// Returns the MTU reported by an ICMPv4 fragmentation needed or an ICMPv6
+// packet too big message.
+func ICMPMTU(message []byte) uint32 {
+	if message[0] == ICMPv4DestinationUnreachable {
+		return uint32(binary.BigEndian.Uint16(message[6:]))
+	}
+	return binary.BigEndian.Uint32(message[4:])
+}
+
+// Returns the leading part of the datagram that caused an error message.
+func ICMPOriginal(message []byte) []byte {
+	return message[8:]
+}
+
+// Reports whether t is an ICMPv4 error message type.
+func IsICMPv4Error(t byte) bool {
+	switch t {
+	case ICMPv4DestinationUnreachable, ICMPv4Redirect, ICMPv4TimeExceeded, ICMPv4ParameterProblem:
+		return true
+	}
+	return false
+}
+
+// Reports whether t is an ICMPv6 error message type.
+func IsICMPv6Error(t byte) bool {
+	return t < 128
+}
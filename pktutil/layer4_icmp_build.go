@@ -0,0 +1,160 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Hop limit of the packets built here.
+const icmpHopLimit = 64
+
+// Error messages include as much of the original datagram as fits in these
+// packet sizes (RFC 1812 section 4.3.2.3, RFC 4443 section 2.4).
+const (
+	icmpv4ErrorMax = 576
+	icmpv6ErrorMax = 1280
+)
+
+// Builds an echo reply to request, an IPv4 or IPv6 packet carrying an echo
+// request. The reply is sent from the request's destination back to its
+// source, so callers answering a multicast or broadcast request must
+// replace the source address. IPv4 options and IPv6 extension headers of
+// the request are not copied.
+func ICMPEchoReply(request []byte) ([]byte, error) {
+	if len(request) > 0 && IsIPv4(request) {
+		var h IPv4Header
+		if err := h.Decode(request); err != nil {
+			return nil, err
+		}
+		if h.Protocol != ICMP || len(h.Payload) < 8 || h.Payload[0] != ICMPv4EchoRequest {
+			return nil, fmt.Errorf("icmp: %w: not an echo request", ErrMalformed)
+		}
+		pkt := newIPv4Packet(h.Destination, h.Source, ICMP, len(h.Payload))
+		message := pkt[20:]
+		copy(message, h.Payload)
+		message[0] = ICMPv4EchoReply
+		setICMPChecksum(pkt, message)
+		return pkt, nil
+	}
+	var h IPv6Header
+	if err := h.Decode(request); err != nil {
+		return nil, err
+	}
+	protocol, offset, err := IPv6UpperLayer(request)
+	if err != nil {
+		return nil, err
+	}
+	payload := request[offset : 40+int(h.PayloadLength)]
+	if protocol != IPv6_ICMP || len(payload) < 8 || payload[0] != ICMPv6EchoRequest {
+		return nil, fmt.Errorf("icmp: %w: not an echo request", ErrMalformed)
+	}
+	pkt := newIPv6Packet(h.Destination, h.Source, IPv6_ICMP, icmpHopLimit, len(payload))
+	message := pkt[40:]
+	copy(message, payload)
+	message[0] = ICMPv6EchoReply
+	setICMPChecksum(pkt, message)
+	return pkt, nil
+}
+
+// Builds a destination unreachable message from src about original, the
+// IPv4 or IPv6 packet that could not be delivered. The code must suit the
+// IP version, e.g. ICMPv4PortUnreachable or ICMPv6PortUnreachable.
+//
+// Like the other error builders, it leaves the rules on when no error may
+// be sent (RFC 1812, RFC 4443), such as in reply to another error message,
+// to the caller.
+func ICMPDestinationUnreachable(src net.IP, code byte, original []byte) ([]byte, error) {
+	return icmpError(src, original, ICMPv4DestinationUnreachable, ICMPv6DestinationUnreachable, code, 0)
+}
+
+// Builds a time exceeded message from src about original, the IPv4 or IPv6
+// packet that was dropped. The code is ICMPHopLimitExceeded or
+// ICMPReassemblyExceeded.
+func ICMPTimeExceeded(src net.IP, code byte, original []byte) ([]byte, error) {
+	return icmpError(src, original, ICMPv4TimeExceeded, ICMPv6TimeExceeded, code, 0)
+}
+
+// Builds a message from src reporting that original, an IPv4 or IPv6
+// packet, exceeds mtu: an ICMPv4 fragmentation needed or an ICMPv6 packet
+// too big message.
+func ICMPPacketTooBig(src net.IP, mtu int, original []byte) ([]byte, error) {
+	if len(original) > 0 && IsIPv4(original) {
+		return icmpError(src, original, ICMPv4DestinationUnreachable, 0, ICMPv4FragmentationNeeded, uint32(mtu)&0xFFFF)
+	}
+	return icmpError(src, original, 0, ICMPv6PacketTooBig, 0, uint32(mtu))
+}
+
+func icmpError(src net.IP, original []byte, type4, type6, code byte, word uint32) ([]byte, error) {
+	var pkt, message []byte
+	switch {
+	case len(original) >= 20 && IsIPv4(original):
+		if src = src.To4(); src == nil {
+			return nil, fmt.Errorf("icmp: %w: source address is not IPv4", ErrMalformed)
+		}
+		n := len(original)
+		if n > icmpv4ErrorMax-28 {
+			n = icmpv4ErrorMax - 28
+		}
+		pkt = newIPv4Packet(src, net.IP(original[12:16]), ICMP, 8+n)
+		message = pkt[20:]
+		message[0] = type4
+	case len(original) >= 40 && IsIPv6(original):
+		if len(src) != net.IPv6len || src.To4() != nil {
+			return nil, fmt.Errorf("icmp: %w: source address is not IPv6", ErrMalformed)
+		}
+		n := len(original)
+		if n > icmpv6ErrorMax-48 {
+			n = icmpv6ErrorMax - 48
+		}
+		pkt = newIPv6Packet(src, net.IP(original[8:24]), IPv6_ICMP, icmpHopLimit, 8+n)
+		message = pkt[40:]
+		message[0] = type6
+	default:
+		return nil, fmt.Errorf("icmp: %w: original datagram of %d bytes", ErrTruncated, len(original))
+	}
+	message[1] = code
+	binary.BigEndian.PutUint32(message[4:], word)
+	copy(message[8:], original)
+	setICMPChecksum(pkt, message)
+	return pkt, nil
+}
+
+// Returns an IPv4 packet with a complete header and room for length bytes
+// of payload.
+func newIPv4Packet(src, dst net.IP, protocol IPProtocol, length int) []byte {
+	pkt := make([]byte, 20+length)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = icmpHopLimit
+	pkt[9] = byte(protocol)
+	copy(pkt[12:16], src.To4())
+	copy(pkt[16:20], dst.To4())
+	binary.BigEndian.PutUint16(pkt[10:], Checksum(pkt[:20]))
+	return pkt
+}
+
+// Returns an IPv6 packet with a complete header and room for length bytes
+// of payload.
+func newIPv6Packet(src, dst net.IP, protocol IPProtocol, hopLimit byte, length int) []byte {
+	pkt := make([]byte, 40+length)
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(length))
+	pkt[6] = byte(protocol)
+	pkt[7] = hopLimit
+	copy(pkt[8:24], src.To16())
+	copy(pkt[24:40], dst.To16())
+	return pkt
+}
+
+// Fills in the checksum of message, the ICMP or ICMPv6 payload of pkt.
+func setICMPChecksum(pkt, message []byte) {
+	message[2], message[3] = 0, 0
+	var sum uint16
+	if IsIPv6(pkt) {
+		sum = TransportChecksum(pkt[8:24], pkt[24:40], IPv6_ICMP, message)
+	} else {
+		sum = Checksum(message)
+	}
+	binary.BigEndian.PutUint16(message[2:], sum)
+}
@@ -0,0 +1,375 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// NDP option types.
+const (
+	NDPOptionSourceLinkLayerAddr = 1
+	NDPOptionTargetLinkLayerAddr = 2
+	NDPOptionPrefixInformation   = 3
+	NDPOptionRedirectedHeader    = 4
+	NDPOptionMTU                 = 5
+)
+
+// Neighbor advertisement flags.
+const (
+	NDPFlagRouter    = 0x80
+	NDPFlagSolicited = 0x40
+	NDPFlagOverride  = 0x20
+)
+
+// Router advertisement flags.
+const (
+	NDPFlagManaged = 0x80
+	NDPFlagOther   = 0x40
+)
+
+// Hop limit of all NDP messages; receivers drop any with another value, as
+// they may have been forwarded.
+const NDPHopLimit = 255
+
+// NDPMessage is a bounds-checked view of a Neighbor Discovery message: a
+// router solicitation or advertisement, neighbor solicitation or
+// advertisement, or redirect. The address and option slices refer to the
+// decoded message.
+type NDPMessage struct {
+	Type byte
+	Code byte
+	// Neighbor or router advertisement flags.
+	Flags byte
+	// Router advertisement fields.
+	CurHopLimit    byte
+	RouterLifetime uint16
+	ReachableTime  uint32
+	RetransTimer   uint32
+	// Neighbor solicitation, neighbor advertisement and redirect target.
+	Target net.IP
+	// Redirect destination.
+	Destination net.IP
+	Options     []byte
+}
+
+// Decodes the ICMPv6 message into m, returning an error wrapping
+// ErrTruncated, or ErrUnsupported for other message types.
+func (m *NDPMessage) Decode(message []byte) error {
+	if len(message) < 8 {
+		return fmt.Errorf("ndp: %w: message of %d bytes", ErrTruncated, len(message))
+	}
+	var fixed int
+	switch message[0] {
+	case ICMPv6RouterSolicitation:
+		fixed = 8
+	case ICMPv6RouterAdvertisement:
+		fixed = 16
+	case ICMPv6NeighborSolicitation, ICMPv6NeighborAdvertisement:
+		fixed = 24
+	case ICMPv6Redirect:
+		fixed = 40
+	default:
+		return fmt.Errorf("ndp: %w: message type %d", ErrUnsupported, message[0])
+	}
+	if len(message) < fixed {
+		return fmt.Errorf("ndp: %w: message of type %d and %d bytes", ErrTruncated, message[0], len(message))
+	}
+	*m = NDPMessage{
+		Type:    message[0],
+		Code:    message[1],
+		Options: message[fixed:],
+	}
+	switch m.Type {
+	case ICMPv6RouterAdvertisement:
+		m.CurHopLimit = message[4]
+		m.Flags = message[5]
+		m.RouterLifetime = binary.BigEndian.Uint16(message[6:])
+		m.ReachableTime = binary.BigEndian.Uint32(message[8:])
+		m.RetransTimer = binary.BigEndian.Uint32(message[12:])
+	case ICMPv6NeighborAdvertisement:
+		m.Flags = message[4]
+		m.Target = net.IP(message[8:24])
+	case ICMPv6NeighborSolicitation:
+		m.Target = net.IP(message[8:24])
+	case ICMPv6Redirect:
+		m.Target = net.IP(message[8:24])
+		m.Destination = net.IP(message[24:40])
+	}
+	return nil
+}
+
+// Returns the link-layer address in the source or target link-layer
+// address option of m, or nil.
+func (m *NDPMessage) LinkLayerAddr(optionType byte) net.HardwareAddr {
+	it := NewNDPOptionIterator(m.Options)
+	for it.Next() {
+		if o := it.Option(); o.Type == optionType {
+			return o.LinkLayerAddr()
+		}
+	}
+	return nil
+}
+
+// NDPOption is a single Neighbor Discovery option.
+type NDPOption struct {
+	Type byte
+	// Option data, excluding the type and length bytes.
+	Data []byte
+}
+
+// Returns the address of a source or target link-layer address option.
+func (o NDPOption) LinkLayerAddr() net.HardwareAddr {
+	return net.HardwareAddr(o.Data)
+}
+
+// Returns the contents of a prefix information option.
+func (o NDPOption) Prefix() (NDPPrefix, error) {
+	if len(o.Data) < 30 {
+		return NDPPrefix{}, fmt.Errorf("ndp: %w: prefix option of %d bytes", ErrTruncated, len(o.Data))
+	}
+	length := int(o.Data[0])
+	if length > 128 {
+		return NDPPrefix{}, fmt.Errorf("ndp: %w: prefix length %d", ErrMalformed, length)
+	}
+	prefix := net.IP(o.Data[14:30])
+	mask := net.CIDRMask(length, 128)
+	return NDPPrefix{
+		Prefix:            &net.IPNet{IP: prefix.Mask(mask), Mask: mask},
+		OnLink:            o.Data[1]&0x80 != 0,
+		Autonomous:        o.Data[1]&0x40 != 0,
+		ValidLifetime:     binary.BigEndian.Uint32(o.Data[2:]),
+		PreferredLifetime: binary.BigEndian.Uint32(o.Data[6:]),
+	}, nil
+}
+
+// Returns the MTU of an MTU option.
+func (o NDPOption) MTU() (uint32, error) {
+	if len(o.Data) < 6 {
+		return 0, fmt.Errorf("ndp: %w: MTU option of %d bytes", ErrTruncated, len(o.Data))
+	}
+	return binary.BigEndian.Uint32(o.Data[2:]), nil
+}
+
+// NDPOptionIterator steps through Neighbor Discovery options. It does not
+// allocate.
+type NDPOptionIterator struct {
+	options []byte
+	option  NDPOption
+	err     error
+}
+
+// Creates an iterator over options, as found in NDPMessage.Options.
+func NewNDPOptionIterator(options []byte) NDPOptionIterator {
+	return NDPOptionIterator{options: options}
+}
+
+// Advances to the next option, returning false at the end of the options
+// or on error.
+func (it *NDPOptionIterator) Next() bool {
+	if it.err != nil || len(it.options) == 0 {
+		return false
+	}
+	if len(it.options) < 2 {
+		it.err = fmt.Errorf("ndp: %w: option of %d bytes", ErrTruncated, len(it.options))
+		return false
+	}
+	// the length is in units of 8 bytes and must not be zero
+	length := int(it.options[1]) * 8
+	if length == 0 {
+		it.err = fmt.Errorf("ndp: %w: option %d of length zero", ErrMalformed, it.options[0])
+		return false
+	}
+	if len(it.options) < length {
+		it.err = fmt.Errorf("ndp: %w: option %d of length %d in %d bytes", ErrTruncated, it.options[0], length, len(it.options))
+		return false
+	}
+	it.option = NDPOption{Type: it.options[0], Data: it.options[2:length]}
+	it.options = it.options[length:]
+	return true
+}
+
+// Returns the option found by the last call to Next.
+func (it *NDPOptionIterator) Option() NDPOption {
+	return it.option
+}
+
+// Returns the error that stopped the iteration, if any.
+func (it *NDPOptionIterator) Err() error {
+	return it.err
+}
+
+// NDPPrefix is the content of a prefix information option.
+type NDPPrefix struct {
+	Prefix *net.IPNet
+	// Whether the prefix is on-link.
+	OnLink bool
+	// Whether hosts may form addresses in the prefix with SLAAC.
+	Autonomous bool
+	// Lifetimes in seconds; 0xFFFFFFFF means infinity.
+	ValidLifetime     uint32
+	PreferredLifetime uint32
+}
+
+// RouterAdvertisement describes a router advertisement to build.
+type RouterAdvertisement struct {
+	CurHopLimit byte
+	Managed     bool
+	Other       bool
+	// Seconds the sender is usable as a default router; zero if it is not
+	// a default router.
+	RouterLifetime uint16
+	// Milliseconds; zero if unspecified.
+	ReachableTime uint32
+	RetransTimer  uint32
+	// Link MTU to advertise; zero to leave it out.
+	MTU      uint32
+	Prefixes []NDPPrefix
+}
+
+// Returns the solicited-node multicast address of ip.
+func SolicitedNodeMulticast(ip net.IP) net.IP {
+	ip = ip.To16()
+	return net.IP{0xFF, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xFF, ip[13], ip[14], ip[15]}
+}
+
+// Returns the Ethernet address an IPv6 multicast address maps to.
+func MulticastMAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// Returns the link-local address formed from mac with a modified EUI-64
+// interface identifier.
+func LinkLocalAddr(mac net.HardwareAddr) net.IP {
+	return net.IP{0xFE, 0x80, 0, 0, 0, 0, 0, 0,
+		mac[0] ^ 0x02, mac[1], mac[2], 0xFF, 0xFE, mac[3], mac[4], mac[5]}
+}
+
+// Addresses of all nodes and all routers on the link.
+var (
+	IPv6AllNodes   = net.IP{0xFF, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}
+	IPv6AllRouters = net.IP{0xFF, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02}
+)
+
+// Builds a neighbor solicitation from src asking for target, sent to the
+// target's solicited-node multicast address. A src of :: makes it a
+// duplicate address detection probe, which carries no link-layer address.
+func NewNeighborSolicitation(src net.IP, srcMAC net.HardwareAddr, target net.IP) []byte {
+	body := make([]byte, 20, 28)
+	copy(body[4:], target.To16())
+	if !src.IsUnspecified() {
+		body = appendLinkLayerOption(body, NDPOptionSourceLinkLayerAddr, srcMAC)
+	}
+	return newNDPPacket(src, SolicitedNodeMulticast(target), ICMPv6NeighborSolicitation, body)
+}
+
+// Builds a neighbor advertisement from src to dst stating that target is
+// at targetMAC. The flags are NDPFlagRouter, NDPFlagSolicited and
+// NDPFlagOverride.
+func NewNeighborAdvertisement(src, dst, target net.IP, targetMAC net.HardwareAddr, flags byte) []byte {
+	body := make([]byte, 20, 28)
+	body[0] = flags
+	copy(body[4:], target.To16())
+	body = appendLinkLayerOption(body, NDPOptionTargetLinkLayerAddr, targetMAC)
+	return newNDPPacket(src, dst, ICMPv6NeighborAdvertisement, body)
+}
+
+// Builds a router solicitation from src to all routers.
+func NewRouterSolicitation(src net.IP, srcMAC net.HardwareAddr) []byte {
+	body := make([]byte, 4, 12)
+	if !src.IsUnspecified() {
+		body = appendLinkLayerOption(body, NDPOptionSourceLinkLayerAddr, srcMAC)
+	}
+	return newNDPPacket(src, IPv6AllRouters, ICMPv6RouterSolicitation, body)
+}
+
+// Builds a router advertisement from src, a link-local address, to dst.
+func NewRouterAdvertisement(src net.IP, srcMAC net.HardwareAddr, dst net.IP, ra *RouterAdvertisement) []byte {
+	body := make([]byte, 12)
+	body[0] = ra.CurHopLimit
+	if ra.Managed {
+		body[1] |= NDPFlagManaged
+	}
+	if ra.Other {
+		body[1] |= NDPFlagOther
+	}
+	binary.BigEndian.PutUint16(body[2:], ra.RouterLifetime)
+	binary.BigEndian.PutUint32(body[4:], ra.ReachableTime)
+	binary.BigEndian.PutUint32(body[8:], ra.RetransTimer)
+	body = appendLinkLayerOption(body, NDPOptionSourceLinkLayerAddr, srcMAC)
+	if ra.MTU != 0 {
+		option := make([]byte, 8)
+		option[0] = NDPOptionMTU
+		option[1] = 1
+		binary.BigEndian.PutUint32(option[4:], ra.MTU)
+		body = append(body, option...)
+	}
+	for _, p := range ra.Prefixes {
+		option := make([]byte, 32)
+		option[0] = NDPOptionPrefixInformation
+		option[1] = 4
+		ones, _ := p.Prefix.Mask.Size()
+		option[2] = byte(ones)
+		if p.OnLink {
+			option[3] |= 0x80
+		}
+		if p.Autonomous {
+			option[3] |= 0x40
+		}
+		binary.BigEndian.PutUint32(option[4:], p.ValidLifetime)
+		binary.BigEndian.PutUint32(option[8:], p.PreferredLifetime)
+		copy(option[16:], p.Prefix.IP.Mask(p.Prefix.Mask).To16())
+		body = append(body, option...)
+	}
+	return newNDPPacket(src, dst, ICMPv6RouterAdvertisement, body)
+}
+
+// Builds a redirect from src, a link-local address, telling dst that
+// packets for destination are better sent to target at targetMAC. As much
+// of original, the packet that triggered the redirect, is included as fits
+// in the minimum IPv6 MTU.
+func NewRedirect(src, dst, target net.IP, targetMAC net.HardwareAddr, destination net.IP, original []byte) []byte {
+	body := make([]byte, 36, 44)
+	copy(body[4:], target.To16())
+	copy(body[20:], destination.To16())
+	if targetMAC != nil {
+		body = appendLinkLayerOption(body, NDPOptionTargetLinkLayerAddr, targetMAC)
+	}
+	if len(original) > 0 {
+		room := (icmpv6ErrorMax - 40 - 4 - len(body) - 8) &^ 7
+		n := len(original)
+		if n > room {
+			n = room
+		}
+		option := make([]byte, 8+pad8(n))
+		option[0] = NDPOptionRedirectedHeader
+		option[1] = byte(len(option) / 8)
+		copy(option[8:], original[:n])
+		body = append(body, option...)
+	}
+	return newNDPPacket(src, dst, ICMPv6Redirect, body)
+}
+
+func appendLinkLayerOption(body []byte, optionType byte, mac net.HardwareAddr) []byte {
+	option := make([]byte, pad8(2+len(mac)))
+	option[0] = optionType
+	option[1] = byte(len(option) / 8)
+	copy(option[2:], mac)
+	return append(body, option...)
+}
+
+func pad8(n int) int {
+	return (n + 7) &^ 7
+}
+
+// Returns an IPv6 packet carrying an NDP message of type t whose contents
+// after the checksum are body.
+func newNDPPacket(src, dst net.IP, t byte, body []byte) []byte {
+	pkt := newIPv6Packet(src, dst, IPv6_ICMP, NDPHopLimit, 4+len(body))
+	message := pkt[40:]
+	message[0] = t
+	copy(message[4:], body)
+	setICMPChecksum(pkt, message)
+	return pkt
+}
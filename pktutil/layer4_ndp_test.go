@@ -0,0 +1,75 @@
+package pktutil
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRouterAdvertisementOptions(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("fd00:1::/64")
+	ra := &RouterAdvertisement{
+		CurHopLimit:    64,
+		RouterLifetime: 1800,
+		MTU:            1400,
+		Prefixes:       []NDPPrefix{{Prefix: prefix, OnLink: true, Autonomous: true, ValidLifetime: 86400, PreferredLifetime: 14400}},
+	}
+	pkt := NewRouterAdvertisement(net.ParseIP("fe80::1"), testMAC1, IPv6AllNodes, ra)
+
+	var m NDPMessage
+	if err := m.Decode(pkt[40:]); err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != ICMPv6RouterAdvertisement || m.CurHopLimit != 64 || m.RouterLifetime != 1800 {
+		t.Fatalf("decoded %+v", m)
+	}
+	if mac := m.LinkLayerAddr(NDPOptionSourceLinkLayerAddr); mac.String() != testMAC1.String() {
+		t.Errorf("source link-layer address %s", mac)
+	}
+	var sawMTU, sawPrefix bool
+	it := NewNDPOptionIterator(m.Options)
+	for it.Next() {
+		o := it.Option()
+		switch o.Type {
+		case NDPOptionMTU:
+			mtu, err := o.MTU()
+			if err != nil || mtu != 1400 {
+				t.Errorf("MTU %d, %v", mtu, err)
+			}
+			sawMTU = true
+		case NDPOptionPrefixInformation:
+			p, err := o.Prefix()
+			if err != nil || p.Prefix.String() != prefix.String() || !p.OnLink || !p.Autonomous || p.ValidLifetime != 86400 {
+				t.Errorf("prefix %+v, %v", p, err)
+			}
+			sawPrefix = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !sawMTU || !sawPrefix {
+		t.Errorf("options missing: MTU %v, prefix %v", sawMTU, sawPrefix)
+	}
+}
+
+func TestNDPOptionTruncated(t *testing.T) {
+	short := NDPOption{Type: NDPOptionMTU, Data: []byte{0, 0, 5}}
+	if _, err := short.MTU(); !errors.Is(err, ErrTruncated) {
+		t.Errorf("short MTU option: %v", err)
+	}
+	short.Type = NDPOptionPrefixInformation
+	if _, err := short.Prefix(); !errors.Is(err, ErrTruncated) {
+		t.Errorf("short prefix option: %v", err)
+	}
+
+	// an option whose length overruns the message stops the iteration
+	it := NewNDPOptionIterator([]byte{NDPOptionMTU, 2, 0, 0, 0, 0, 5, 0xdc})
+	if it.Next() || !errors.Is(it.Err(), ErrTruncated) {
+		t.Errorf("overrunning option: %v", it.Err())
+	}
+	it = NewNDPOptionIterator([]byte{NDPOptionMTU, 0, 0, 0, 0, 0, 5, 0xdc})
+	if it.Next() || !errors.Is(it.Err(), ErrMalformed) {
+		t.Errorf("zero-length option: %v", it.Err())
+	}
+}
@@ -0,0 +1,145 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type TCPFlags uint16
+
+// TCP control flags.
+const (
+	TCPFlagFIN TCPFlags = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+	TCPFlagNS
+)
+
+// TCPHeader is a bounds-checked view of a TCP segment. The option and
+// payload slices refer to the decoded segment.
+type TCPHeader struct {
+	SourcePort      uint16
+	DestinationPort uint16
+	Seq             uint32
+	Ack             uint32
+	DataOffset      byte
+	Flags           TCPFlags
+	Window          uint16
+	Checksum        uint16
+	Urgent          uint16
+	Options         []byte
+	Payload         []byte
+}
+
+// Decodes the header of segment into h.
+func (h *TCPHeader) Decode(segment []byte) error {
+	if len(segment) < 20 {
+		return fmt.Errorf("tcp: %w: segment of %d bytes", ErrTruncated, len(segment))
+	}
+	dataOffset := segment[12] >> 4
+	headerLen := int(dataOffset) * 4
+	if dataOffset < 5 {
+		return fmt.Errorf("tcp: %w: data offset %d", ErrMalformed, dataOffset)
+	}
+	if len(segment) < headerLen {
+		return fmt.Errorf("tcp: %w: header of %d bytes in segment of %d bytes", ErrTruncated, headerLen, len(segment))
+	}
+	h.SourcePort = binary.BigEndian.Uint16(segment[0:])
+	h.DestinationPort = binary.BigEndian.Uint16(segment[2:])
+	h.Seq = binary.BigEndian.Uint32(segment[4:])
+	h.Ack = binary.BigEndian.Uint32(segment[8:])
+	h.DataOffset = dataOffset
+	h.Flags = TCPFlags(binary.BigEndian.Uint16(segment[12:]) & 0x01FF)
+	h.Window = binary.BigEndian.Uint16(segment[14:])
+	h.Checksum = binary.BigEndian.Uint16(segment[16:])
+	h.Urgent = binary.BigEndian.Uint16(segment[18:])
+	h.Options = segment[20:headerLen]
+	h.Payload = segment[headerLen:]
+	return nil
+}
+
+var tcpFlagNames = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR", "NS"}
+
+// Returns the names of the set flags joined by "|", e.g. "SYN|ACK".
+func (f TCPFlags) String() string {
+	var b []byte
+	for i, name := range tcpFlagNames {
+		if f&(1<<uint(i)) == 0 {
+			continue
+		}
+		if len(b) > 0 {
+			b = append(b, '|')
+		}
+		b = append(b, name...)
+	}
+	return string(b)
+}
+
+func TCPSourcePort(segment []byte) uint16 {
+	return binary.BigEndian.Uint16(segment[0:])
+}
+
+func TCPDestinationPort(segment []byte) uint16 {
+	return binary.BigEndian.Uint16(segment[2:])
+}
+
+// Sets the source port, updating the checksum.
+func SetTCPSourcePort(segment []byte, port uint16) {
+	setTCPField(segment, 0, port)
+}
+
+// Sets the destination port, updating the checksum.
+func SetTCPDestinationPort(segment []byte, port uint16) {
+	setTCPField(segment, 2, port)
+}
+
+func setTCPField(segment []byte, pos int, value uint16) {
+	updateChecksumField(segment[16:], binary.BigEndian.Uint16(segment[pos:]), value)
+	binary.BigEndian.PutUint16(segment[pos:], value)
+}
+
+func TCPSeq(segment []byte) uint32 {
+	return binary.BigEndian.Uint32(segment[4:])
+}
+
+func TCPAck(segment []byte) uint32 {
+	return binary.BigEndian.Uint32(segment[8:])
+}
+
+func TCPDataOffset(segment []byte) byte {
+	return segment[12] >> 4
+}
+
+// Returns the header length in bytes.
+func TCPHeaderLength(segment []byte) int {
+	return int(TCPDataOffset(segment)) * 4
+}
+
+func TCPControlFlags(segment []byte) TCPFlags {
+	return TCPFlags(binary.BigEndian.Uint16(segment[12:]) & 0x01FF)
+}
+
+func TCPWindow(segment []byte) uint16 {
+	return binary.BigEndian.Uint16(segment[14:])
+}
+
+func TCPChecksum(segment []byte) uint16 {
+	return binary.BigEndian.Uint16(segment[16:])
+}
+
+func TCPUrgent(segment []byte) uint16 {
+	return binary.BigEndian.Uint16(segment[18:])
+}
+
+func TCPOptions(segment []byte) []byte {
+	return segment[20:TCPHeaderLength(segment)]
+}
+
+func TCPPayload(segment []byte) []byte {
+	return segment[TCPHeaderLength(segment):]
+}
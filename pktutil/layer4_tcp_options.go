@@ -0,0 +1,130 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type TCPOptionKind byte
+
+// TCP option kinds.
+// From: https://www.iana.org/assignments/tcp-parameters
+const (
+	TCPOptionEnd           TCPOptionKind = 0
+	TCPOptionNOP           TCPOptionKind = 1
+	TCPOptionMSS           TCPOptionKind = 2
+	TCPOptionWindowScale   TCPOptionKind = 3
+	TCPOptionSACKPermitted TCPOptionKind = 4
+	TCPOptionSACK          TCPOptionKind = 5
+	TCPOptionTimestamps    TCPOptionKind = 8
+)
+
+// Data lengths of the options with a fixed size.
+var tcpOptionLengths = map[TCPOptionKind]int{
+	TCPOptionMSS:           2,
+	TCPOptionWindowScale:   1,
+	TCPOptionSACKPermitted: 0,
+	TCPOptionTimestamps:    8,
+}
+
+// TCPOption is a single TCP header option.
+type TCPOption struct {
+	Kind TCPOptionKind
+	// Option data, excluding the kind and length bytes.
+	Data []byte
+}
+
+// Returns the maximum segment size of a TCPOptionMSS option.
+func (o TCPOption) MSS() uint16 {
+	return binary.BigEndian.Uint16(o.Data)
+}
+
+// Returns the shift count of a TCPOptionWindowScale option.
+func (o TCPOption) WindowScale() byte {
+	return o.Data[0]
+}
+
+// Returns the timestamp value and echo reply of a TCPOptionTimestamps
+// option.
+func (o TCPOption) Timestamps() (value, echo uint32) {
+	return binary.BigEndian.Uint32(o.Data[0:]), binary.BigEndian.Uint32(o.Data[4:])
+}
+
+// Returns the number of blocks in a TCPOptionSACK option.
+func (o TCPOption) SACKBlocks() int {
+	return len(o.Data) / 8
+}
+
+// Returns the left and right edges of block i of a TCPOptionSACK option.
+func (o TCPOption) SACKBlock(i int) (left, right uint32) {
+	b := o.Data[i*8:]
+	return binary.BigEndian.Uint32(b[0:]), binary.BigEndian.Uint32(b[4:])
+}
+
+// TCPOptionIterator steps through the options of a TCP header, skipping
+// NOP padding and stopping at the end of option list. Options whose length
+// does not match their kind are reported as malformed, so the TCPOption
+// accessors are safe to use on what it returns. It does not allocate.
+type TCPOptionIterator struct {
+	options []byte
+	option  TCPOption
+	err     error
+}
+
+// Creates an iterator over options, as returned by TCPOptions or found in
+// TCPHeader.Options.
+func NewTCPOptionIterator(options []byte) TCPOptionIterator {
+	return TCPOptionIterator{options: options}
+}
+
+// Advances to the next option, returning false at the end of the list or
+// on error.
+func (it *TCPOptionIterator) Next() bool {
+	for len(it.options) > 0 {
+		kind := TCPOptionKind(it.options[0])
+		switch kind {
+		case TCPOptionEnd:
+			it.options = nil
+			return false
+		case TCPOptionNOP:
+			it.options = it.options[1:]
+			continue
+		}
+		if len(it.options) < 2 {
+			it.err = fmt.Errorf("tcp: %w: option %d missing length", ErrTruncated, kind)
+			return false
+		}
+		length := int(it.options[1])
+		if length < 2 {
+			it.err = fmt.Errorf("tcp: %w: option %d of length %d", ErrMalformed, kind, length)
+			return false
+		}
+		if len(it.options) < length {
+			it.err = fmt.Errorf("tcp: %w: option %d of length %d in %d bytes", ErrTruncated, kind, length, len(it.options))
+			return false
+		}
+		data := it.options[2:length]
+		if want, ok := tcpOptionLengths[kind]; ok && len(data) != want {
+			it.err = fmt.Errorf("tcp: %w: option %d of length %d", ErrMalformed, kind, length)
+			return false
+		}
+		if kind == TCPOptionSACK && len(data)%8 != 0 {
+			it.err = fmt.Errorf("tcp: %w: sack option of length %d", ErrMalformed, length)
+			return false
+		}
+		it.option = TCPOption{Kind: kind, Data: data}
+		it.options = it.options[length:]
+		return true
+	}
+	return false
+}
+
+// Returns the option found by the last call to Next.
+func (it *TCPOptionIterator) Option() TCPOption {
+	return it.option
+}
+
+// Returns the error that stopped the iteration, if any.
+func (it *TCPOptionIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,103 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// UDPHeader is a bounds-checked view of a UDP datagram. The payload slice
+// refers to the decoded datagram.
+type UDPHeader struct {
+	SourcePort      uint16
+	DestinationPort uint16
+	Length          uint16
+	Checksum        uint16
+	Payload         []byte
+}
+
+// Decodes the header of datagram into h.
+func (h *UDPHeader) Decode(datagram []byte) error {
+	if len(datagram) < 8 {
+		return fmt.Errorf("udp: %w: datagram of %d bytes", ErrTruncated, len(datagram))
+	}
+	length := binary.BigEndian.Uint16(datagram[4:])
+	if length < 8 {
+		return fmt.Errorf("udp: %w: length %d", ErrMalformed, length)
+	}
+	if len(datagram) < int(length) {
+		return fmt.Errorf("udp: %w: length %d in datagram of %d bytes", ErrTruncated, length, len(datagram))
+	}
+	h.SourcePort = binary.BigEndian.Uint16(datagram[0:])
+	h.DestinationPort = binary.BigEndian.Uint16(datagram[2:])
+	h.Length = length
+	h.Checksum = binary.BigEndian.Uint16(datagram[6:])
+	h.Payload = datagram[8:length]
+	return nil
+}
+
+// Decodes the header of a datagram split into IP fragments, of which
+// datagram is the first. Length is not checked against the fragment, and
+// Payload holds as much of the datagram as the fragment carries.
+func (h *UDPHeader) decodeFirstFragment(datagram []byte) error {
+	if len(datagram) < 8 {
+		return fmt.Errorf("udp: %w: datagram of %d bytes", ErrTruncated, len(datagram))
+	}
+	length := binary.BigEndian.Uint16(datagram[4:])
+	if length < 8 {
+		return fmt.Errorf("udp: %w: length %d", ErrMalformed, length)
+	}
+	end := int(length)
+	if end > len(datagram) {
+		end = len(datagram)
+	}
+	h.SourcePort = binary.BigEndian.Uint16(datagram[0:])
+	h.DestinationPort = binary.BigEndian.Uint16(datagram[2:])
+	h.Length = length
+	h.Checksum = binary.BigEndian.Uint16(datagram[6:])
+	h.Payload = datagram[8:end]
+	return nil
+}
+
+func UDPSourcePort(datagram []byte) uint16 {
+	return binary.BigEndian.Uint16(datagram[0:])
+}
+
+func UDPDestinationPort(datagram []byte) uint16 {
+	return binary.BigEndian.Uint16(datagram[2:])
+}
+
+// Sets the source port, updating the checksum if there is one.
+func SetUDPSourcePort(datagram []byte, port uint16) {
+	setUDPField(datagram, 0, port)
+}
+
+// Sets the destination port, updating the checksum if there is one.
+func SetUDPDestinationPort(datagram []byte, port uint16) {
+	setUDPField(datagram, 2, port)
+}
+
+func setUDPField(datagram []byte, pos int, value uint16) {
+	updateUDPChecksumField(datagram[6:], binary.BigEndian.Uint16(datagram[pos:]), value)
+	binary.BigEndian.PutUint16(datagram[pos:], value)
+}
+
+func UDPLength(datagram []byte) uint16 {
+	return binary.BigEndian.Uint16(datagram[4:])
+}
+
+func UDPChecksum(datagram []byte) uint16 {
+	return binary.BigEndian.Uint16(datagram[6:])
+}
+
+// Returns the bytes following the header, up to the length field when the
+// datagram holds that many.
+func UDPPayload(datagram []byte) []byte {
+	end := int(UDPLength(datagram))
+	if end > len(datagram) {
+		end = len(datagram)
+	}
+	if end < 8 {
+		end = 8
+	}
+	return datagram[8:end]
+}
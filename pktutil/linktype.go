@@ -0,0 +1,112 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Link-layer header type of a capture. From: http://www.tcpdump.org/linktypes.html
+type LinkType uint32
+
+const (
+	LinkTypeNull      LinkType = 0
+	LinkTypeEthernet  LinkType = 1
+	LinkTypeRaw       LinkType = 101
+	LinkTypeLoop      LinkType = 108
+	LinkTypeLinuxSLL  LinkType = 113
+	LinkTypeIPv4      LinkType = 228
+	LinkTypeIPv6      LinkType = 229
+	LinkTypeLinuxSLL2 LinkType = 276
+)
+
+var linkTypeNames = map[LinkType]string{
+	LinkTypeNull:      "NULL",
+	LinkTypeEthernet:  "EN10MB",
+	LinkTypeRaw:       "RAW",
+	LinkTypeLoop:      "LOOP",
+	LinkTypeLinuxSLL:  "LINUX_SLL",
+	LinkTypeIPv4:      "IPV4",
+	LinkTypeIPv6:      "IPV6",
+	LinkTypeLinuxSLL2: "LINUX_SLL2",
+}
+
+func (lt LinkType) String() string {
+	if name, ok := linkTypeNames[lt]; ok {
+		return name
+	}
+	return fmt.Sprintf("LINKTYPE_%d", uint32(lt))
+}
+
+const (
+	sllHeaderLen  = 16
+	sll2HeaderLen = 20
+	nullHeaderLen = 4
+
+	// BSD address family values used by the NULL and LOOP link types;
+	// AF_INET6 differs between platforms.
+	bsdAFInet       = 2
+	bsdAFInet6BSD   = 24
+	bsdAFInet6BSD2  = 28
+	bsdAFInet6Apple = 30
+)
+
+// Returns the network-layer protocol and payload of data, interpreting its
+// link-layer header according to linkType. This gives captures from a TAP
+// (Ethernet), a TUN (raw IP) or the Linux "any" device (SLL) a uniform view.
+func LinkPayload(linkType LinkType, data []byte) (Ethertype, []byte, error) {
+	switch linkType {
+	case LinkTypeEthernet:
+		var frame EthernetFrame
+		if err := frame.Decode(data); err != nil {
+			return Ethertype{}, nil, err
+		}
+		return frame.Ethertype, frame.Payload, nil
+	case LinkTypeRaw:
+		if len(data) < 1 {
+			return Ethertype{}, nil, fmt.Errorf("empty packet")
+		}
+		switch {
+		case IsIPv4(data):
+			return IPv4, data, nil
+		case IsIPv6(data):
+			return IPv6, data, nil
+		}
+		return Ethertype{}, nil, fmt.Errorf("unknown IP version %d", data[0]>>4)
+	case LinkTypeIPv4:
+		return IPv4, data, nil
+	case LinkTypeIPv6:
+		return IPv6, data, nil
+	case LinkTypeNull, LinkTypeLoop:
+		if len(data) < nullHeaderLen {
+			return Ethertype{}, nil, fmt.Errorf("short loopback header (%d bytes)", len(data))
+		}
+		// NULL uses the capturing host's byte order, LOOP is big-endian
+		family := binary.BigEndian.Uint32(data)
+		if linkType == LinkTypeNull && family&0xFFFF == 0 {
+			family = binary.LittleEndian.Uint32(data)
+		}
+		switch family {
+		case bsdAFInet:
+			return IPv4, data[nullHeaderLen:], nil
+		case bsdAFInet6BSD, bsdAFInet6BSD2, bsdAFInet6Apple:
+			return IPv6, data[nullHeaderLen:], nil
+		}
+		return Ethertype{}, nil, fmt.Errorf("unknown address family %d", family)
+	case LinkTypeLinuxSLL:
+		if len(data) < sllHeaderLen {
+			return Ethertype{}, nil, fmt.Errorf("short SLL header (%d bytes)", len(data))
+		}
+		return Ethertype{data[14], data[15]}, data[sllHeaderLen:], nil
+	case LinkTypeLinuxSLL2:
+		if len(data) < sll2HeaderLen {
+			return Ethertype{}, nil, fmt.Errorf("short SLL2 header (%d bytes)", len(data))
+		}
+		return Ethertype{data[0], data[1]}, data[sll2HeaderLen:], nil
+	}
+	return Ethertype{}, nil, fmt.Errorf("unsupported link type %s", linkType)
+}
+
+// Returns the network-layer protocol and payload of the packet.
+func (p *PcapPacket) NetworkPayload() (Ethertype, []byte, error) {
+	return LinkPayload(p.LinkType, p.Data)
+}
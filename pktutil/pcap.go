@@ -10,17 +10,42 @@ import (
 )
 
 type PcapReader struct {
-	file   *os.File
-	reader *bufio.Reader
-	order  binary.ByteOrder
+	closer   io.Closer
+	reader   *bufio.Reader
+	order    binary.ByteOrder
+	nano     bool
+	snaplen  uint32
+	linkType LinkType
+	ng       *PcapngReader
 }
 
 type PcapPacket struct {
 	Timestamp time.Time
 	Truncated bool
 	Data      []byte
+	// Length of the packet on the wire; larger than len(Data) if truncated.
+	Length   int
+	LinkType LinkType
+	// Only set for pcapng captures.
+	InterfaceID int
+	Comments    []string
 }
 
+type PcapWriter struct {
+	writer  io.Writer
+	order   binary.ByteOrder
+	snaplen uint32
+	nano    bool
+}
+
+// Timestamp precision of a pcap file.
+type PcapPrecision int
+
+const (
+	Microsecond PcapPrecision = iota
+	Nanosecond
+)
+
 // Format based on https://wiki.wireshark.org/Development/LibpcapFileFormat
 
 type pcapHeader struct {
@@ -30,7 +55,7 @@ type pcapHeader struct {
 	Zone         int32
 	Sigfigs      uint32
 	Snaplen      uint32
-	Network      linkType
+	Network      LinkType
 }
 
 type pcapPacketHeader struct {
@@ -40,79 +65,193 @@ type pcapPacketHeader struct {
 	OrigLen uint32
 }
 
-type linkType uint32
-
 const (
-	pcapMagic = 0xA1B2C3D4
+	pcapMagic     = 0xA1B2C3D4
+	pcapMagicNano = 0xA1B23C4D
 
-	linkTypeEthernet linkType = 1
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+
+	// largest packet accepted whatever the snaplen in the header says,
+	// matching libpcap
+	pcapMaxSnaplen = 262144
 )
 
 func OpenPcap(fileName string) (*PcapReader, error) {
-	success := false
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if !success {
-			file.Close()
-		}
-	}()
+	pr, err := NewPcapReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	pr.closer = file
+	return pr, nil
+}
 
-	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
-		_, err := file.Seek(0, 0)
-		if err != nil {
-			return nil, err
-		}
-		reader := bufio.NewReader(file)
-		header, err := readHeader(file, order)
+// Creates a PcapReader that reads a pcap or pcapng capture from reader,
+// which need not be seekable.
+func NewPcapReader(reader io.Reader) (*PcapReader, error) {
+	br := bufio.NewReader(reader)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngBlockSHB {
+		ng, err := NewPcapngReader(br)
 		if err != nil {
 			return nil, err
 		}
-		if header != nil {
-			if header.VersionMajor != 2 && header.VersionMinor != 4 {
-				return nil, fmt.Errorf("unsupported version %d.%d", header.VersionMajor, header.VersionMinor)
-			}
-			if header.Network != linkTypeEthernet {
-				return nil, fmt.Errorf("unsupported link type %d", header.Network)
-			}
-			success = true
-			return &PcapReader{file, reader, order}, nil
-		}
+		return &PcapReader{ng: ng}, nil
+	}
+
+	var order binary.ByteOrder
+	var nano bool
+	switch binary.BigEndian.Uint32(magic) {
+	case pcapMagic:
+		order = binary.BigEndian
+	case pcapMagicNano:
+		order, nano = binary.BigEndian, true
+	case swap32(pcapMagic):
+		order = binary.LittleEndian
+	case swap32(pcapMagicNano):
+		order, nano = binary.LittleEndian, true
+	default:
+		return nil, fmt.Errorf("unsupported file format")
 	}
-	return nil, fmt.Errorf("unsupported file format")
-}
 
-func readHeader(reader io.Reader, order binary.ByteOrder) (*pcapHeader, error) {
 	header := pcapHeader{}
-	err := binary.Read(reader, order, &header)
-	if err != nil {
-		return nil, err
+	if err := binary.Read(br, order, &header); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if header.VersionMajor != pcapVersionMajor || header.VersionMinor != pcapVersionMinor {
+		return nil, fmt.Errorf("unsupported version %d.%d", header.VersionMajor, header.VersionMinor)
+	}
+	return &PcapReader{
+		reader:   br,
+		order:    order,
+		nano:     nano,
+		snaplen:  header.Snaplen,
+		linkType: header.Network,
+	}, nil
+}
+
+func swap32(v uint32) uint32 {
+	return v>>24 | (v>>8)&0xFF00 | (v<<8)&0xFF0000 | v<<24
+}
+
+// Returns the maximum captured length of packets, as recorded in the file
+// header or in the first pcapng interface.
+func (pr *PcapReader) Snaplen() uint32 {
+	if pr.ng != nil {
+		if ifcs := pr.ng.Interfaces(); len(ifcs) > 0 {
+			return ifcs[0].Snaplen
+		}
+		return 0
 	}
-	if header.MagicNumber != pcapMagic {
-		return nil, nil
+	return pr.snaplen
+}
+
+// Returns the link type of the capture, or of the first pcapng interface.
+func (pr *PcapReader) LinkType() LinkType {
+	if pr.ng != nil {
+		if ifcs := pr.ng.Interfaces(); len(ifcs) > 0 {
+			return ifcs[0].LinkType
+		}
+		return 0
 	}
-	return &header, nil
+	return pr.linkType
 }
 
+// Closes the file opened by OpenPcap. Readers created with NewPcapReader
+// do not close the underlying reader.
 func (pr *PcapReader) Close() error {
-	return pr.file.Close()
+	if pr.closer == nil {
+		return nil
+	}
+	return pr.closer.Close()
 }
 
 func (pr *PcapReader) Read() (*PcapPacket, error) {
+	if pr.ng != nil {
+		return pr.ng.Read()
+	}
 	header := pcapPacketHeader{}
 	err := binary.Read(pr.reader, pr.order, &header)
 	if err != nil {
 		return nil, err
 	}
 	len := header.InclLen
+	if len > pcapMaxSnaplen {
+		return nil, fmt.Errorf("packet length %d exceeds maximum %d", len, pcapMaxSnaplen)
+	}
 	buff := make([]byte, len)
 	_, err = io.ReadFull(pr.reader, buff)
 	if err != nil {
-		return nil, err
+		return nil, unexpectedEOF(err)
 	}
-	timestamp := time.Unix(int64(header.TsSec), int64(header.TsUsec*1000))
+	nsec := int64(header.TsUsec)
+	if !pr.nano {
+		nsec *= 1000
+	}
+	timestamp := time.Unix(int64(header.TsSec), nsec)
 	totLen := header.OrigLen
-	return &PcapPacket{timestamp, len != totLen, buff}, nil
+	return &PcapPacket{
+		Timestamp: timestamp,
+		Truncated: len != totLen,
+		Data:      buff,
+		Length:    int(totLen),
+		LinkType:  pr.linkType,
+	}, nil
+}
+
+// Creates a PcapWriter that writes to writer, starting with the file
+// header. Packets longer than snaplen are truncated.
+func NewPcapWriter(writer io.Writer, snaplen uint32, linkType LinkType, precision PcapPrecision) (*PcapWriter, error) {
+	magic := uint32(pcapMagic)
+	if precision == Nanosecond {
+		magic = pcapMagicNano
+	}
+	order := binary.LittleEndian
+	header := pcapHeader{
+		MagicNumber:  magic,
+		VersionMajor: pcapVersionMajor,
+		VersionMinor: pcapVersionMinor,
+		Snaplen:      snaplen,
+		Network:      linkType,
+	}
+	err := binary.Write(writer, order, &header)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapWriter{writer, order, snaplen, precision == Nanosecond}, nil
+}
+
+func (pw *PcapWriter) Write(pkt *PcapPacket) error {
+	data := pkt.Data
+	if uint32(len(data)) > pw.snaplen {
+		data = data[:pw.snaplen]
+	}
+	origLen := pkt.Length
+	if origLen < len(pkt.Data) {
+		origLen = len(pkt.Data)
+	}
+	frac := pkt.Timestamp.Nanosecond()
+	if !pw.nano {
+		frac /= 1000
+	}
+	header := pcapPacketHeader{
+		TsSec:   uint32(pkt.Timestamp.Unix()),
+		TsUsec:  uint32(frac),
+		InclLen: uint32(len(data)),
+		OrigLen: uint32(origLen),
+	}
+	err := binary.Write(pw.writer, pw.order, &header)
+	if err != nil {
+		return err
+	}
+	_, err = pw.writer.Write(data)
+	return err
 }
@@ -0,0 +1,118 @@
+package pktutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPcapRoundTrip(t *testing.T) {
+	ts := time.Unix(1600000000, 123456789)
+	tests := []struct {
+		precision PcapPrecision
+		want      time.Time
+	}{
+		{Microsecond, ts.Truncate(time.Microsecond)},
+		{Nanosecond, ts},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w, err := NewPcapWriter(&buf, 8, LinkTypeEthernet, test.precision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+		if err := w.Write(&PcapPacket{Timestamp: ts, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(&PcapPacket{Timestamp: ts, Data: data[:4]}); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewPcapReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Snaplen() != 8 || r.LinkType() != LinkTypeEthernet {
+			t.Errorf("precision %d: snaplen %d, link type %v", test.precision, r.Snaplen(), r.LinkType())
+		}
+		pkt, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pkt.Timestamp.Equal(test.want) || !pkt.Truncated || pkt.Length != 10 || !bytes.Equal(pkt.Data, data[:8]) {
+			t.Errorf("precision %d: first packet %+v", test.precision, pkt)
+		}
+		pkt, err = r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Truncated || pkt.Length != 4 || !bytes.Equal(pkt.Data, data[:4]) {
+			t.Errorf("precision %d: second packet %+v", test.precision, pkt)
+		}
+		if _, err := r.Read(); err != io.EOF {
+			t.Errorf("precision %d: read past end: %v", test.precision, err)
+		}
+	}
+}
+
+// Builds a big-endian capture, the opposite of what PcapWriter produces.
+func bigEndianPcap(magic, snaplen, inclLen uint32, data []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &pcapHeader{
+		MagicNumber:  magic,
+		VersionMajor: pcapVersionMajor,
+		VersionMinor: pcapVersionMinor,
+		Snaplen:      snaplen,
+		Network:      LinkTypeRaw,
+	})
+	binary.Write(&buf, binary.BigEndian, &pcapPacketHeader{
+		TsSec:   1600000000,
+		TsUsec:  500,
+		InclLen: inclLen,
+		OrigLen: inclLen,
+	})
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestPcapSwappedMagic(t *testing.T) {
+	tests := []struct {
+		magic uint32
+		want  time.Time
+	}{
+		{pcapMagic, time.Unix(1600000000, 500000)},
+		{pcapMagicNano, time.Unix(1600000000, 500)},
+	}
+	for _, test := range tests {
+		data := []byte{0x45, 0, 0, 4}
+		r, err := NewPcapReader(bytes.NewReader(bigEndianPcap(test.magic, 65535, 4, data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Snaplen() != 65535 || r.LinkType() != LinkTypeRaw {
+			t.Errorf("magic %#x: snaplen %d, link type %v", test.magic, r.Snaplen(), r.LinkType())
+		}
+		pkt, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pkt.Timestamp.Equal(test.want) || !bytes.Equal(pkt.Data, data) {
+			t.Errorf("magic %#x: packet %+v", test.magic, pkt)
+		}
+	}
+}
+
+func TestPcapOversizedRecord(t *testing.T) {
+	// the header's snaplen must not raise the limit on record lengths
+	capture := bigEndianPcap(pcapMagic, 0xFFFFFFFF, 0xFFFFFFF0, nil)
+	r, err := NewPcapReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err == nil {
+		t.Fatal("oversized record accepted")
+	}
+}
@@ -0,0 +1,541 @@
+package pktutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// Format based on https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+
+type PcapngReader struct {
+	reader     *bufio.Reader
+	order      binary.ByteOrder
+	comments   []string
+	interfaces []*PcapngInterface
+	names      map[string][]string
+}
+
+type PcapngWriter struct {
+	writer     io.Writer
+	order      binary.ByteOrder
+	interfaces []*PcapngInterface
+}
+
+// Describes a capture interface from an Interface Description Block.
+type PcapngInterface struct {
+	LinkType    LinkType
+	Snaplen     uint32
+	Name        string
+	Description string
+	Comments    []string
+
+	// timestamp units per second, and offset in seconds
+	resolution uint64
+	offset     int64
+}
+
+const (
+	pcapngBlockSHB = 0x0A0D0D0A
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockSPB = 0x00000003
+	pcapngBlockNRB = 0x00000004
+	pcapngBlockEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEnd     = 0
+	pcapngOptComment = 1
+
+	pcapngOptIfName        = 2
+	pcapngOptIfDescription = 3
+	pcapngOptIfTsresol     = 9
+	pcapngOptIfTsoffset    = 14
+
+	pcapngNRBEnd  = 0
+	pcapngNRBIPv4 = 1
+	pcapngNRBIPv6 = 2
+
+	// upper bound on block sizes, to reject corrupt lengths before
+	// allocating buffers for them
+	pcapngMaxBlockLen = 16 << 20
+)
+
+// Creates a PcapngReader that reads from reader, starting with its Section
+// Header Block.
+func NewPcapngReader(reader io.Reader) (*PcapngReader, error) {
+	r := &PcapngReader{
+		reader: bufio.NewReader(reader),
+		names:  make(map[string][]string),
+	}
+	blockType, body, err := r.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if blockType != pcapngBlockSHB {
+		return nil, fmt.Errorf("missing section header block")
+	}
+	if err := r.parseSHB(body); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Returns the interfaces described so far in the current section.
+func (r *PcapngReader) Interfaces() []*PcapngInterface {
+	return r.interfaces
+}
+
+// Returns the comments on the current section.
+func (r *PcapngReader) Comments() []string {
+	return r.comments
+}
+
+// Returns the names recorded for ip in Name Resolution Blocks read so far.
+func (r *PcapngReader) LookupName(ip net.IP) []string {
+	return r.names[ip.String()]
+}
+
+// Returns the next packet, processing any non-packet blocks before it.
+func (r *PcapngReader) Read() (*PcapPacket, error) {
+	for {
+		blockType, body, err := r.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch blockType {
+		case pcapngBlockSHB:
+			err = r.parseSHB(body)
+		case pcapngBlockIDB:
+			err = r.parseIDB(body)
+		case pcapngBlockNRB:
+			err = r.parseNRB(body)
+		case pcapngBlockEPB:
+			return r.parseEPB(body)
+		case pcapngBlockSPB:
+			return r.parseSPB(body)
+		}
+		// other block types are skipped
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reads a block, returning its type and body without the trailing length.
+func (r *PcapngReader) readBlock() (uint32, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return 0, nil, err
+	}
+	order := r.order
+	if binary.BigEndian.Uint32(header) == pcapngBlockSHB {
+		// a new section may change the byte order
+		magic, err := r.reader.Peek(4)
+		if err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		switch binary.BigEndian.Uint32(magic) {
+		case pcapngByteOrderMagic:
+			order = binary.BigEndian
+		case 0x4D3C2B1A:
+			order = binary.LittleEndian
+		default:
+			return 0, nil, fmt.Errorf("invalid byte-order magic %x", magic)
+		}
+		r.order = order
+	}
+	if order == nil {
+		return 0, nil, fmt.Errorf("missing section header block")
+	}
+	blockType := order.Uint32(header[0:])
+	totalLen := order.Uint32(header[4:])
+	if totalLen < 12 || totalLen%4 != 0 || totalLen > pcapngMaxBlockLen {
+		return 0, nil, fmt.Errorf("invalid block length %d", totalLen)
+	}
+	body := make([]byte, totalLen-8)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	trailer := body[len(body)-4:]
+	if order.Uint32(trailer) != totalLen {
+		return 0, nil, fmt.Errorf("mismatched block length")
+	}
+	return blockType, body[:len(body)-4], nil
+}
+
+func (r *PcapngReader) parseSHB(body []byte) error {
+	if len(body) < 16 {
+		return fmt.Errorf("short section header block")
+	}
+	major := r.order.Uint16(body[4:])
+	if major != 1 {
+		return fmt.Errorf("unsupported version %d.%d", major, r.order.Uint16(body[6:]))
+	}
+	r.interfaces = nil
+	r.comments = nil
+	return r.parseOptions(body[16:], func(code uint16, value []byte) {
+		if code == pcapngOptComment {
+			r.comments = append(r.comments, string(value))
+		}
+	})
+}
+
+func (r *PcapngReader) parseIDB(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("short interface description block")
+	}
+	ifc := &PcapngInterface{
+		LinkType:   LinkType(r.order.Uint16(body[0:])),
+		Snaplen:    r.order.Uint32(body[4:]),
+		resolution: 1000000,
+	}
+	err := r.parseOptions(body[8:], func(code uint16, value []byte) {
+		switch code {
+		case pcapngOptComment:
+			ifc.Comments = append(ifc.Comments, string(value))
+		case pcapngOptIfName:
+			ifc.Name = string(value)
+		case pcapngOptIfDescription:
+			ifc.Description = string(value)
+		case pcapngOptIfTsresol:
+			if len(value) >= 1 {
+				ifc.resolution = tsresol(value[0])
+			}
+		case pcapngOptIfTsoffset:
+			if len(value) >= 8 {
+				ifc.offset = int64(r.order.Uint64(value))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	r.interfaces = append(r.interfaces, ifc)
+	return nil
+}
+
+// Converts an if_tsresol value to timestamp units per second.
+func tsresol(v byte) uint64 {
+	exp := uint64(v & 0x7F)
+	base := uint64(10)
+	if v&0x80 != 0 {
+		base = 2
+	}
+	res := uint64(1)
+	for i := uint64(0); i < exp; i++ {
+		if res > math.MaxUint64/base {
+			break
+		}
+		res *= base
+	}
+	return res
+}
+
+func (r *PcapngReader) parseNRB(body []byte) error {
+	for len(body) >= 4 {
+		recordType := r.order.Uint16(body[0:])
+		recordLen := int(r.order.Uint16(body[2:]))
+		body = body[4:]
+		if recordType == pcapngNRBEnd {
+			return r.parseOptions(body, func(code uint16, value []byte) {})
+		}
+		padded := pad4(recordLen)
+		if padded > len(body) {
+			return fmt.Errorf("truncated name resolution record")
+		}
+		value := body[:recordLen]
+		body = body[padded:]
+
+		var addrLen int
+		switch recordType {
+		case pcapngNRBIPv4:
+			addrLen = net.IPv4len
+		case pcapngNRBIPv6:
+			addrLen = net.IPv6len
+		default:
+			continue
+		}
+		if len(value) < addrLen {
+			return fmt.Errorf("short name resolution record")
+		}
+		key := net.IP(value[:addrLen]).String()
+		for _, name := range bytes.Split(value[addrLen:], []byte{0}) {
+			if len(name) > 0 {
+				r.names[key] = append(r.names[key], string(name))
+			}
+		}
+	}
+	return nil
+}
+
+func (r *PcapngReader) parseEPB(body []byte) (*PcapPacket, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("short enhanced packet block")
+	}
+	id := r.order.Uint32(body[0:])
+	if int(id) >= len(r.interfaces) {
+		return nil, fmt.Errorf("unknown interface %d", id)
+	}
+	ifc := r.interfaces[id]
+	ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+	capLen := r.order.Uint32(body[12:])
+	origLen := r.order.Uint32(body[16:])
+	body = body[20:]
+	if uint64(pad4(int(capLen))) > uint64(len(body)) {
+		return nil, fmt.Errorf("packet length %d exceeds block", capLen)
+	}
+	data := body[:capLen]
+	pkt := &PcapPacket{
+		Timestamp:   ifc.timestamp(ts),
+		Truncated:   capLen < origLen,
+		Data:        data,
+		Length:      int(origLen),
+		InterfaceID: int(id),
+		LinkType:    ifc.LinkType,
+	}
+	err := r.parseOptions(body[pad4(int(capLen)):], func(code uint16, value []byte) {
+		if code == pcapngOptComment {
+			pkt.Comments = append(pkt.Comments, string(value))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func (r *PcapngReader) parseSPB(body []byte) (*PcapPacket, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("short simple packet block")
+	}
+	if len(r.interfaces) == 0 {
+		return nil, fmt.Errorf("simple packet block without interface")
+	}
+	ifc := r.interfaces[0]
+	origLen := r.order.Uint32(body[0:])
+	capLen := origLen
+	if ifc.Snaplen > 0 && capLen > ifc.Snaplen {
+		capLen = ifc.Snaplen
+	}
+	body = body[4:]
+	if uint64(capLen) > uint64(len(body)) {
+		capLen = uint32(len(body))
+	}
+	return &PcapPacket{
+		Truncated: capLen < origLen,
+		Data:      body[:capLen],
+		Length:    int(origLen),
+		LinkType:  ifc.LinkType,
+	}, nil
+}
+
+func (r *PcapngReader) parseOptions(b []byte, fn func(code uint16, value []byte)) error {
+	for len(b) >= 4 {
+		code := r.order.Uint16(b[0:])
+		length := int(r.order.Uint16(b[2:]))
+		b = b[4:]
+		if code == pcapngOptEnd {
+			return nil
+		}
+		if pad4(length) > len(b) {
+			return fmt.Errorf("truncated option %d", code)
+		}
+		fn(code, b[:length])
+		b = b[pad4(length):]
+	}
+	return nil
+}
+
+func (ifc *PcapngInterface) timestamp(ts uint64) time.Time {
+	sec := ts / ifc.resolution
+	frac := ts % ifc.resolution
+	// frac < resolution, so the 128-bit quotient fits in 64 bits
+	hi, lo := bits.Mul64(frac, 1000000000)
+	nsec, _ := bits.Div64(hi, lo, ifc.resolution)
+	return time.Unix(int64(sec)+ifc.offset, int64(nsec))
+}
+
+// Creates a PcapngWriter that writes to writer, starting with a Section
+// Header Block carrying the given comments.
+func NewPcapngWriter(writer io.Writer, comments ...string) (*PcapngWriter, error) {
+	w := &PcapngWriter{writer: writer, order: binary.LittleEndian}
+	body := make([]byte, 16)
+	w.order.PutUint32(body[0:], pcapngByteOrderMagic)
+	w.order.PutUint16(body[4:], 1)
+	w.order.PutUint16(body[6:], 0)
+	// section length is not specified
+	w.order.PutUint64(body[8:], math.MaxUint64)
+	body = w.appendComments(body, comments)
+	body = w.endOptions(body, 16)
+	if err := w.writeBlock(pcapngBlockSHB, body); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Writes an Interface Description Block and returns the ID to use for
+// packets captured on it.
+func (w *PcapngWriter) AddInterface(ifc *PcapngInterface, precision PcapPrecision) (int, error) {
+	body := make([]byte, 8)
+	w.order.PutUint16(body[0:], uint16(ifc.LinkType))
+	w.order.PutUint32(body[4:], ifc.Snaplen)
+	if ifc.Name != "" {
+		body = w.appendOption(body, pcapngOptIfName, []byte(ifc.Name))
+	}
+	if ifc.Description != "" {
+		body = w.appendOption(body, pcapngOptIfDescription, []byte(ifc.Description))
+	}
+	resolution := uint64(1000000)
+	if precision == Nanosecond {
+		resolution = 1000000000
+		body = w.appendOption(body, pcapngOptIfTsresol, []byte{9})
+	}
+	body = w.appendComments(body, ifc.Comments)
+	body = w.endOptions(body, 8)
+	if err := w.writeBlock(pcapngBlockIDB, body); err != nil {
+		return 0, err
+	}
+	written := *ifc
+	written.resolution = resolution
+	w.interfaces = append(w.interfaces, &written)
+	return len(w.interfaces) - 1, nil
+}
+
+// Writes pkt as an Enhanced Packet Block on interface pkt.InterfaceID,
+// including any comments.
+func (w *PcapngWriter) Write(pkt *PcapPacket) error {
+	if pkt.InterfaceID < 0 || pkt.InterfaceID >= len(w.interfaces) {
+		return fmt.Errorf("unknown interface %d", pkt.InterfaceID)
+	}
+	ifc := w.interfaces[pkt.InterfaceID]
+	data, origLen := ifc.truncate(pkt)
+
+	t := pkt.Timestamp.UnixNano()
+	var ts uint64
+	if ifc.resolution == 1000000000 {
+		ts = uint64(t)
+	} else {
+		ts = uint64(t / 1000)
+	}
+
+	body := make([]byte, 20, 20+pad4(len(data))+16)
+	w.order.PutUint32(body[0:], uint32(pkt.InterfaceID))
+	w.order.PutUint32(body[4:], uint32(ts>>32))
+	w.order.PutUint32(body[8:], uint32(ts))
+	w.order.PutUint32(body[12:], uint32(len(data)))
+	w.order.PutUint32(body[16:], uint32(origLen))
+	body = appendPadded(body, data)
+	fixed := len(body)
+	body = w.appendComments(body, pkt.Comments)
+	body = w.endOptions(body, fixed)
+	return w.writeBlock(pcapngBlockEPB, body)
+}
+
+// Writes pkt as a Simple Packet Block, which carries neither a timestamp
+// nor comments and always refers to the first interface.
+func (w *PcapngWriter) WriteSimple(pkt *PcapPacket) error {
+	if len(w.interfaces) == 0 {
+		return fmt.Errorf("no interface for simple packet block")
+	}
+	data, origLen := w.interfaces[0].truncate(pkt)
+	body := make([]byte, 4, 4+pad4(len(data)))
+	w.order.PutUint32(body[0:], uint32(origLen))
+	body = appendPadded(body, data)
+	return w.writeBlock(pcapngBlockSPB, body)
+}
+
+// Writes a Name Resolution Block associating names with ip.
+func (w *PcapngWriter) WriteNameResolution(ip net.IP, names ...string) error {
+	recordType := uint16(pcapngNRBIPv6)
+	addr := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		recordType = pcapngNRBIPv4
+		addr = ip4
+	}
+	if addr == nil {
+		return fmt.Errorf("invalid address %s", ip)
+	}
+	value := append([]byte{}, addr...)
+	for _, name := range names {
+		value = append(value, name...)
+		value = append(value, 0)
+	}
+	body := w.appendOption(nil, recordType, value)
+	body = w.appendOption(body, pcapngNRBEnd, nil)
+	return w.writeBlock(pcapngBlockNRB, body)
+}
+
+func (ifc *PcapngInterface) truncate(pkt *PcapPacket) ([]byte, int) {
+	data := pkt.Data
+	if ifc.Snaplen > 0 && uint32(len(data)) > ifc.Snaplen {
+		data = data[:ifc.Snaplen]
+	}
+	origLen := pkt.Length
+	if origLen < len(pkt.Data) {
+		origLen = len(pkt.Data)
+	}
+	return data, origLen
+}
+
+func (w *PcapngWriter) appendComments(b []byte, comments []string) []byte {
+	for _, comment := range comments {
+		b = w.appendOption(b, pcapngOptComment, []byte(comment))
+	}
+	return b
+}
+
+// Terminates the options following the first fixed bytes of a block body,
+// if there are any.
+func (w *PcapngWriter) endOptions(b []byte, fixed int) []byte {
+	if len(b) == fixed {
+		return b
+	}
+	return w.appendOption(b, pcapngOptEnd, nil)
+}
+
+func (w *PcapngWriter) appendOption(b []byte, code uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	w.order.PutUint16(header[0:], code)
+	w.order.PutUint16(header[2:], uint16(len(value)))
+	b = append(b, header...)
+	return appendPadded(b, value)
+}
+
+func (w *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	totalLen := uint32(12 + len(body))
+	block := make([]byte, 0, totalLen)
+	header := make([]byte, 8)
+	w.order.PutUint32(header[0:], blockType)
+	w.order.PutUint32(header[4:], totalLen)
+	block = append(block, header...)
+	block = append(block, body...)
+	block = append(block, header[4:]...)
+	_, err := w.writer.Write(block)
+	return err
+}
+
+func appendPadded(b []byte, value []byte) []byte {
+	b = append(b, value...)
+	for i := len(value); i < pad4(len(value)); i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package pktutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPcapngRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapngWriter(&buf, "section")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap := &PcapngInterface{LinkType: LinkTypeEthernet, Snaplen: 64, Name: "tap0"}
+	if _, err := w.AddInterface(tap, Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	tun := &PcapngInterface{LinkType: LinkTypeRaw, Description: "tun", Comments: []string{"raw"}}
+	if _, err := w.AddInterface(tun, Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteNameResolution(net.ParseIP("10.0.0.1"), "host", "alias"); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Unix(1600000000, 123456789)
+	frame := bytes.Repeat([]byte{0xAB}, 100)
+	packets := []*PcapPacket{
+		{Timestamp: ts, Data: frame, InterfaceID: 0, Comments: []string{"first", "second"}},
+		{Timestamp: ts, Data: []byte{0x45, 0, 0, 20}, InterfaceID: 1},
+	}
+	for _, pkt := range packets {
+		if err := w.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteSimple(&PcapPacket{Data: frame[:10]}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewPcapngReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Comments(), []string{"section"}) {
+		t.Errorf("section comments %q", r.Comments())
+	}
+
+	pkt, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pkt.Timestamp.Equal(ts) || !pkt.Truncated || pkt.Length != 100 || !bytes.Equal(pkt.Data, frame[:64]) {
+		t.Errorf("first packet %+v", pkt)
+	}
+	if !reflect.DeepEqual(pkt.Comments, []string{"first", "second"}) || pkt.LinkType != LinkTypeEthernet {
+		t.Errorf("first packet comments %q, link type %v", pkt.Comments, pkt.LinkType)
+	}
+
+	pkt, err = r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pkt.Timestamp.Equal(ts.Truncate(time.Microsecond)) || pkt.InterfaceID != 1 || pkt.Comments != nil || pkt.LinkType != LinkTypeRaw {
+		t.Errorf("second packet %+v", pkt)
+	}
+
+	pkt, err = r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pkt.Data, frame[:10]) {
+		t.Errorf("simple packet %x", pkt.Data)
+	}
+
+	ifcs := r.Interfaces()
+	if len(ifcs) != 2 || ifcs[0].Name != "tap0" || ifcs[0].Snaplen != 64 ||
+		ifcs[1].Description != "tun" || !reflect.DeepEqual(ifcs[1].Comments, []string{"raw"}) {
+		t.Errorf("interfaces %+v", ifcs)
+	}
+	if names := r.LookupName(net.ParseIP("10.0.0.1")); !reflect.DeepEqual(names, []string{"host", "alias"}) {
+		t.Errorf("names %q", names)
+	}
+}
+
+func TestPcapngEndOfOptions(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AddInterface(&PcapngInterface{LinkType: LinkTypeEthernet}, Microsecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AddInterface(&PcapngInterface{LinkType: LinkTypeEthernet, Name: "tap0"}, Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&PcapPacket{Data: []byte{1, 2, 3, 4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// block bodies and whether their options must end with opt_endofopt
+	want := []struct {
+		blockType uint32
+		body      int
+		end       bool
+	}{
+		{pcapngBlockSHB, 16, false},
+		{pcapngBlockIDB, 8, false},
+		{pcapngBlockIDB, 8 + 8 + 8 + 4, true},
+		{pcapngBlockEPB, 24, false},
+	}
+	b := buf.Bytes()
+	for i, block := range want {
+		if len(b) < 12 {
+			t.Fatalf("block %d missing", i)
+		}
+		blockType := binary.LittleEndian.Uint32(b)
+		length := int(binary.LittleEndian.Uint32(b[4:]))
+		body := b[8 : length-4]
+		if blockType != block.blockType || len(body) != block.body {
+			t.Errorf("block %d: type %#x with %d-byte body, want %#x with %d", i, blockType, len(body), block.blockType, block.body)
+		}
+		if block.end && !bytes.Equal(body[len(body)-4:], []byte{0, 0, 0, 0}) {
+			t.Errorf("block %d: options not terminated", i)
+		}
+		b = b[length:]
+	}
+}
+
+func TestPcapngTimestampResolution(t *testing.T) {
+	tests := []struct {
+		tsresol byte
+		ts      uint64
+		want    time.Time
+	}{
+		{6, 1600000000123456, time.Unix(1600000000, 123456000)},
+		{9, 1600000000123456789, time.Unix(1600000000, 123456789)},
+		{12, 5123456789123, time.Unix(5, 123456789)},
+		// 2^-40 seconds, which is not a whole number of nanoseconds
+		{0x80 | 40, 5<<40 | 1<<39, time.Unix(5, 500000000)},
+		{0x80 | 40, 5<<40 | (1<<40 - 1), time.Unix(5, 999999999)},
+		{0x80 | 40, 5<<40 | 1, time.Unix(5, 0)},
+		{0x80 | 63, 1<<63 + 1<<62, time.Unix(1, 500000000)},
+	}
+	for _, tt := range tests {
+		ifc := &PcapngInterface{resolution: tsresol(tt.tsresol)}
+		if got := ifc.timestamp(tt.ts); !got.Equal(tt.want) {
+			t.Errorf("tsresol %#x, timestamp %d: got %s, want %s", tt.tsresol, tt.ts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults for NewReassembler.
+const (
+	DefaultReassemblyTimeout  = 30 * time.Second
+	DefaultReassemblyMaxBytes = 4 << 20
+)
+
+// Reassembler collects IPv4 and IPv6 fragments and returns the datagrams
+// they form. Fragments are grouped by source, destination, protocol and
+// identification for IPv4, and by source, destination and identification
+// for IPv6. It is safe for concurrent use.
+//
+// A datagram with overlapping fragments is dropped, as RFC 5722 requires
+// for IPv6, so that overlaps cannot be used to slip data past filters;
+// exact duplicates are ignored.
+type Reassembler struct {
+	timeout  time.Duration
+	maxBytes int
+
+	mu        sync.Mutex
+	datagrams map[fragmentKey]*datagram
+	bytes     int
+}
+
+type fragmentKey struct {
+	src, dst [16]byte
+	protocol IPProtocol
+	id       uint32
+	v6       bool
+}
+
+type datagram struct {
+	key     fragmentKey
+	expires time.Time
+	// Header of the first fragment, or nil until it arrives.
+	header []byte
+	// Offset of the next header field to rewrite in an IPv6 header.
+	nextPos    int
+	nextHeader IPProtocol
+	// Length of the reassembled payload, or -1 until the last fragment
+	// arrives.
+	length    int
+	fragments []fragmentData
+	bytes     int
+}
+
+type fragmentData struct {
+	offset int
+	data   []byte
+}
+
+// Creates a Reassembler that drops incomplete datagrams after timeout and
+// holds at most maxBytes of fragment headers and data, evicting the oldest
+// datagrams when the limit is reached.
+func NewReassembler(timeout time.Duration, maxBytes int) *Reassembler {
+	return &Reassembler{
+		timeout:   timeout,
+		maxBytes:  maxBytes,
+		datagrams: make(map[fragmentKey]*datagram),
+	}
+}
+
+// Adds an IPv4 or IPv6 packet. Packets that are not fragments are returned
+// as they are; fragments return nil until they complete a datagram, which
+// is then returned as a new packet.
+func (r *Reassembler) Add(packet []byte) ([]byte, error) {
+	if len(packet) > 0 && IsIPv4(packet) {
+		return r.addIPv4(packet)
+	}
+	return r.addIPv6(packet)
+}
+
+func (r *Reassembler) addIPv4(packet []byte) ([]byte, error) {
+	var h IPv4Header
+	if err := h.Decode(packet); err != nil {
+		return nil, err
+	}
+	more := h.Flags&IPv4FlagMF != 0
+	if !more && h.FragmentOffset == 0 {
+		return packet, nil
+	}
+	key := fragmentKey{protocol: h.Protocol, id: uint32(h.Identification)}
+	copy(key.src[:], h.Source.To16())
+	copy(key.dst[:], h.Destination.To16())
+	var header []byte
+	if h.FragmentOffset == 0 {
+		header = packet[:int(h.IHL)*4]
+	}
+	return r.add(key, header, 0, 0, int(h.FragmentOffset)*8, more, h.Payload)
+}
+
+func (r *Reassembler) addIPv6(packet []byte) ([]byte, error) {
+	var h IPv6Header
+	if err := h.Decode(packet); err != nil {
+		return nil, err
+	}
+	nextPos := 6
+	w := NewIPv6ExtensionWalker(packet)
+	for w.Next() {
+		hdr := w.Header()
+		if hdr.Protocol != IPv6_Frag {
+			nextPos = hdr.Offset
+			continue
+		}
+		field := binary.BigEndian.Uint16(hdr.Data[2:])
+		offset := int(field &^ 7)
+		more := field&1 != 0
+		key := fragmentKey{id: binary.BigEndian.Uint32(hdr.Data[4:]), v6: true}
+		copy(key.src[:], h.Source)
+		copy(key.dst[:], h.Destination)
+		var header []byte
+		if offset == 0 {
+			header = packet[:hdr.Offset]
+		}
+		return r.add(key, header, nextPos, hdr.NextHeader, offset, more, packet[hdr.Offset+8:40+int(h.PayloadLength)])
+	}
+	if err := w.Err(); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (r *Reassembler) add(key fragmentKey, header []byte, nextPos int, nextHeader IPProtocol, offset int, more bool, data []byte) ([]byte, error) {
+	if more && len(data)%8 != 0 {
+		return nil, fmt.Errorf("reassembly: %w: fragment length %d not a multiple of 8", ErrMalformed, len(data))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.expire(now)
+
+	d, ok := r.datagrams[key]
+	if !ok {
+		d = &datagram{key: key, expires: now.Add(r.timeout), length: -1}
+		r.datagrams[key] = d
+	}
+	end := offset + len(data)
+	if !more {
+		if d.length >= 0 && d.length != end {
+			r.drop(d)
+			return nil, fmt.Errorf("reassembly: %w: conflicting datagram lengths", ErrMalformed)
+		}
+		d.length = end
+	}
+
+	// find where the fragment goes, rejecting overlaps
+	i := sort.Search(len(d.fragments), func(i int) bool {
+		return d.fragments[i].offset >= offset
+	})
+	if i < len(d.fragments) && d.fragments[i].offset == offset && len(d.fragments[i].data) == len(data) {
+		// duplicate
+		return nil, nil
+	}
+	if i > 0 && d.fragments[i-1].offset+len(d.fragments[i-1].data) > offset ||
+		i < len(d.fragments) && d.fragments[i].offset < end ||
+		d.length >= 0 && end > d.length {
+		r.drop(d)
+		return nil, fmt.Errorf("reassembly: %w: overlapping fragments", ErrMalformed)
+	}
+
+	// the reassembled length must fit the header's 16-bit length field,
+	// which for IPv6 excludes the fixed header but not extension headers
+	newHeader := header != nil && d.header == nil
+	headerLen := len(d.header)
+	if newHeader {
+		headerLen = len(header)
+	}
+	last := end
+	if d.length >= 0 {
+		last = d.length
+	} else if n := len(d.fragments); n > 0 && d.fragments[n-1].offset+len(d.fragments[n-1].data) > last {
+		last = d.fragments[n-1].offset + len(d.fragments[n-1].data)
+	}
+	if max := d.maxLength(headerLen); last > max {
+		r.drop(d)
+		return nil, fmt.Errorf("reassembly: %w: datagram payload of %d bytes exceeds %d", ErrMalformed, last, max)
+	}
+
+	size := len(data)
+	if newHeader {
+		size += len(header)
+	}
+	for r.bytes+size > r.maxBytes && len(r.datagrams) > 1 {
+		r.evictOldest(d)
+	}
+	if r.bytes+size > r.maxBytes {
+		r.drop(d)
+		return nil, fmt.Errorf("reassembly: %w: datagram exceeds %d bytes", ErrUnsupported, r.maxBytes)
+	}
+	if newHeader {
+		d.header = append([]byte(nil), header...)
+		d.nextPos = nextPos
+		d.nextHeader = nextHeader
+	}
+	d.fragments = append(d.fragments, fragmentData{})
+	copy(d.fragments[i+1:], d.fragments[i:])
+	d.fragments[i] = fragmentData{offset: offset, data: append([]byte(nil), data...)}
+	d.bytes += size
+	r.bytes += size
+
+	if !d.complete() {
+		return nil, nil
+	}
+	r.drop(d)
+	return d.assemble(), nil
+}
+
+// Drops datagrams that have timed out. Add does this itself, so calling
+// Expire only frees memory sooner.
+func (r *Reassembler) Expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire(time.Now())
+}
+
+// Returns the number of incomplete datagrams and the bytes they hold.
+func (r *Reassembler) Pending() (datagrams, bytes int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.datagrams), r.bytes
+}
+
+func (r *Reassembler) expire(now time.Time) {
+	for _, d := range r.datagrams {
+		if now.After(d.expires) {
+			r.drop(d)
+		}
+	}
+}
+
+// Drops the datagram expiring first, other than keep.
+func (r *Reassembler) evictOldest(keep *datagram) {
+	var oldest *datagram
+	for _, d := range r.datagrams {
+		if d != keep && (oldest == nil || d.expires.Before(oldest.expires)) {
+			oldest = d
+		}
+	}
+	r.drop(oldest)
+}
+
+func (r *Reassembler) drop(d *datagram) {
+	delete(r.datagrams, d.key)
+	r.bytes -= d.bytes
+}
+
+func (d *datagram) complete() bool {
+	if d.header == nil || d.length < 0 {
+		return false
+	}
+	pos := 0
+	for _, f := range d.fragments {
+		if f.offset != pos {
+			return false
+		}
+		pos += len(f.data)
+	}
+	return pos == d.length
+}
+
+// Returns the longest payload a datagram whose first fragment has a
+// header of headerLen bytes can carry; the smallest header is assumed while
+// it is unknown.
+func (d *datagram) maxLength(headerLen int) int {
+	if d.key.v6 {
+		if headerLen < 40 {
+			headerLen = 40
+		}
+		return 65535 - (headerLen - 40)
+	}
+	if headerLen < 20 {
+		headerLen = 20
+	}
+	return 65535 - headerLen
+}
+
+func (d *datagram) assemble() []byte {
+	packet := make([]byte, len(d.header)+d.length)
+	copy(packet, d.header)
+	for _, f := range d.fragments {
+		copy(packet[len(d.header)+f.offset:], f.data)
+	}
+	if d.key.v6 {
+		packet[d.nextPos] = byte(d.nextHeader)
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)-40))
+		return packet
+	}
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[6] &^= 0x3F
+	packet[7] = 0
+	SetIPv4Checksum(packet)
+	return packet
+}
@@ -0,0 +1,233 @@
+package pktutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testDatagram(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+// Builds an IPv4 fragment carrying data at offset bytes into the datagram,
+// with a header of 20+len(options) bytes.
+func testIPv4Fragment(t *testing.T, id uint16, offset int, more bool, data, options []byte) []byte {
+	h := testIPv4("10.0.0.1", "10.0.0.2")
+	h.Identification = id
+	h.FragmentOffset = uint16(offset / 8)
+	h.Protocol = UDP
+	h.Options = options
+	if more {
+		h.Flags = IPv4FlagMF
+	}
+	return mustSerialize(t, h, Payload(data))
+}
+
+// Builds an IPv6 fragment carrying data at offset bytes into the fragmentable
+// part, preceded by an 8-byte hop-by-hop options header if hopByHop is set.
+func testIPv6Fragment(t *testing.T, id uint32, offset int, more, hopByHop bool, data []byte) []byte {
+	h := testIPv6("fd00::1", "fd00::2")
+	h.NextHeader = IPv6_Frag
+	var ext []byte
+	if hopByHop {
+		h.NextHeader = HOPOPT
+		// a PadN option filling the header
+		ext = []byte{byte(IPv6_Frag), 0, 1, 4, 0, 0, 0, 0}
+	}
+	frag := make([]byte, 8)
+	frag[0] = byte(UDP)
+	field := uint16(offset)
+	if more {
+		field |= 1
+	}
+	binary.BigEndian.PutUint16(frag[2:], field)
+	binary.BigEndian.PutUint32(frag[4:], id)
+	ext = append(append(ext, frag...), data...)
+	return mustSerialize(t, h, Payload(ext))
+}
+
+func TestFragmentReassemble(t *testing.T) {
+	v4 := testIPv4("10.0.0.1", "10.0.0.2")
+	v4.Identification = 0x1234
+	// NOPs are not copied into later fragments, so only the first has a
+	// 24-byte header
+	v4.Options = []byte{1, 1, 1, 1}
+	v6 := testIPv6("fd00::1", "fd00::2")
+	tests := []struct {
+		name   string
+		mtu    int
+		packet []byte
+	}{
+		{"ipv4", 576, mustSerialize(t, v4, &UDPHeader{SourcePort: 1000, DestinationPort: 2000}, Payload(testDatagram(3000)))},
+		{"ipv6", MinIPv6MTU, mustSerialize(t, v6, &UDPHeader{SourcePort: 1000, DestinationPort: 2000}, Payload(testDatagram(3000)))},
+	}
+	for _, test := range tests {
+		fragments, err := NewFragmenter(test.mtu, nil).Fragment(test.packet)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(fragments) < 3 {
+			t.Fatalf("%s: %d fragments", test.name, len(fragments))
+		}
+
+		// out of order, with every fragment but the one completing the
+		// datagram delivered twice
+		r := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMaxBytes)
+		var result []byte
+		for i := len(fragments) - 1; i >= 0; i-- {
+			for j := 0; j < 2 && (j == 0 || i > 0); j++ {
+				if len(fragments[i]) > test.mtu {
+					t.Errorf("%s: fragment of %d bytes", test.name, len(fragments[i]))
+				}
+				p, err := r.Add(fragments[i])
+				if err != nil {
+					t.Fatalf("%s: fragment %d: %v", test.name, i, err)
+				}
+				if p != nil {
+					if result != nil {
+						t.Fatalf("%s: datagram returned twice", test.name)
+					}
+					result = p
+				}
+			}
+		}
+		if !bytes.Equal(result, test.packet) {
+			t.Errorf("%s: reassembled\n%x\nwant\n%x", test.name, result, test.packet)
+		}
+		if n, b := r.Pending(); n != 0 || b != 0 {
+			t.Errorf("%s: %d datagrams and %d bytes pending", test.name, n, b)
+		}
+
+		// packets that are not fragments pass through
+		if p, err := r.Add(test.packet); err != nil || !bytes.Equal(p, test.packet) {
+			t.Errorf("%s: unfragmented packet: %v", test.name, err)
+		}
+	}
+}
+
+func TestReassembleOverlap(t *testing.T) {
+	r := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMaxBytes)
+	data := testDatagram(32)
+	if _, err := r.Add(testIPv4Fragment(t, 1, 0, true, data[:16], nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(testIPv4Fragment(t, 1, 8, true, data[8:24], nil)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("overlapping fragment: %v", err)
+	}
+	if n, b := r.Pending(); n != 0 || b != 0 {
+		t.Errorf("%d datagrams and %d bytes pending", n, b)
+	}
+	// the remaining fragments start a new datagram that never completes
+	if p, err := r.Add(testIPv4Fragment(t, 1, 16, false, data[16:], nil)); p != nil || err != nil {
+		t.Errorf("fragment after overlap: %v", err)
+	}
+
+	// a fragment ending past the last one is an overlap too
+	r = NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMaxBytes)
+	if _, err := r.Add(testIPv6Fragment(t, 1, 16, false, false, data[16:24])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(testIPv6Fragment(t, 1, 8, true, false, data[8:32])); !errors.Is(err, ErrMalformed) {
+		t.Errorf("fragment past the end: %v", err)
+	}
+}
+
+func TestReassembleTimeout(t *testing.T) {
+	r := NewReassembler(10*time.Millisecond, DefaultReassemblyMaxBytes)
+	data := testDatagram(16)
+	if _, err := r.Add(testIPv4Fragment(t, 1, 0, true, data[:8], nil)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := r.Pending(); n != 1 {
+		t.Fatalf("%d datagrams pending", n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	r.Expire()
+	if n, b := r.Pending(); n != 0 || b != 0 {
+		t.Errorf("%d datagrams and %d bytes pending after expiry", n, b)
+	}
+	if p, err := r.Add(testIPv4Fragment(t, 1, 8, false, data[8:], nil)); p != nil || err != nil {
+		t.Errorf("fragment after expiry: %v", err)
+	}
+}
+
+func TestReassembleMemoryLimit(t *testing.T) {
+	r := NewReassembler(DefaultReassemblyTimeout, 100)
+	data := testDatagram(96)
+
+	// headers count against the limit
+	if _, err := r.Add(testIPv4Fragment(t, 1, 0, true, data[:48], nil)); err != nil {
+		t.Fatal(err)
+	}
+	if n, b := r.Pending(); n != 1 || b != 20+48 {
+		t.Errorf("%d datagrams and %d bytes pending", n, b)
+	}
+	// the oldest datagram makes way for a new one
+	if _, err := r.Add(testIPv4Fragment(t, 2, 0, true, data[:48], nil)); err != nil {
+		t.Fatal(err)
+	}
+	if n, b := r.Pending(); n != 1 || b != 20+48 {
+		t.Errorf("%d datagrams and %d bytes pending after eviction", n, b)
+	}
+	if p, err := r.Add(testIPv4Fragment(t, 1, 48, false, data[48:], nil)); p != nil || err != nil {
+		t.Errorf("fragment of evicted datagram: %v", err)
+	}
+
+	// a datagram that cannot fit at all is dropped, including when the
+	// first fragment's header is what takes it over the limit
+	r = NewReassembler(DefaultReassemblyTimeout, 100)
+	if _, err := r.Add(testIPv4Fragment(t, 3, 8, false, data[:88], nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(testIPv4Fragment(t, 3, 0, true, data[:8], nil)); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("datagram over the limit: %v", err)
+	}
+	if n, b := r.Pending(); n != 0 || b != 0 {
+		t.Errorf("%d datagrams and %d bytes pending", n, b)
+	}
+}
+
+func TestReassembleMaxLength(t *testing.T) {
+	data := testDatagram(8)
+	tests := []struct {
+		name  string
+		first []byte
+		last  []byte
+		ok    bool
+	}{
+		// 20 + 65504 + 8 = 65532
+		{"ipv4", testIPv4Fragment(t, 1, 0, true, data, nil), testIPv4Fragment(t, 1, 65504, false, data, nil), true},
+		// 24 + 65504 + 8 = 65536
+		{"ipv4 options", testIPv4Fragment(t, 1, 0, true, data, []byte{1, 1, 1, 1}), testIPv4Fragment(t, 1, 65504, false, data, nil), false},
+		// payload length 65528 + 8 = 65536
+		{"ipv6 at limit", testIPv6Fragment(t, 1, 0, true, false, data), testIPv6Fragment(t, 1, 65528, false, false, data), false},
+		// payload length 65520 + 8 = 65528, plus an 8-byte extension header
+		{"ipv6", testIPv6Fragment(t, 1, 0, true, false, data), testIPv6Fragment(t, 1, 65520, false, false, data), true},
+		{"ipv6 extension", testIPv6Fragment(t, 1, 0, true, true, data), testIPv6Fragment(t, 1, 65520, false, true, data), false},
+	}
+	for _, test := range tests {
+		// the limit depends on the first fragment's header, so try both orders
+		for _, order := range [][][]byte{{test.first, test.last}, {test.last, test.first}} {
+			r := NewReassembler(DefaultReassemblyTimeout, DefaultReassemblyMaxBytes)
+			var err error
+			for _, fragment := range order {
+				if _, err = r.Add(fragment); err != nil {
+					break
+				}
+			}
+			if test.ok && err != nil || !test.ok && !errors.Is(err, ErrMalformed) {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			if n, _ := r.Pending(); test.ok && n != 1 || !test.ok && n != 0 {
+				t.Errorf("%s: %d datagrams pending", test.name, n)
+			}
+		}
+	}
+}
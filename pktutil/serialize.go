@@ -0,0 +1,276 @@
+package pktutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Minimum size of an Ethernet frame, excluding the frame check sequence.
+const minEthernetFrame = 60
+
+// Default TTL or hop limit of serialized IP packets that leave it unset.
+const defaultHopLimit = 64
+
+// Layer is a header or payload that Serialize can write: *EthernetFrame,
+// *VLANTag, *IPv4Header, *IPv6Header, *TCPHeader, *UDPHeader, *ICMPHeader
+// or Payload.
+type Layer interface {
+	headerLen() int
+	serialize(b []byte, next Layer)
+}
+
+// Payload is the data carried by the innermost header of a serialized
+// packet.
+type Payload []byte
+
+// Returns the number of bytes Serialize produces for layers.
+func SerializedLength(layers ...Layer) int {
+	n := 0
+	for _, l := range layers {
+		n += l.headerLen()
+	}
+	if len(layers) > 0 {
+		if _, ok := layers[0].(*EthernetFrame); ok && n < minEthernetFrame {
+			n = minEthernetFrame
+		}
+	}
+	return n
+}
+
+// Composes layers, outermost first, into a new packet. See SerializeTo.
+func Serialize(layers ...Layer) ([]byte, error) {
+	b := make([]byte, SerializedLength(layers...))
+	n, err := SerializeTo(b, layers...)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// Composes layers, outermost first, into buf and returns the number of
+// bytes written.
+//
+// Fields that follow from the layers are filled in, leaving the layers
+// themselves untouched: ethertypes, IP protocols and next headers when the
+// next layer is one of the above, VLAN tag protocol identifiers, lengths,
+// header lengths, and IPv4, TCP, UDP, ICMP and ICMPv6 checksums. A TTL or
+// hop limit of zero is replaced by 64. TCP and IPv4 options are padded to
+// a multiple of 4 bytes, and frames starting with an Ethernet header to
+// the 60-byte minimum. IPv4 and IPv6 layers ignore their Payload field and
+// IPv6 extension headers must be given as a Payload with an explicit
+// NextHeader.
+func SerializeTo(buf []byte, layers ...Layer) (int, error) {
+	n := SerializedLength(layers...)
+	if len(buf) < n {
+		return 0, fmt.Errorf("serialize: %w: need %d bytes, have %d", io.ErrShortBuffer, n, len(buf))
+	}
+	for i := range buf[:n] {
+		buf[i] = 0
+	}
+
+	end := 0
+	for _, l := range layers {
+		end += l.headerLen()
+	}
+	offsets := make([]int, len(layers))
+	pos := 0
+	for i, l := range layers {
+		var next Layer
+		if i+1 < len(layers) {
+			next = layers[i+1]
+		}
+		offsets[i] = pos
+		l.serialize(buf[pos:end], next)
+		pos += l.headerLen()
+	}
+
+	// checksums are computed innermost first, as they cover what follows
+	for i := len(layers) - 1; i >= 0; i-- {
+		b := buf[offsets[i]:end]
+		switch layers[i].(type) {
+		case *IPv4Header:
+			SetIPv4Checksum(b)
+		case *TCPHeader, *UDPHeader, *ICMPHeader:
+			if i == 0 {
+				continue
+			}
+			ip := buf[offsets[i-1]:end]
+			switch layers[i-1].(type) {
+			case *IPv4Header:
+				setChecksum(ip[:IPv4HeaderLength(ip)], b, layers[i])
+			case *IPv6Header:
+				setChecksum(ip[:40], b, layers[i])
+			}
+		}
+	}
+	return n, nil
+}
+
+// Fills in the checksum of segment, which directly follows the IP header
+// ipHeader.
+func setChecksum(ipHeader, segment []byte, l Layer) {
+	v6 := IsIPv6(ipHeader)
+	var src, dst []byte
+	if v6 {
+		src, dst = ipHeader[8:24], ipHeader[24:40]
+	} else {
+		src, dst = ipHeader[12:16], ipHeader[16:20]
+	}
+	switch l.(type) {
+	case *TCPHeader:
+		binary.BigEndian.PutUint16(segment[16:], TransportChecksum(src, dst, TCP, segment))
+	case *UDPHeader:
+		sum := TransportChecksum(src, dst, UDP, segment)
+		if sum == 0 {
+			sum = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(segment[6:], sum)
+	case *ICMPHeader:
+		if v6 {
+			binary.BigEndian.PutUint16(segment[2:], TransportChecksum(src, dst, IPv6_ICMP, segment))
+		} else {
+			binary.BigEndian.PutUint16(segment[2:], Checksum(segment))
+		}
+	}
+}
+
+// Returns the ethertype identifying l, or def if l is not a network layer.
+func layerEthertype(l Layer, def Ethertype) Ethertype {
+	switch l := l.(type) {
+	case *VLANTag:
+		return l.tpid()
+	case *IPv4Header:
+		return IPv4
+	case *IPv6Header:
+		return IPv6
+	}
+	return def
+}
+
+// Returns the IP protocol identifying l, or def if l is not a transport
+// layer.
+func layerProtocol(l Layer, def IPProtocol, v6 bool) IPProtocol {
+	switch l.(type) {
+	case *TCPHeader:
+		return TCP
+	case *UDPHeader:
+		return UDP
+	case *ICMPHeader:
+		if v6 {
+			return IPv6_ICMP
+		}
+		return ICMP
+	case *IPv4Header:
+		return IPv4Encapsulation
+	case *IPv6Header:
+		return IPv6Encapsulation
+	}
+	return def
+}
+
+func (f *EthernetFrame) headerLen() int {
+	return 14
+}
+
+func (f *EthernetFrame) serialize(b []byte, next Layer) {
+	copy(b[0:6], f.Destination)
+	copy(b[6:12], f.Source)
+	ethertype := layerEthertype(next, f.Ethertype)
+	copy(b[12:14], ethertype[:])
+}
+
+func (t *VLANTag) headerLen() int {
+	return 4
+}
+
+func (t *VLANTag) serialize(b []byte, next Layer) {
+	binary.BigEndian.PutUint16(b[0:], t.TCI())
+	ethertype := layerEthertype(next, t.Ethertype)
+	copy(b[2:4], ethertype[:])
+}
+
+func (h *IPv4Header) headerLen() int {
+	return 20 + pad4(len(h.Options))
+}
+
+func (h *IPv4Header) serialize(b []byte, next Layer) {
+	headerLen := h.headerLen()
+	b[0] = 0x40 | byte(headerLen/4)
+	b[1] = h.DSCP<<2 | h.ECN&0x03
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:], h.Identification)
+	binary.BigEndian.PutUint16(b[6:], uint16(h.Flags)<<13|h.FragmentOffset&0x1FFF)
+	b[8] = h.TTL
+	if b[8] == 0 {
+		b[8] = defaultHopLimit
+	}
+	b[9] = byte(layerProtocol(next, h.Protocol, false))
+	copy(b[12:16], h.Source.To4())
+	copy(b[16:20], h.Destination.To4())
+	copy(b[20:headerLen], h.Options)
+}
+
+func (h *IPv6Header) headerLen() int {
+	return 40
+}
+
+func (h *IPv6Header) serialize(b []byte, next Layer) {
+	binary.BigEndian.PutUint32(b[0:], 6<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0x000FFFFF)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)-40))
+	b[6] = byte(layerProtocol(next, h.NextHeader, true))
+	b[7] = h.HopLimit
+	if b[7] == 0 {
+		b[7] = defaultHopLimit
+	}
+	copy(b[8:24], h.Source.To16())
+	copy(b[24:40], h.Destination.To16())
+}
+
+func (h *TCPHeader) headerLen() int {
+	return 20 + pad4(len(h.Options))
+}
+
+func (h *TCPHeader) serialize(b []byte, next Layer) {
+	headerLen := h.headerLen()
+	binary.BigEndian.PutUint16(b[0:], h.SourcePort)
+	binary.BigEndian.PutUint16(b[2:], h.DestinationPort)
+	binary.BigEndian.PutUint32(b[4:], h.Seq)
+	binary.BigEndian.PutUint32(b[8:], h.Ack)
+	binary.BigEndian.PutUint16(b[12:], uint16(headerLen/4)<<12|uint16(h.Flags&0x01FF))
+	binary.BigEndian.PutUint16(b[14:], h.Window)
+	binary.BigEndian.PutUint16(b[18:], h.Urgent)
+	copy(b[20:headerLen], h.Options)
+}
+
+func (h *UDPHeader) headerLen() int {
+	return 8
+}
+
+func (h *UDPHeader) serialize(b []byte, next Layer) {
+	binary.BigEndian.PutUint16(b[0:], h.SourcePort)
+	binary.BigEndian.PutUint16(b[2:], h.DestinationPort)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+}
+
+func (h *ICMPHeader) headerLen() int {
+	// at least the type-specific header word
+	if len(h.Body) < 4 {
+		return 8
+	}
+	return 4 + len(h.Body)
+}
+
+func (h *ICMPHeader) serialize(b []byte, next Layer) {
+	b[0] = h.Type
+	b[1] = h.Code
+	copy(b[4:], h.Body)
+}
+
+func (p Payload) headerLen() int {
+	return len(p)
+}
+
+func (p Payload) serialize(b []byte, next Layer) {
+	copy(b, p)
+}
@@ -3,18 +3,20 @@
 package taptun
 
 import (
-	"fmt"
-	"io"
+	"os"
 	"strings"
-	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
 
 const (
-	cIFF_TUN   = 0x0001
-	cIFF_TAP   = 0x0002
-	cIFF_NO_PI = 0x1000
+	cIFF_TUN     = 0x0001
+	cIFF_TAP     = 0x0002
+	cIFF_PERSIST = 0x0800
+	cIFF_NO_PI   = 0x1000
+
+	cTUNSETCARRIER = 0x400454e2
+	cTUNGETIFF     = 0x800454d2
 )
 
 type ifReq struct {
@@ -23,9 +25,39 @@ type ifReq struct {
 	pad   [0x28 - 0x10 - 2]byte
 }
 
-func createInterface(fd uintptr, ifName string, isTAP bool) (createdIFName string, err error) {
-	if len(ifName) > 0x10 {
-		return "", fmt.Errorf("interface name '%s' is too long", ifName)
+type ifReqMTU struct {
+	Name [0x10]byte
+	MTU  int32
+	pad  [0x28 - 0x10 - 4]byte
+}
+
+// Opens the device in non-blocking mode so that the runtime poller manages
+// it, which lets Close interrupt pending reads and writes.
+func openDevice(ifName string, isTAP bool, features int) (*os.File, string, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", &os.PathError{Op: "open", Path: "/dev/net/tun", Err: err}
+	}
+	name, err := createInterface(uintptr(fd), ifName, isTAP, features)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, "", err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), name, nil
+}
+
+// Duplicates fd into a new, separately pollable file.
+func dupFile(fd uintptr) (*os.File, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_DUPFD_CLOEXEC, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return os.NewFile(r, "/dev/net/tun"), nil
+}
+
+func createInterface(fd uintptr, ifName string, isTAP bool, features int) (createdIFName string, err error) {
+	if len(ifName) >= 0x10 {
+		return "", ErrNameTooLong
 	}
 	var req ifReq
 	if isTAP {
@@ -33,6 +65,9 @@ func createInterface(fd uintptr, ifName string, isTAP bool) (createdIFName strin
 	} else {
 		req.Flags = cIFF_TUN | cIFF_NO_PI
 	}
+	// TUNSETIFF replaces the feature flags of an existing device, and
+	// fails if they disagree on multi-queue
+	req.Flags |= uint16(features) &^ cIFF_PERSIST
 	copy(req.Name[:], ifName)
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TUNSETIFF), uintptr(unsafe.Pointer(&req)))
 	if errno != 0 {
@@ -53,154 +88,67 @@ func setPersistent(fd uintptr, persistent bool) error {
 	return nil
 }
 
-type wrapper struct {
-	fd uintptr // atomic uintptr
-}
-
-func wrap(ifce *Interface) (*wrapper, error) {
-	// grab the file descriptor
-	fd := ifce.file.Fd()
-
-	// validate that the file descriptor can be used in a select call
-	if fd < 0 || fd >= syscall.FD_SETSIZE {
-		return nil, fmt.Errorf("file descriptor cannot be used with select(2)")
-	}
-
-	// set the file descriptor in non-blocking mode
-	if err := syscall.SetNonblock(int(fd), true); err != nil {
-		return nil, err
+func isPersistent(fd uintptr) (bool, error) {
+	var req ifReq
+	if err := ioctl(fd, cTUNGETIFF, uintptr(unsafe.Pointer(&req))); err != nil {
+		return false, err
 	}
-
-	return &wrapper{fd}, nil
+	return req.Flags&cIFF_PERSIST != 0, nil
 }
 
-func (w *wrapper) Write(p []byte) (n int, err error) {
-	ptr := &w.fd
-	ready := true
-	for {
-		// grab current fd and bail if already stopped
-		current := atomic.LoadUintptr(ptr)
-		fd := int(current)
-		if fd < 0 {
-			return 0, io.EOF
-		}
-
-		// attempt write if descriptor is ready
-		if ready {
-			n, err := syscall.Write(fd, p)
-			if err != nil && err != syscall.EAGAIN || n > 0 {
-				return n, err
-			}
-		}
-
-		// wait for fd to become ready
-		selected, err := waitFD(fd, false)
-		if err != nil {
-			return 0, err
-		}
-		ready = selected
-	}
+func setOwner(fd uintptr, uid int) error {
+	return ioctl(fd, syscall.TUNSETOWNER, uintptr(uid))
 }
 
-func (w *wrapper) Read(p []byte) (n int, err error) {
-	ptr := &w.fd
-	ready := true
-	for {
-		// grab current fd and bail if already stopped
-		current := atomic.LoadUintptr(ptr)
-		fd := int(current)
-		if fd < 0 {
-			return 0, io.EOF
-		}
-
-		// attempt read if descriptor is ready
-		if ready {
-			n, err := syscall.Read(fd, p)
-			if err != nil && err != syscall.EAGAIN || n > 0 {
-				return n, err
-			}
-		}
-
-		// wait for fd to become ready
-		selected, err := waitFD(fd, true)
-		if err != nil {
-			return 0, err
-		}
-		ready = selected
-	}
+func setGroup(fd uintptr, gid int) error {
+	return ioctl(fd, syscall.TUNSETGROUP, uintptr(gid))
 }
 
-func (w *wrapper) Stop() bool {
-	ptr := &w.fd
-	for {
-		// grab current fd and bail if already stopped
-		old := atomic.LoadUintptr(ptr)
-		fd := int(old)
-		if fd < 0 {
-			return false
-		}
-
-		// replace fd with stopped marker
-		newFD := -1
-		new := uintptr(newFD)
-		if atomic.CompareAndSwapUintptr(ptr, old, new) {
-			return true
-		}
+func setCarrier(fd uintptr, on bool) error {
+	// TUNSETCARRIER takes a pointer to an int, unlike TUNSETPERSIST
+	var val int32 = 0
+	if on {
+		val = 1
 	}
+	return ioctl(fd, cTUNSETCARRIER, uintptr(unsafe.Pointer(&val)))
 }
 
-/*
-Related issue: https://golang.org/issue/500. In this case, the tap/tun
-device reads and writes are definitely not mapped to select, so we have
-to emulate the related macros (FD_SET, FD_ISSET, etc) directly.
-*/
-
-const (
-	fdBits = syscall.FD_SETSIZE / len(syscall.FdSet{}.Bits)
-)
+func setMTU(ifName string, mtu int) error {
+	var req ifReqMTU
+	copy(req.Name[:], ifName)
+	req.MTU = int32(mtu)
+	return socketIoctl(syscall.SIOCSIFMTU, unsafe.Pointer(&req))
+}
 
-func waitFD(fd int, read bool) (bool, error) {
-	nfd := fd + 1
-
-	var off int
-	var index uint
-	switch fdBits {
-	case 16:
-		off = fd >> 4
-		index = uint(fd & 0x0F)
-	case 32:
-		off = fd >> 5
-		index = uint(fd & 0x1F)
-	case 64:
-		off = fd >> 6
-		index = uint(fd & 0x3F)
-	case 128:
-		off = fd >> 7
-		index = uint(fd & 0x7F)
-	default:
-		return false, fmt.Errorf("unexpected FdSet element size")
+func setUp(ifName string, up bool) error {
+	var req ifReq
+	copy(req.Name[:], ifName)
+	if err := socketIoctl(syscall.SIOCGIFFLAGS, unsafe.Pointer(&req)); err != nil {
+		return err
 	}
-
-	set := syscall.FdSet{}
-	eset := syscall.FdSet{}
-	set.Bits[off] |= 1 << index
-	eset.Bits[off] |= 1 << index
-
-	tv := syscall.Timeval{Sec: 1}
-
-	var n int
-	var err error
-	if read {
-		n, err = syscall.Select(nfd, &set, nil, &eset, &tv)
+	if up {
+		req.Flags |= syscall.IFF_UP
 	} else {
-		n, err = syscall.Select(nfd, nil, &set, &eset, &tv)
+		req.Flags &^= syscall.IFF_UP
 	}
+	return socketIoctl(syscall.SIOCSIFFLAGS, unsafe.Pointer(&req))
+}
 
-	if err != nil {
-		return false, err
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	if errno != 0 {
+		return errno
 	}
+	return nil
+}
 
-	// We're only waiting on one file descriptor, so there is no need to
-	// check which file descriptor is ready.
-	return n > 0, nil
+// Interface-level ioctls (MTU, flags) are issued on an ordinary socket
+// rather than on the TUN/TAP file descriptor.
+func socketIoctl(request uintptr, arg unsafe.Pointer) error {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sock)
+	return ioctl(uintptr(sock), request, uintptr(arg))
 }
@@ -0,0 +1,216 @@
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+const (
+	ipHeaderLen  = 20
+	udpHeaderLen = 8
+	// run ID, sequence number and send timestamp
+	stampLen      = 24
+	minPacketSize = ipHeaderLen + udpHeaderLen + stampLen
+
+	// sequence number of the packet that ends a run
+	endMarker = ^uint64(0)
+
+	// how long the writer waits on a full window before assuming loss
+	lossTimeout = 5 * time.Millisecond
+
+	// how long the reader waits for a packet before giving up on a run
+	readTimeout = time.Second
+)
+
+var (
+	runID uint64
+	epoch = time.Now()
+)
+
+// Returns a benchmark that sends b.N packets of the given size from p.src
+// and receives them on p.dst, reporting throughput, latency percentiles,
+// read/write syscalls per packet and loss.
+func benchmark(p *pair, size int) func(b *testing.B) {
+	return func(b *testing.B) {
+		runID++
+		id := runID
+		template := udpPacket(size)
+		latencies := make([]time.Duration, 0, b.N)
+		tokens := make(chan struct{}, window)
+		done := make(chan struct{})
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		var writeErr error
+		go func() {
+			defer wg.Done()
+			writeErr = send(p, template, id, b.N, tokens, done)
+		}()
+		stopSender := func() {
+			close(done)
+			wg.Wait()
+		}
+
+		// a blocked read only returns once the pair is closed, so close it
+		// if nothing arrives in time, including every end marker
+		var timedOut int32
+		watchdog := time.AfterFunc(readTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			p.close()
+		})
+		defer watchdog.Stop()
+
+		b.SetBytes(int64(size))
+		syscallsBefore := syscalls()
+		b.ResetTimer()
+		start := time.Now()
+
+		var received int
+		buf := make([]byte, 65536)
+		for {
+			n, err := p.dst.Read(buf)
+			if err != nil {
+				stopSender()
+				if atomic.LoadInt32(&timedOut) != 0 {
+					b.Fatalf("no packets received for %s", readTimeout)
+				}
+				b.Fatal(err)
+			}
+			pkt := buf[:n]
+			// ignore unrelated traffic such as IPv6 router solicitations
+			if n < minPacketSize || pkt[0]>>4 != 4 || pkt[9] != 17 {
+				continue
+			}
+			stamp := pkt[ipHeaderLen+udpHeaderLen:]
+			if binary.BigEndian.Uint64(stamp[0:]) != id {
+				continue
+			}
+			watchdog.Reset(readTimeout)
+			if binary.BigEndian.Uint64(stamp[8:]) == endMarker {
+				break
+			}
+			sent := time.Duration(binary.BigEndian.Uint64(stamp[16:]))
+			latencies = append(latencies, time.Since(epoch)-sent)
+			received++
+			select {
+			case <-tokens:
+			default:
+			}
+		}
+
+		elapsed := time.Since(start)
+		b.StopTimer()
+		watchdog.Stop()
+		stopSender()
+		if writeErr != nil {
+			b.Fatal(writeErr)
+		}
+
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		b.ReportMetric(float64(received)/elapsed.Seconds(), "pps")
+		b.ReportMetric(float64(percentile(latencies, 50).Nanoseconds()), "p50-ns")
+		b.ReportMetric(float64(percentile(latencies, 99).Nanoseconds()), "p99-ns")
+		b.ReportMetric(float64(syscalls()-syscallsBefore)/float64(b.N), "syscalls/op")
+		b.ReportMetric(100*float64(b.N-received)/float64(b.N), "loss-%")
+	}
+}
+
+func send(p *pair, template []byte, id uint64, count int, tokens chan struct{}, done chan struct{}) error {
+	pkt := make([]byte, len(template))
+	copy(pkt, template)
+	stamp := pkt[ipHeaderLen+udpHeaderLen:]
+	binary.BigEndian.PutUint64(stamp[0:], id)
+
+	timer := time.NewTimer(lossTimeout)
+	defer timer.Stop()
+	for seq := 0; seq < count; seq++ {
+		select {
+		case tokens <- struct{}{}:
+		default:
+			// window is full; wait for the reader, then assume loss
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(lossTimeout)
+			select {
+			case tokens <- struct{}{}:
+			case <-timer.C:
+			}
+		}
+		binary.BigEndian.PutUint64(stamp[8:], uint64(seq))
+		binary.BigEndian.PutUint64(stamp[16:], uint64(time.Since(epoch)))
+		if _, err := p.src.Write(pkt); err != nil {
+			return err
+		}
+	}
+
+	// keep sending end markers until the reader has seen one
+	binary.BigEndian.PutUint64(stamp[8:], endMarker)
+	for {
+		if _, err := p.src.Write(pkt); err != nil {
+			return err
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Builds an IPv4/UDP packet of the given total size from srcIP to dstIP.
+func udpPacket(size int) []byte {
+	pkt := make([]byte, size)
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(size))
+	pkt[6] = 0x40 // don't fragment
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:], srcIP)
+	copy(pkt[16:], dstIP)
+	pktutil.SetIPv4Checksum(pkt)
+
+	udp := pkt[ipHeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:], 9000)
+	binary.BigEndian.PutUint16(udp[2:], 9000)
+	binary.BigEndian.PutUint16(udp[4:], uint16(size-ipHeaderLen))
+	// a zero UDP checksum is permitted over IPv4 and lets the payload vary
+	return pkt
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// Returns the number of read and write syscalls issued by this process.
+func syscalls() uint64 {
+	b, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0
+	}
+	var total uint64
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "syscr:") || strings.HasPrefix(line, "syscw:") {
+			v, _ := strconv.ParseUint(strings.TrimSpace(line[6:]), 10, 64)
+			total += v
+		}
+	}
+	return total
+}
@@ -0,0 +1,52 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func BenchmarkTaptun(b *testing.B) {
+	b.Run("pipe", func(b *testing.B) {
+		benchmarkPaths(b, setupPipe)
+	})
+	b.Run("netns", func(b *testing.B) {
+		// the namespace belongs to this thread, which exits with the benchmark
+		runtime.LockOSThread()
+		setup, err := setupNetns()
+		if err != nil {
+			b.Skip(err)
+		}
+		benchmarkPaths(b, setup)
+	})
+}
+
+// Runs a sub-benchmark for every path and packet size. Pairs are set up on
+// the calling goroutine, which may be locked to a namespace's thread.
+func benchmarkPaths(b *testing.B, setup setupFunc) {
+	packetSizes, err := parseSizes(sizes)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, path := range strings.Split(paths, ",") {
+		for _, size := range packetSizes {
+			p, err := setup(path)
+			if err == errSkip {
+				break
+			}
+			if errors.Is(err, os.ErrPermission) {
+				b.Skip(err)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s/size=%d", path, size), benchmark(p, size))
+			p.close()
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/catalyzeio/taptun"
+)
+
+// Settings, with the defaults also used by go test -bench.
+var (
+	mode   = "auto"
+	paths  = "interface,accessor"
+	sizes  = "64,512,1024,1500"
+	window = 64
+)
+
+// Addresses used for the device pair. Packets are written to tun A from
+// srcIP, forwarded by the kernel, and read from tun B addressed to dstIP.
+var (
+	netA  = mustCIDR("10.201.0.1/24")
+	netB  = mustCIDR("10.202.0.1/24")
+	srcIP = net.IPv4(10, 201, 0, 2).To4()
+	dstIP = net.IPv4(10, 202, 0, 2).To4()
+)
+
+// A packet source and sink under test.
+type pair struct {
+	src   io.Writer
+	dst   io.Reader
+	close func()
+}
+
+type setupFunc func(path string) (*pair, error)
+
+// Returned by a setupFunc for paths that cannot be measured in a mode.
+var errSkip = errors.New("path not available in this mode")
+
+func main() {
+	flag.StringVar(&mode, "mode", mode, "traffic mode: netns, pipe or auto")
+	flag.StringVar(&paths, "paths", paths, "comma-separated I/O paths to measure")
+	flag.StringVar(&sizes, "sizes", sizes, "comma-separated IP packet sizes")
+	flag.IntVar(&window, "window", window, "maximum number of packets in flight")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		fmt.Printf("Error benchmarking tun/tap device: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	packetSizes, err := parseSizes(sizes)
+	if err != nil {
+		return err
+	}
+
+	// device setup must happen in the namespace created on this thread
+	runtime.LockOSThread()
+
+	setup, err := selectMode()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range strings.Split(paths, ",") {
+		for _, size := range packetSizes {
+			p, err := setup(path)
+			if err == errSkip {
+				fmt.Printf("Skipping %s path in %s mode\n", path, mode)
+				break
+			}
+			if err != nil {
+				return err
+			}
+			r := testing.Benchmark(benchmark(p, size))
+			p.close()
+			fmt.Printf("BenchmarkTaptun/%s/%s/size=%d\t%s\n", mode, path, size, r)
+		}
+	}
+	return nil
+}
+
+func selectMode() (setupFunc, error) {
+	switch mode {
+	case "netns":
+		return setupNetns()
+	case "pipe":
+		return setupPipe, nil
+	case "auto":
+		setup, err := setupNetns()
+		if err == nil {
+			mode = "netns"
+			return setup, nil
+		}
+		fmt.Printf("Falling back to pipe mode: %s\n", err)
+		mode = "pipe"
+		return setupPipe, nil
+	}
+	return nil, fmt.Errorf("unknown mode '%s'", mode)
+}
+
+// Moves this thread into a private network namespace with forwarding
+// enabled, so traffic can flow between two tun devices.
+func setupNetns() (setupFunc, error) {
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		return nil, fmt.Errorf("could not create network namespace: %s", err)
+	}
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return nil, err
+	}
+	return setupTUN, nil
+}
+
+func setupTUN(path string) (*pair, error) {
+	a, err := newTUN(netA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newTUN(netB)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	p := &pair{
+		src: a,
+		dst: b,
+		close: func() {
+			a.Close()
+			b.Close()
+		},
+	}
+	switch path {
+	case "interface":
+		return p, nil
+	case "accessor":
+		accA, err := a.Accessor()
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		accB, err := b.Accessor()
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.src = accA
+		p.dst = accB
+		p.close = func() {
+			accA.Stop()
+			accB.Stop()
+			a.Close()
+			b.Close()
+		}
+		return p, nil
+	}
+	p.close()
+	return nil, fmt.Errorf("unknown path '%s'", path)
+}
+
+func newTUN(addr *net.IPNet) (*taptun.Interface, error) {
+	i, err := taptun.NewTUN("")
+	if err != nil {
+		return nil, err
+	}
+	if err := i.AddAddress(addr); err != nil {
+		i.Close()
+		return nil, err
+	}
+	if err := i.SetUp(true); err != nil {
+		i.Close()
+		return nil, err
+	}
+	return i, nil
+}
+
+// Emulates a packet device with a SOCK_SEQPACKET socket pair, which keeps
+// packet boundaries and requires no privileges.
+func setupPipe(path string) (*pair, error) {
+	if path != "interface" {
+		return nil, errSkip
+	}
+	// non-blocking sockets use the runtime poller, so closing them wakes a
+	// blocked read
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	src := os.NewFile(uintptr(fds[0]), "pipe-src")
+	dst := os.NewFile(uintptr(fds[1]), "pipe-dst")
+	return &pair{
+		src: src,
+		dst: dst,
+		close: func() {
+			src.Close()
+			dst.Close()
+		},
+	}, nil
+}
+
+func parseSizes(s string) ([]int, error) {
+	var result []int
+	for _, field := range strings.Split(s, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if size < minPacketSize || size > 65535 {
+			return nil, fmt.Errorf("packet size %d out of range [%d, 65535]", size, minPacketSize)
+		}
+		result = append(result, size)
+	}
+	return result, nil
+}
+
+func mustCIDR(s string) *net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	ipNet.IP = ip
+	return ipNet
+}
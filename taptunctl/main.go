@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/catalyzeio/taptun"
+)
+
+// Exit codes.
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitPermission  = 4
+	exitExists      = 5
+	exitUnsupported = 6
+)
+
+var jsonOutput bool
+
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+type commandFunc func(args []string) error
+
+var commands = map[string]commandFunc{
+	"create": create,
+	"delete": del,
+	"list":   list,
+	"show":   show,
+	"set":    set,
+}
+
+func main() {
+	flag.BoolVar(&jsonOutput, "json", false, "whether to print results as JSON")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fail(usageError(fmt.Sprintf("unknown command '%s'", args[0])))
+	}
+	if err := cmd(args[1:]); err != nil {
+		fail(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [-json] <command> [options] [name]
+
+Commands:
+  create   create a persistent TUN/TAP device
+  delete   delete a persistent TUN/TAP device
+  list     list TUN/TAP devices
+  show     show a TUN/TAP device
+  set      change settings of a TUN/TAP device
+
+Run '%s <command> -h' for command options.
+`, os.Args[0], os.Args[0])
+}
+
+func fail(err error) {
+	code := exitCode(err)
+	if jsonOutput {
+		json.NewEncoder(os.Stderr).Encode(struct {
+			Error string `json:"error"`
+			Code  int    `json:"code"`
+		}{err.Error(), code})
+	} else {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+	}
+	os.Exit(code)
+}
+
+func exitCode(err error) int {
+	var uerr usageError
+	switch {
+	case errors.As(err, &uerr):
+		return exitUsage
+	case errors.Is(err, taptun.ErrUnsupported):
+		return exitUnsupported
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ENODEV), errors.Is(err, taptun.ErrNotTUNTAP):
+		return exitNotFound
+	case errors.Is(err, os.ErrPermission):
+		return exitPermission
+	case errors.Is(err, os.ErrExist), errors.Is(err, syscall.EBUSY):
+		return exitExists
+	}
+	return exitFailure
+}
+
+func create(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	tap := fs.Bool("tap", false, "whether to create a TAP device instead of a TUN device")
+	owner := fs.String("owner", "", "user allowed to use the device")
+	group := fs.String("group", "", "group allowed to use the device")
+	mtu := fs.Int("mtu", 0, "device MTU")
+	up := fs.Bool("up", false, "whether to bring the device up")
+	var addrs addrList
+	fs.Var(&addrs, "addr", "address to assign, in CIDR notation (repeatable)")
+	fs.Parse(args)
+
+	name, err := optionalName(fs)
+	if err != nil {
+		return err
+	}
+	// attaching to an existing device would succeed, so check up front
+	if name != "" && !strings.Contains(name, "%") {
+		if _, err := taptun.LookupDevice(name); err == nil {
+			return &taptun.Error{Op: "create", Name: name, Err: os.ErrExist}
+		}
+	}
+
+	var ifce *taptun.Interface
+	if *tap {
+		ifce, err = taptun.NewTAP(name)
+	} else {
+		ifce, err = taptun.NewTUN(name)
+	}
+	if err != nil {
+		return err
+	}
+	defer ifce.Close()
+
+	success := false
+	defer func() {
+		if !success {
+			ifce.SetPersistent(false)
+		}
+	}()
+
+	if err := ifce.SetPersistent(true); err != nil {
+		return err
+	}
+	if *owner != "" {
+		uid, err := lookupUser(*owner)
+		if err != nil {
+			return err
+		}
+		if err := ifce.SetOwner(uid); err != nil {
+			return err
+		}
+	}
+	if *group != "" {
+		gid, err := lookupGroup(*group)
+		if err != nil {
+			return err
+		}
+		if err := ifce.SetGroup(gid); err != nil {
+			return err
+		}
+	}
+	if *mtu > 0 {
+		if err := ifce.SetMTU(*mtu); err != nil {
+			return err
+		}
+	}
+	for _, addr := range addrs {
+		if err := ifce.AddAddress(addr); err != nil {
+			return err
+		}
+	}
+	if *up {
+		if err := ifce.SetUp(true); err != nil {
+			return err
+		}
+	}
+	success = true
+
+	return printDevice(ifce.Name())
+}
+
+func del(args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	fs.Parse(args)
+
+	name, err := requiredName(fs)
+	if err != nil {
+		return err
+	}
+	if err := taptun.DeleteDevice(name); err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(struct {
+			Name    string `json:"name"`
+			Deleted bool   `json:"deleted"`
+		}{name, true})
+	}
+	fmt.Printf("Deleted %s\n", name)
+	return nil
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return usageError("list does not take any arguments")
+	}
+
+	devices, err := taptun.Devices()
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		out := make([]*deviceJSON, 0, len(devices))
+		for _, info := range devices {
+			out = append(out, toJSON(info))
+		}
+		return printJSON(out)
+	}
+	for _, info := range devices {
+		fmt.Printf("%-16s %s\n", info.Name, summary(info))
+	}
+	return nil
+}
+
+func show(args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	fs.Parse(args)
+
+	name, err := requiredName(fs)
+	if err != nil {
+		return err
+	}
+	return printDevice(name)
+}
+
+func set(args []string) error {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	persist := fs.Bool("persist", true, "whether the device is persistent")
+	owner := fs.String("owner", "", "user allowed to use the device")
+	group := fs.String("group", "", "group allowed to use the device")
+	mtu := fs.Int("mtu", 0, "device MTU")
+	carrier := fs.Bool("carrier", true, "whether the device reports a carrier")
+	up := fs.Bool("up", false, "bring the device up")
+	down := fs.Bool("down", false, "bring the device down")
+	var addrs, delAddrs addrList
+	fs.Var(&addrs, "addr", "address to assign, in CIDR notation (repeatable)")
+	fs.Var(&delAddrs, "deladdr", "address to remove, in CIDR notation (repeatable)")
+	fs.Parse(args)
+
+	name, err := requiredName(fs)
+	if err != nil {
+		return err
+	}
+	if *up && *down {
+		return usageError("-up and -down are mutually exclusive")
+	}
+	visited := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		visited[f.Name] = true
+	})
+	if len(visited) == 0 {
+		return usageError("nothing to set")
+	}
+
+	ifce, err := taptun.OpenDevice(name)
+	if err != nil {
+		return err
+	}
+	defer ifce.Close()
+
+	if visited["persist"] {
+		if err := ifce.SetPersistent(*persist); err != nil {
+			return err
+		}
+	}
+	if visited["owner"] {
+		uid, err := lookupUser(*owner)
+		if err != nil {
+			return err
+		}
+		if err := ifce.SetOwner(uid); err != nil {
+			return err
+		}
+	}
+	if visited["group"] {
+		gid, err := lookupGroup(*group)
+		if err != nil {
+			return err
+		}
+		if err := ifce.SetGroup(gid); err != nil {
+			return err
+		}
+	}
+	if visited["mtu"] {
+		if err := ifce.SetMTU(*mtu); err != nil {
+			return err
+		}
+	}
+	if visited["carrier"] {
+		if err := ifce.SetCarrier(*carrier); err != nil {
+			return err
+		}
+	}
+	for _, addr := range delAddrs {
+		if err := ifce.RemoveAddress(addr); err != nil {
+			return err
+		}
+	}
+	for _, addr := range addrs {
+		if err := ifce.AddAddress(addr); err != nil {
+			return err
+		}
+	}
+	if *up || *down {
+		if err := ifce.SetUp(*up); err != nil {
+			return err
+		}
+	}
+
+	if visited["persist"] && !*persist {
+		// the device goes away once this process closes it
+		return nil
+	}
+	return printDevice(name)
+}
+
+func optionalName(fs *flag.FlagSet) (string, error) {
+	switch fs.NArg() {
+	case 0:
+		return "", nil
+	case 1:
+		return fs.Arg(0), nil
+	}
+	return "", usageError(fmt.Sprintf("%s takes at most one device name", fs.Name()))
+}
+
+func requiredName(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		return "", usageError(fmt.Sprintf("%s requires exactly one device name", fs.Name()))
+	}
+	return fs.Arg(0), nil
+}
+
+func lookupUser(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, usageError(err.Error())
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, usageError(err.Error())
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+type addrList []*net.IPNet
+
+func (l *addrList) String() string {
+	var s []string
+	for _, addr := range *l {
+		s = append(s, addr.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *addrList) Set(value string) error {
+	ip, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	ipNet.IP = ip
+	*l = append(*l, ipNet)
+	return nil
+}
+
+type deviceJSON struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Persistent   bool     `json:"persistent"`
+	Owner        int      `json:"owner"`
+	Group        int      `json:"group"`
+	MTU          int      `json:"mtu"`
+	Up           bool     `json:"up"`
+	Carrier      bool     `json:"carrier"`
+	HardwareAddr string   `json:"hardwareAddr,omitempty"`
+	Addrs        []string `json:"addrs"`
+}
+
+func toJSON(info *taptun.DeviceInfo) *deviceJSON {
+	d := &deviceJSON{
+		Name:       info.Name,
+		Type:       deviceType(info),
+		Persistent: info.Persistent,
+		Owner:      info.Owner,
+		Group:      info.Group,
+		MTU:        info.MTU,
+		Up:         info.Up,
+		Carrier:    info.Carrier,
+		Addrs:      []string{},
+	}
+	if len(info.HardwareAddr) > 0 {
+		d.HardwareAddr = info.HardwareAddr.String()
+	}
+	for _, addr := range info.Addrs {
+		d.Addrs = append(d.Addrs, addr.String())
+	}
+	return d
+}
+
+func deviceType(info *taptun.DeviceInfo) string {
+	if info.TAP {
+		return "tap"
+	}
+	return "tun"
+}
+
+func summary(info *taptun.DeviceInfo) string {
+	parts := []string{deviceType(info), fmt.Sprintf("mtu %d", info.MTU)}
+	if info.Up {
+		parts = append(parts, "up")
+	} else {
+		parts = append(parts, "down")
+	}
+	if info.Carrier {
+		parts = append(parts, "carrier")
+	}
+	if info.Persistent {
+		parts = append(parts, "persistent")
+	}
+	return strings.Join(parts, " ")
+}
+
+func printDevice(name string) error {
+	info, err := taptun.LookupDevice(name)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(toJSON(info))
+	}
+	fmt.Printf("%s: %s\n", info.Name, summary(info))
+	if info.Owner >= 0 {
+		fmt.Printf("    owner: %d\n", info.Owner)
+	}
+	if info.Group >= 0 {
+		fmt.Printf("    group: %d\n", info.Group)
+	}
+	if len(info.HardwareAddr) > 0 {
+		fmt.Printf("    hwaddr: %s\n", info.HardwareAddr)
+	}
+	for _, addr := range info.Addrs {
+		fmt.Printf("    addr: %s\n", addr)
+	}
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/catalyzeio/taptun"
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+var (
+	tap      bool
+	accessor bool
+	name     string
+	addr     string
+	respond  bool
+	quiet    bool
+	interval time.Duration
+)
+
+// MAC address used when answering ARP requests on a tap device.
+var localMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+type counters struct {
+	rxPackets uint64
+	rxBytes   uint64
+	txPackets uint64
+	txBytes   uint64
+}
+
+func main() {
+	flag.BoolVar(&tap, "tap", false, "whether to create a tap device instead of a tun device")
+	flag.BoolVar(&accessor, "accessor", false, "whether to use the accessor interface")
+	flag.StringVar(&name, "name", "", "interface name (default tun%d or tap%d)")
+	flag.StringVar(&addr, "addr", "", "address to assign to the interface, in CIDR notation")
+	flag.BoolVar(&respond, "respond", true, "whether to answer ARP and ICMP echo requests")
+	flag.BoolVar(&quiet, "quiet", false, "whether to suppress per-packet output")
+	flag.DurationVar(&interval, "interval", 5*time.Second, "rate summary interval; 0 disables")
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		fmt.Printf("Error testing tun/tap device: %s\n", err)
+	}
+}
+
+func run() error {
+	i, err := create()
+	if err != nil {
+		return err
+	}
+	defer i.Close()
+
+	ifName := i.Name()
+	fmt.Printf("Created interface %s\n", ifName)
+
+	var localIP net.IP
+	if addr != "" {
+		ip, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return err
+		}
+		ipNet.IP = ip
+		if err := i.AddAddress(ipNet); err != nil {
+			return err
+		}
+		if err := i.SetUp(true); err != nil {
+			return err
+		}
+		localIP = ip
+		fmt.Printf("Configured %s on %s\n", ipNet, ifName)
+	}
+
+	var rw io.ReadWriter = i
+	if accessor {
+		acc, err := i.Accessor()
+		if err != nil {
+			return err
+		}
+		rw = acc
+	}
+
+	c := &counters{}
+	if interval > 0 {
+		go summarize(c, ifName)
+	}
+
+	p := make([]byte, 65536)
+	for {
+		n, err := rw.Read(p)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&c.rxPackets, 1)
+		atomic.AddUint64(&c.rxBytes, uint64(n))
+
+		pkt := p[:n]
+		if !quiet {
+			fmt.Printf("%s: %s\n", ifName, describe(pkt))
+		}
+		if !respond {
+			continue
+		}
+		reply := answer(pkt, localIP)
+		if reply == nil {
+			continue
+		}
+		if _, err := rw.Write(reply); err != nil {
+			return err
+		}
+		atomic.AddUint64(&c.txPackets, 1)
+		atomic.AddUint64(&c.txBytes, uint64(len(reply)))
+	}
+}
+
+func create() (*taptun.Interface, error) {
+	if tap {
+		if name == "" {
+			name = "tap%d"
+		}
+		return taptun.NewTAP(name)
+	}
+	if name == "" {
+		name = "tun%d"
+	}
+	return taptun.NewTUN(name)
+}
+
+func summarize(c *counters, ifName string) {
+	var last counters
+	secs := interval.Seconds()
+	for range time.Tick(interval) {
+		cur := counters{
+			atomic.LoadUint64(&c.rxPackets),
+			atomic.LoadUint64(&c.rxBytes),
+			atomic.LoadUint64(&c.txPackets),
+			atomic.LoadUint64(&c.txBytes),
+		}
+		fmt.Printf("%s: rx %.1f pkt/s %.1f B/s, tx %.1f pkt/s %.1f B/s (total rx %d pkts, tx %d pkts)\n",
+			ifName,
+			float64(cur.rxPackets-last.rxPackets)/secs, float64(cur.rxBytes-last.rxBytes)/secs,
+			float64(cur.txPackets-last.txPackets)/secs, float64(cur.txBytes-last.txBytes)/secs,
+			cur.rxPackets, cur.txPackets)
+		last = cur
+	}
+}
+
+func describe(pkt []byte) string {
+	d := pktutil.Decoder{LinkType: pktutil.LinkTypeRaw}
+	if tap {
+		d.LinkType = pktutil.LinkTypeEthernet
+	}
+	var p pktutil.DecodedPacket
+	err := d.Decode(pkt, &p)
+	s := describeDecoded(&p, len(pkt))
+	if err != nil {
+		s += fmt.Sprintf(" (%s)", err)
+	}
+	return s
+}
+
+// Describes the layers decoded into p, which may stop short of the
+// transport header if the packet was malformed.
+func describeDecoded(p *pktutil.DecodedPacket, n int) string {
+	var prefix string
+	if p.Layers.Has(pktutil.LayerEthernet) {
+		prefix = fmt.Sprintf("%s > %s ", p.Ethernet.Source, p.Ethernet.Destination)
+	} else if tap {
+		return fmt.Sprintf("bad frame, %d bytes", n)
+	}
+	if p.Layers.Has(pktutil.LayerVLAN) {
+		prefix += fmt.Sprintf("vlan %d ", p.VLAN.VID)
+	}
+
+	var version string
+	var src, dst net.IP
+	switch {
+	case p.Layers.Has(pktutil.LayerARP):
+		return prefix + describeARP(&p.ARP)
+	case p.Layers.Has(pktutil.LayerIPv4):
+		version, src, dst = "IPv4", p.IPv4.Source, p.IPv4.Destination
+	case p.Layers.Has(pktutil.LayerIPv6):
+		version, src, dst = "IPv6", p.IPv6.Source, p.IPv6.Destination
+	case p.Ethertype == pktutil.IPv4 || p.Ethertype == pktutil.IPv6 || p.Ethertype == pktutil.ARP:
+		return fmt.Sprintf("%sbad packet, %d bytes", prefix, n)
+	case !tap:
+		return fmt.Sprintf("unknown packet, %d bytes", n)
+	default:
+		return fmt.Sprintf("%sethertype %#04x, %d bytes", prefix, p.Ethertype[:], n)
+	}
+
+	switch {
+	case p.Fragment:
+		return fmt.Sprintf("%s%s %s > %s protocol %d fragment, %d bytes", prefix, version, src, dst, p.Protocol, n)
+	case p.Layers.Has(pktutil.LayerTCP):
+		return fmt.Sprintf("%s%s TCP %s > %s, %d bytes", prefix, version, hostPort(src, p.TCP.SourcePort), hostPort(dst, p.TCP.DestinationPort), n)
+	case p.Layers.Has(pktutil.LayerUDP):
+		return fmt.Sprintf("%s%s UDP %s > %s, %d bytes", prefix, version, hostPort(src, p.UDP.SourcePort), hostPort(dst, p.UDP.DestinationPort), n)
+	case p.Layers.Has(pktutil.LayerICMP) || p.Layers.Has(pktutil.LayerICMPv6):
+		return fmt.Sprintf("%s%s ICMP %s > %s type %d code %d, %d bytes", prefix, version, src, dst, p.ICMP.Type, p.ICMP.Code, n)
+	}
+	return fmt.Sprintf("%s%s %s > %s protocol %d, %d bytes", prefix, version, src, dst, p.Protocol, n)
+}
+
+func hostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+func describeARP(h *pktutil.ARPHeader) string {
+	switch h.Operation {
+	case pktutil.ARPOpRequest:
+		return fmt.Sprintf("ARP who-has %s tell %s", h.TargetProtocolAddr, h.SenderProtocolAddr)
+	case pktutil.ARPOpReply:
+		return fmt.Sprintf("ARP %s is-at %s", h.SenderProtocolAddr, h.SenderHardwareAddr)
+	}
+	return fmt.Sprintf("ARP unknown operation %d", h.Operation)
+}
+
+// Builds a reply to an ARP request or ICMP echo request, or returns nil.
+// Requests for localIP are left to the kernel.
+func answer(pkt []byte, localIP net.IP) []byte {
+	if !tap {
+		return answerICMP(pkt, localIP)
+	}
+	if len(pkt) < 14 || pktutil.MACTagging(pkt) != pktutil.NotTagged {
+		return nil
+	}
+	var payload []byte
+	switch pktutil.MACEthertype(pkt) {
+	case pktutil.ARP:
+		payload = answerARP(pktutil.MACPayload(pkt), localIP)
+	case pktutil.IPv4:
+		payload = answerICMP(pktutil.MACPayload(pkt), localIP)
+	}
+	if payload == nil {
+		return nil
+	}
+	frame := make([]byte, 14+len(payload))
+	copy(frame[0:], pktutil.MACSource(pkt))
+	copy(frame[6:], localMAC)
+	copy(frame[12:], pkt[12:14])
+	copy(frame[14:], payload)
+	return frame
+}
+
+func answerARP(pkt []byte, localIP net.IP) []byte {
+	// only answer Ethernet/IPv4 requests
+	if !pktutil.IsARPEthernetIPv4(pkt) || pktutil.ARPOperation(pkt) != pktutil.ARPOpRequest {
+		return nil
+	}
+	targetIP := pktutil.ARPTargetIP(pkt)
+	senderIP := pktutil.ARPSenderIP(pkt)
+	if targetIP.Equal(localIP) || targetIP.Equal(senderIP) {
+		return nil
+	}
+	return pktutil.NewARPReply(localMAC, targetIP, pktutil.ARPSenderMAC(pkt), senderIP)
+}
+
+func answerICMP(pkt []byte, localIP net.IP) []byte {
+	if len(pkt) < 20 || !pktutil.IsIPv4(pkt) || pktutil.IPv4Destination(pkt).Equal(localIP) {
+		return nil
+	}
+	reply, err := pktutil.ICMPEchoReply(pkt)
+	if err != nil {
+		return nil
+	}
+	return reply
+}
@@ -0,0 +1,23 @@
+/*
+Package taptuntest provides a harness for integration tests that exchange
+real packets between TUN/TAP devices and the kernel network stack.
+
+Each Namespace is a private network namespace bound to a dedicated OS
+thread, so devices, addresses and sockets created through it never touch
+the host's network configuration. Creating a namespace requires
+CAP_NET_ADMIN; without it the calling test is skipped.
+
+	func TestUDP(t *testing.T) {
+		ns := taptuntest.NewNamespace(t)
+		defer ns.Close()
+
+		dev := ns.NewTUN(t, "10.0.0.1/24")
+		conn := ns.ListenUDP(t, "10.0.0.1:9000")
+
+		// write an IPv4/UDP packet from 10.0.0.2 into dev and read it
+		// from conn, or send on conn and read the packet from dev
+		pkt, err := dev.ReadPacket(time.Second)
+		...
+	}
+*/
+package taptuntest
@@ -0,0 +1,277 @@
+package taptuntest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catalyzeio/taptun"
+)
+
+// Returned by Device.ReadPacket when no packet arrives in time.
+var ErrTimeout = errors.New("timed out waiting for packet")
+
+// Returned by Namespace.Do after the namespace is closed.
+var ErrClosed = errors.New("namespace closed")
+
+// Namespace is a private network namespace for a single test.
+type Namespace struct {
+	funcs chan func()
+
+	mu      sync.Mutex
+	closed  bool
+	devices []*Device
+	conns   []net.Conn
+}
+
+// Creates a new network namespace with the loopback device up. Skips the
+// test if the process lacks the privileges to create namespaces or TUN/TAP
+// devices.
+func NewNamespace(tb testing.TB) *Namespace {
+	tb.Helper()
+	funcs := make(chan func())
+	if err := startNamespace(funcs); err != nil {
+		close(funcs)
+		tb.Skipf("network namespaces unavailable: %s", err)
+	}
+	return &Namespace{funcs: funcs}
+}
+
+// Runs fn on the namespace's thread. Anything that depends on the current
+// network namespace, such as creating devices or sockets, must happen here.
+// Returns ErrClosed once the namespace is closed.
+func (ns *Namespace) Do(fn func() error) error {
+	done := make(chan error)
+	ns.mu.Lock()
+	if ns.closed {
+		ns.mu.Unlock()
+		return ErrClosed
+	}
+	// sending under the lock keeps Close from closing funcs meanwhile
+	ns.funcs <- func() {
+		done <- fn()
+	}
+	ns.mu.Unlock()
+	return <-done
+}
+
+// Closes all devices and sockets created through the namespace and
+// releases its thread.
+func (ns *Namespace) Close() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.closed {
+		return
+	}
+	ns.closed = true
+	for _, c := range ns.conns {
+		c.Close()
+	}
+	for _, d := range ns.devices {
+		d.close()
+	}
+	close(ns.funcs)
+}
+
+// Creates a TUN device in the namespace. If addr is not empty, it is
+// assigned to the device in CIDR notation and the device is brought up.
+func (ns *Namespace) NewTUN(tb testing.TB, addr string) *Device {
+	tb.Helper()
+	return ns.newDevice(tb, false, addr)
+}
+
+// Creates a TAP device in the namespace. If addr is not empty, it is
+// assigned to the device in CIDR notation and the device is brought up.
+func (ns *Namespace) NewTAP(tb testing.TB, addr string) *Device {
+	tb.Helper()
+	return ns.newDevice(tb, true, addr)
+}
+
+func (ns *Namespace) newDevice(tb testing.TB, tap bool, addr string) *Device {
+	tb.Helper()
+	var ipNet *net.IPNet
+	if addr != "" {
+		ip, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		n.IP = ip
+		ipNet = n
+	}
+
+	var d *Device
+	err := ns.Do(func() error {
+		var ifce *taptun.Interface
+		var err error
+		if tap {
+			ifce, err = taptun.NewTAP("")
+		} else {
+			ifce, err = taptun.NewTUN("")
+		}
+		if err != nil {
+			return err
+		}
+		if ipNet != nil {
+			if err := ifce.AddAddress(ipNet); err != nil {
+				ifce.Close()
+				return err
+			}
+			if err := ifce.SetUp(true); err != nil {
+				ifce.Close()
+				return err
+			}
+		}
+		d, err = newDevice(ifce, ipNet)
+		return err
+	})
+	if errors.Is(err, os.ErrPermission) {
+		// EPERM or EACCES: namespaces may be allowed where devices are not
+		tb.Skipf("TUN/TAP devices unavailable: %s", err)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ns.mu.Lock()
+	ns.devices = append(ns.devices, d)
+	ns.mu.Unlock()
+	return d
+}
+
+// Opens a UDP socket in the namespace bound to addr (host:port).
+func (ns *Namespace) ListenUDP(tb testing.TB, addr string) *net.UDPConn {
+	tb.Helper()
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var conn *net.UDPConn
+	err = ns.Do(func() error {
+		var err error
+		conn, err = net.ListenUDP("udp", udpAddr)
+		return err
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ns.track(conn)
+	return conn
+}
+
+// Opens a connected UDP socket in the namespace.
+func (ns *Namespace) DialUDP(tb testing.TB, addr string) *net.UDPConn {
+	tb.Helper()
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var conn *net.UDPConn
+	err = ns.Do(func() error {
+		var err error
+		conn, err = net.DialUDP("udp", nil, udpAddr)
+		return err
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ns.track(conn)
+	return conn
+}
+
+func (ns *Namespace) track(c net.Conn) {
+	ns.mu.Lock()
+	ns.conns = append(ns.conns, c)
+	ns.mu.Unlock()
+}
+
+// Device is a TUN/TAP device inside a Namespace. Packets are read in the
+// background so reads can time out.
+type Device struct {
+	*taptun.Interface
+	Addr *net.IPNet
+
+	acc     taptun.Accessor
+	packets chan []byte
+}
+
+func newDevice(ifce *taptun.Interface, addr *net.IPNet) (*Device, error) {
+	acc, err := ifce.Accessor()
+	if err != nil {
+		ifce.Close()
+		return nil, err
+	}
+	d := &Device{
+		Interface: ifce,
+		Addr:      addr,
+		acc:       acc,
+		packets:   make(chan []byte, 256),
+	}
+	go d.readLoop()
+	return d, nil
+}
+
+func (d *Device) readLoop() {
+	defer close(d.packets)
+	buf := make([]byte, 65536)
+	for {
+		n, err := d.acc.Read(buf)
+		if err != nil {
+			return
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf)
+		select {
+		case d.packets <- pkt:
+		default:
+			// drop, like the kernel would with a full queue
+		}
+	}
+}
+
+// Returns the next packet (TUN) or frame (TAP) sent to the device by the
+// kernel, waiting up to timeout.
+func (d *Device) ReadPacket(timeout time.Duration) ([]byte, error) {
+	select {
+	case pkt, ok := <-d.packets:
+		if !ok {
+			return nil, io.EOF
+		}
+		return pkt, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Returns the next packet accepted by match, discarding others such as
+// IPv6 router solicitations, waiting up to timeout in total.
+func (d *Device) ReadMatching(timeout time.Duration, match func(pkt []byte) bool) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, ErrTimeout
+		}
+		pkt, err := d.ReadPacket(remaining)
+		if err != nil {
+			return nil, err
+		}
+		if match(pkt) {
+			return pkt, nil
+		}
+	}
+}
+
+// Injects a packet (TUN) or frame (TAP) into the kernel stack.
+func (d *Device) WritePacket(pkt []byte) error {
+	_, err := d.acc.Write(pkt)
+	return err
+}
+
+func (d *Device) close() {
+	d.acc.Stop()
+	d.Interface.Close()
+}
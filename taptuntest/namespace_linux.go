@@ -0,0 +1,66 @@
+// +build linux
+
+package taptuntest
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Starts a goroutine locked to a thread in a new network namespace. The
+// thread is discarded when the goroutine exits, since it cannot rejoin the
+// original namespace cleanly.
+func startNamespace(funcs chan func()) error {
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		return err
+	}
+	result := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			result <- err
+			return
+		}
+		if err := setLinkUp("lo"); err != nil {
+			result <- err
+			return
+		}
+		result <- nil
+		for fn := range funcs {
+			fn()
+		}
+	}()
+	return <-result
+}
+
+type ifReq struct {
+	Name  [0x10]byte
+	Flags uint16
+	pad   [0x28 - 0x10 - 2]byte
+}
+
+func setLinkUp(ifName string) error {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sock)
+
+	var req ifReq
+	copy(req.Name[:], ifName)
+	if err := ioctl(sock, syscall.SIOCGIFFLAGS, &req); err != nil {
+		return err
+	}
+	req.Flags |= syscall.IFF_UP
+	return ioctl(sock, syscall.SIOCSIFFLAGS, &req)
+}
+
+func ioctl(fd int, request uintptr, req *ifReq) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(unsafe.Pointer(req)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package taptuntest
+
+import (
+	"github.com/catalyzeio/taptun"
+)
+
+func startNamespace(funcs chan func()) error {
+	return taptun.ErrUnsupported
+}
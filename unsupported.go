@@ -3,31 +3,66 @@
 package taptun
 
 import (
-	"fmt"
+	"net"
+	"os"
 )
 
-func createInterface(fd uintptr, ifName string, isTAP bool) (string, error) {
-	return "", fmt.Errorf("unsupported platform")
+func openDevice(ifName string, isTAP bool, features int) (*os.File, string, error) {
+	return nil, "", ErrUnsupported
+}
+
+func dupFile(fd uintptr) (*os.File, error) {
+	return nil, ErrUnsupported
+}
+
+func isPersistent(fd uintptr) (bool, error) {
+	return false, ErrUnsupported
 }
 
 func setPersistent(fd uintptr, persistent bool) error {
-	return fmt.Errorf("unsupported platform")
+	return ErrUnsupported
 }
 
-type wrapper struct{}
+func setOwner(fd uintptr, uid int) error {
+	return ErrUnsupported
+}
+
+func setGroup(fd uintptr, gid int) error {
+	return ErrUnsupported
+}
+
+func setCarrier(fd uintptr, on bool) error {
+	return ErrUnsupported
+}
+
+func setMTU(ifName string, mtu int) error {
+	return ErrUnsupported
+}
+
+func setUp(ifName string, up bool) error {
+	return ErrUnsupported
+}
+
+func addAddress(ifName string, addr *net.IPNet) error {
+	return ErrUnsupported
+}
+
+func removeAddress(ifName string, addr *net.IPNet) error {
+	return ErrUnsupported
+}
 
-func wrap(ifce *Interface) (*wrapper, error) {
-	return nil, fmt.Errorf("unsupported platform")
+func addRoute(ifName string, route *Route) error {
+	return ErrUnsupported
 }
 
-func (w *wrapper) Write(p []byte) (int, error) {
-	return 0, fmt.Errorf("unsupported platform")
+func removeRoute(ifName string, route *Route) error {
+	return ErrUnsupported
 }
 
-func (w *wrapper) Read(p []byte) (n int, err error) {
-	return 0, fmt.Errorf("unsupported platform")
+func listDevices() ([]string, error) {
+	return nil, ErrUnsupported
 }
 
-func (w *wrapper) Stop() bool {
-	return false
+func lookupDevice(name string) (*DeviceInfo, error) {
+	return nil, ErrUnsupported
 }
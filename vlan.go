@@ -0,0 +1,234 @@
+package taptun
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+const (
+	// Number of frames queued for a VLAN before further frames are dropped.
+	vlanQueueLen = 64
+
+	// Largest frame the demultiplexer reads from the trunk.
+	maxFrameSize = 65536
+)
+
+// VLANDemux splits the traffic of a TAP device carrying tagged frames into
+// per-VLAN Accessors that see untagged frames.
+type VLANDemux struct {
+	trunk  Accessor
+	native int
+
+	mu       sync.Mutex
+	vlans    map[uint16]*vlanAccessor
+	unknown  map[uint16]uint64
+	untagged uint64
+	dropped  uint64
+	err      error
+}
+
+// VLANDemuxStats counts frames a VLANDemux could not deliver.
+type VLANDemuxStats struct {
+	// Frames per VLAN identifier with no open VLAN.
+	Unknown map[uint16]uint64
+	// Untagged frames received without a native VLAN.
+	Untagged uint64
+	// Frames discarded because a VLAN's queue was full.
+	Dropped uint64
+}
+
+// Creates a demultiplexer reading frames from the TAP interface ifce.
+// Untagged frames belong to the native VLAN nativeVID, which sends its
+// frames untagged as well; a nativeVID of -1 means there is none.
+func NewVLANDemux(ifce *Interface, nativeVID int) (*VLANDemux, error) {
+	if !ifce.IsTAP() {
+		return nil, fmt.Errorf("vlan demux on %s: not a TAP device", ifce.Name())
+	}
+	if nativeVID < -1 || nativeVID > 4094 {
+		return nil, fmt.Errorf("invalid native VLAN %d", nativeVID)
+	}
+	trunk, err := ifce.Accessor()
+	if err != nil {
+		return nil, err
+	}
+	return newVLANDemux(trunk, nativeVID), nil
+}
+
+func newVLANDemux(trunk Accessor, nativeVID int) *VLANDemux {
+	d := &VLANDemux{
+		trunk:   trunk,
+		native:  nativeVID,
+		vlans:   make(map[uint16]*vlanAccessor),
+		unknown: make(map[uint16]uint64),
+	}
+	go d.run()
+	return d
+}
+
+// Opens an Accessor for the VLAN vid. Reads return frames received with
+// that VLAN's tag removed, and written frames are tagged before being sent,
+// except on the native VLAN. Stopping the Accessor closes the VLAN again.
+func (d *VLANDemux) Open(vid uint16) (Accessor, error) {
+	if vid == 0 || vid > 4094 {
+		return nil, fmt.Errorf("invalid VLAN %d", vid)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if _, ok := d.vlans[vid]; ok {
+		return nil, fmt.Errorf("VLAN %d is already open", vid)
+	}
+	v := &vlanAccessor{
+		demux:  d,
+		vid:    vid,
+		frames: make(chan []byte, vlanQueueLen),
+		done:   make(chan struct{}),
+	}
+	d.vlans[vid] = v
+	return v, nil
+}
+
+// Returns a snapshot of the frames that could not be delivered.
+func (d *VLANDemux) Stats() VLANDemuxStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	unknown := make(map[uint16]uint64, len(d.unknown))
+	for vid, n := range d.unknown {
+		unknown[vid] = n
+	}
+	return VLANDemuxStats{
+		Unknown:  unknown,
+		Untagged: d.untagged,
+		Dropped:  d.dropped,
+	}
+}
+
+// Stops the demultiplexer and all of its VLAN Accessors. The interface
+// itself is left open.
+func (d *VLANDemux) Close() error {
+	d.trunk.Stop()
+	d.shutdown(io.EOF)
+	return nil
+}
+
+// Reads frames from the trunk until it is stopped or fails.
+func (d *VLANDemux) run() {
+	buf := make([]byte, maxFrameSize)
+	for {
+		n, err := d.trunk.Read(buf)
+		if err != nil {
+			d.shutdown(err)
+			return
+		}
+		d.dispatch(buf[:n])
+	}
+}
+
+func (d *VLANDemux) dispatch(frame []byte) {
+	if len(frame) < 14 {
+		return
+	}
+	var vid int
+	var payload []byte
+	if tag, ok := pktutil.MACOuterVLAN(frame); ok && tag.VID != 0 {
+		vid = int(tag.VID)
+		payload, _, _ = pktutil.PopVLAN(frame)
+	} else if ok {
+		// priority-tagged frames belong to the native VLAN
+		vid = d.native
+		payload, _, _ = pktutil.PopVLAN(frame)
+	} else {
+		vid = d.native
+		payload = append([]byte(nil), frame...)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if vid < 0 {
+		d.untagged++
+		return
+	}
+	v, ok := d.vlans[uint16(vid)]
+	if !ok {
+		d.unknown[uint16(vid)]++
+		return
+	}
+	select {
+	case v.frames <- payload:
+	default:
+		d.dropped++
+	}
+}
+
+// Stops all VLAN Accessors and makes further calls to Open return err.
+func (d *VLANDemux) shutdown(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		d.err = err
+	}
+	for vid, v := range d.vlans {
+		close(v.done)
+		delete(d.vlans, vid)
+	}
+}
+
+func (d *VLANDemux) send(vid uint16, frame []byte) (int, error) {
+	if int(vid) != d.native {
+		tagged, err := pktutil.PushVLAN(frame, pktutil.VLANTag{VID: vid})
+		if err != nil {
+			return 0, err
+		}
+		if _, err := d.trunk.Write(tagged); err != nil {
+			return 0, err
+		}
+		return len(frame), nil
+	}
+	return d.trunk.Write(frame)
+}
+
+func (d *VLANDemux) release(v *vlanAccessor) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.vlans[v.vid] != v {
+		return false
+	}
+	close(v.done)
+	delete(d.vlans, v.vid)
+	return true
+}
+
+// vlanAccessor is the Accessor of one VLAN of a VLANDemux.
+type vlanAccessor struct {
+	demux  *VLANDemux
+	vid    uint16
+	frames chan []byte
+	done   chan struct{}
+}
+
+func (v *vlanAccessor) Read(p []byte) (n int, err error) {
+	select {
+	case frame := <-v.frames:
+		return copy(p, frame), nil
+	case <-v.done:
+		return 0, io.EOF
+	}
+}
+
+func (v *vlanAccessor) Write(p []byte) (n int, err error) {
+	select {
+	case <-v.done:
+		return 0, io.EOF
+	default:
+	}
+	return v.demux.send(v.vid, p)
+}
+
+func (v *vlanAccessor) Stop() bool {
+	return v.demux.release(v)
+}
@@ -0,0 +1,215 @@
+package taptun
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catalyzeio/taptun/pktutil"
+)
+
+// fakeTrunk is an Accessor standing in for a TAP device. Frames sent on in
+// are read by the demultiplexer; since in is unbuffered, a send returns only
+// after the previous frame was dispatched.
+type fakeTrunk struct {
+	in   chan []byte
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func newFakeTrunk() *fakeTrunk {
+	return &fakeTrunk{
+		in:   make(chan []byte),
+		out:  make(chan []byte, 16),
+		done: make(chan struct{}),
+	}
+}
+
+func (f *fakeTrunk) Read(p []byte) (int, error) {
+	select {
+	case frame := <-f.in:
+		return copy(p, frame), nil
+	case <-f.done:
+		return 0, io.EOF
+	}
+}
+
+func (f *fakeTrunk) Write(p []byte) (int, error) {
+	f.out <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (f *fakeTrunk) Stop() bool {
+	stopped := false
+	f.once.Do(func() {
+		close(f.done)
+		stopped = true
+	})
+	return stopped
+}
+
+// Waits until every frame sent so far has been dispatched.
+func (f *fakeTrunk) flush() {
+	// too short to be a frame, so it is ignored
+	f.in <- []byte{0}
+}
+
+func testVLANFrame(t *testing.T, payload string) []byte {
+	t.Helper()
+	frame, err := pktutil.Serialize(&pktutil.EthernetFrame{
+		Destination: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		Source:      net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		Ethertype:   pktutil.IPv4,
+	}, pktutil.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func testTagged(t *testing.T, frame []byte, tag pktutil.VLANTag) []byte {
+	t.Helper()
+	tagged, err := pktutil.PushVLAN(frame, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tagged
+}
+
+func readVLAN(t *testing.T, acc Accessor) []byte {
+	t.Helper()
+	frames := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, maxFrameSize)
+		n, err := acc.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		frames <- buf[:n]
+	}()
+	select {
+	case frame := <-frames:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("timed out reading VLAN")
+		return nil
+	}
+}
+
+func TestVLANDemuxDispatch(t *testing.T) {
+	trunk := newFakeTrunk()
+	d := newVLANDemux(trunk, 1)
+	defer d.Close()
+	vlan5, err := d.Open(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := d.Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := testVLANFrame(t, "tagged")
+	trunk.in <- testTagged(t, frame, pktutil.VLANTag{VID: 5})
+	if got := readVLAN(t, vlan5); !bytes.Equal(got, frame) {
+		t.Errorf("VLAN 5 read %x, want %x", got, frame)
+	}
+
+	frame = testVLANFrame(t, "untagged")
+	trunk.in <- frame
+	if got := readVLAN(t, native); !bytes.Equal(got, frame) {
+		t.Errorf("native VLAN read %x, want %x", got, frame)
+	}
+
+	frame = testVLANFrame(t, "priority")
+	trunk.in <- testTagged(t, frame, pktutil.VLANTag{VID: 0, PCP: 5})
+	if got := readVLAN(t, native); !bytes.Equal(got, frame) {
+		t.Errorf("priority-tagged read %x, want %x", got, frame)
+	}
+}
+
+func TestVLANDemuxWrite(t *testing.T) {
+	trunk := newFakeTrunk()
+	d := newVLANDemux(trunk, 1)
+	defer d.Close()
+	vlan5, err := d.Open(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := d.Open(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := testVLANFrame(t, "out")
+	if n, err := vlan5.Write(frame); n != len(frame) || err != nil {
+		t.Errorf("VLAN 5 write: %d, %v", n, err)
+	}
+	if got, want := <-trunk.out, testTagged(t, frame, pktutil.VLANTag{VID: 5}); !bytes.Equal(got, want) {
+		t.Errorf("VLAN 5 sent %x, want %x", got, want)
+	}
+	if n, err := native.Write(frame); n != len(frame) || err != nil {
+		t.Errorf("native VLAN write: %d, %v", n, err)
+	}
+	if got := <-trunk.out; !bytes.Equal(got, frame) {
+		t.Errorf("native VLAN sent %x, want %x", got, frame)
+	}
+
+	vlan5.Stop()
+	if _, err := vlan5.Write(frame); err != io.EOF {
+		t.Errorf("write after Stop: %v", err)
+	}
+}
+
+func TestVLANDemuxStats(t *testing.T) {
+	trunk := newFakeTrunk()
+	d := newVLANDemux(trunk, -1)
+	defer d.Close()
+	if _, err := d.Open(5); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := testVLANFrame(t, "stats")
+	trunk.in <- frame
+	trunk.in <- testTagged(t, frame, pktutil.VLANTag{VID: 0})
+	trunk.in <- testTagged(t, frame, pktutil.VLANTag{VID: 7})
+	// VLAN 5 is never read, so the last frame overflows its queue
+	for i := 0; i <= vlanQueueLen; i++ {
+		trunk.in <- testTagged(t, frame, pktutil.VLANTag{VID: 5})
+	}
+	trunk.flush()
+
+	stats := d.Stats()
+	if stats.Untagged != 2 || stats.Dropped != 1 || len(stats.Unknown) != 1 || stats.Unknown[7] != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestVLANDemuxOpen(t *testing.T) {
+	trunk := newFakeTrunk()
+	d := newVLANDemux(trunk, -1)
+	for _, vid := range []uint16{0, 4095} {
+		if _, err := d.Open(vid); err == nil {
+			t.Errorf("opened VLAN %d", vid)
+		}
+	}
+	vlan5, err := d.Open(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Open(5); err == nil {
+		t.Error("opened VLAN 5 twice")
+	}
+
+	d.Close()
+	if _, err := vlan5.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("read after Close: %v", err)
+	}
+	if _, err := d.Open(6); err != io.EOF {
+		t.Errorf("Open after Close: %v", err)
+	}
+}